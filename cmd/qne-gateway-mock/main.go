@@ -0,0 +1,82 @@
+// Command qne-gateway-mock serves a local stand-in for the QNE gateway so a
+// node and protoloader can be run without network access:
+//
+//	go run ./cmd/qne-gateway-mock -protos ./protos
+//	go run . -gateway-url http://localhost:4444
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/qnepff/qne-node-v12/internal/gatewaytest"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:4444", "listen address")
+	caDir := flag.String("ca-dir", "", "directory to keep the CA and registry signing key in across restarts, new ones are generated when empty")
+	protoDir := flag.String("protos", "", "directory of .proto files to serve, subdirectories become namespaces")
+	segment := flag.String("segment", "segment-1", "segment ID assigned to nodes")
+	lifetime := flag.Duration("cert-lifetime", 24*time.Hour, "validity of issued node certificates")
+	quiet := flag.Bool("quiet", false, "do not log requests")
+	flag.Parse()
+
+	cfg := gatewaytest.Config{
+		CertLifetime: *lifetime,
+		SegmentID:    *segment,
+	}
+	if !*quiet {
+		cfg.Logger = log.Default()
+	}
+	if *caDir != "" {
+		ca, err := gatewaytest.LoadOrCreateCA(*caDir)
+		if err != nil {
+			log.Fatalf("Failed to load CA: %v", err)
+		}
+		cfg.CA = ca
+
+		key, err := gatewaytest.LoadOrCreateRegistryKey(*caDir)
+		if err != nil {
+			log.Fatalf("Failed to load registry key: %v", err)
+		}
+		cfg.RegistryKey = key
+		log.Printf("Protos are signed with the key in %s", filepath.Join(*caDir, "registry.pub"))
+	}
+
+	gateway, err := gatewaytest.New(cfg)
+	if err != nil {
+		log.Fatalf("Failed to create gateway: %v", err)
+	}
+	if *protoDir != "" {
+		count, err := gateway.LoadProtoDir(*protoDir)
+		if err != nil {
+			log.Fatalf("Failed to load protos: %v", err)
+		}
+		log.Printf("Serving %d protos from %s", count, *protoDir)
+	}
+
+	server := &http.Server{Addr: *addr, Handler: gateway}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Mock QNE gateway listening on http://%s", *addr)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Server error: %v", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/qnepff/qne-node-v12/internal/protoloader"
+)
+
+// cacheStats is the JSON output of cache stats
+type cacheStats struct {
+	CacheDir      string `json:"cache_dir"`
+	CacheFiles    int    `json:"cache_files"`
+	CacheBytes    int64  `json:"cache_bytes"`
+	CompiledDir   string `json:"compiled_dir"`
+	CompiledItems int    `json:"compiled_items"`
+	CompiledBytes int64  `json:"compiled_bytes"`
+}
+
+func runCache(ctx context.Context, args []string) int {
+	fs := newFlagSet("cache")
+	lf := addLoaderFlags(fs)
+	maxAge := fs.Duration("max-age", protoloader.DefaultCacheLimits.MaxDiskAge, "prune: remove files not used for longer")
+	maxBytes := fs.Int64("max-bytes", protoloader.DefaultCacheLimits.MaxDiskBytes, "prune: shrink each directory to this size")
+	args, ok := parseArgs(fs, args, 1, 1)
+	if !ok {
+		return 2
+	}
+	loader, err := lf.loader()
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	switch args[0] {
+	case "stats":
+		usage, err := loader.DiskUsage()
+		if err != nil {
+			return fail("%v", err)
+		}
+		stats := cacheStats{
+			CacheDir:      *lf.cacheDir,
+			CacheFiles:    usage.CacheFiles,
+			CacheBytes:    usage.CacheBytes,
+			CompiledDir:   *lf.compiledDir,
+			CompiledItems: usage.CompiledItems,
+			CompiledBytes: usage.CompiledBytes,
+		}
+		return lf.output(stats, func() {
+			fmt.Printf("%s: %d files, %s\n", stats.CacheDir, stats.CacheFiles, formatBytes(stats.CacheBytes))
+			fmt.Printf("%s: %d protos, %s\n", stats.CompiledDir, stats.CompiledItems, formatBytes(stats.CompiledBytes))
+		})
+	case "prune":
+		limits := protoloader.DefaultCacheLimits
+		limits.MaxDiskAge = *maxAge
+		limits.MaxDiskBytes = *maxBytes
+		loader.SetCacheLimits(limits)
+		removed, err := loader.CollectGarbage()
+		if err != nil {
+			return fail("%v", err)
+		}
+		return printRemoved(lf, removed)
+	case "clear":
+		removed, err := loader.ClearCache()
+		if err != nil {
+			return fail("%v", err)
+		}
+		return printRemoved(lf, removed)
+	}
+	fs.Usage()
+	return 2
+}
+
+func printRemoved(lf loaderFlags, removed int) int {
+	return lf.output(map[string]int{"removed": removed}, func() {
+		fmt.Printf("Removed %d files and directories\n", removed)
+	})
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// runCompat compares two versions of a proto. It exits with status 1 when
+// the new version breaks the wire format, or with -source any source
+// compatibility too, so it can gate a release.
+func runCompat(ctx context.Context, args []string) int {
+	fs := newFlagSet("compat")
+	lf := addLoaderFlags(fs)
+	source := fs.Bool("source", false, "fail on source-breaking changes too")
+	args, ok := parseArgs(fs, args, 2, 3)
+	if !ok {
+		return 2
+	}
+	id, err := parseID(args[0])
+	if err != nil {
+		return fail("%v", err)
+	}
+	newVersion := ""
+	if len(args) == 3 {
+		newVersion = args[2]
+	}
+
+	loader, err := lf.loader()
+	if err != nil {
+		return fail("%v", err)
+	}
+	report, err := loader.CheckCompatibility(ctx, id, args[1], newVersion)
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	status := lf.output(report, func() {
+		fmt.Printf("%s %s -> %s\n", report.Name, report.OldVersion, report.NewVersion)
+		for _, c := range report.Changes {
+			fmt.Printf("  %s\n", c)
+		}
+		switch {
+		case report.WireBreaking:
+			fmt.Println("wire-breaking")
+		case report.SourceBreaking:
+			fmt.Println("source-breaking, compatible on the wire")
+		default:
+			fmt.Println("compatible")
+		}
+	})
+	if status == 0 && (report.WireBreaking || (*source && report.SourceBreaking)) {
+		status = 1
+	}
+	return status
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/qnepff/qne-node-v12/internal/protoloader"
+)
+
+// targetFlag adds the -target flag of compile and path
+func targetFlag(fs *flag.FlagSet) *stringList {
+	builtin := []string{
+		protoloader.TargetGo,
+		protoloader.TargetTypeScript,
+		protoloader.TargetProtobufES,
+		protoloader.TargetPython,
+		protoloader.TargetDescriptorSet,
+	}
+	targets := &stringList{}
+	fs.Var(targets, "target", "code generation target, repeatable or comma separated: "+
+		strings.Join(builtin, ", ")+" (default go)")
+	return targets
+}
+
+func runCompile(ctx context.Context, args []string) int {
+	fs := newFlagSet("compile")
+	lf := addLoaderFlags(fs)
+	targets := targetFlag(fs)
+	args, ok := parseArgs(fs, args, 1, 1)
+	if !ok {
+		return 2
+	}
+	id, err := parseID(args[0])
+	if err != nil {
+		return fail("%v", err)
+	}
+	if len(*targets) == 0 {
+		*targets = stringList{protoloader.TargetGo}
+	}
+	loader, err := lf.loader()
+	if err != nil {
+		return fail("%v", err)
+	}
+	if err := loader.CompileProto(ctx, id, *targets...); err != nil {
+		return fail("%v", err)
+	}
+	return printPaths(lf, loader, id, *targets)
+}
+
+func runPath(ctx context.Context, args []string) int {
+	fs := newFlagSet("path")
+	lf := addLoaderFlags(fs)
+	targets := targetFlag(fs)
+	args, ok := parseArgs(fs, args, 1, 1)
+	if !ok {
+		return 2
+	}
+	id, err := parseID(args[0])
+	if err != nil {
+		return fail("%v", err)
+	}
+	if len(*targets) == 0 {
+		*targets = stringList{protoloader.TargetGo}
+	}
+	loader, err := lf.loader()
+	if err != nil {
+		return fail("%v", err)
+	}
+	return printPaths(lf, loader, id, *targets)
+}
+
+// printPaths prints the output directory of each target, one per line, or
+// as a JSON object keyed by target
+func printPaths(lf loaderFlags, loader *protoloader.ProtoLoader, id int64, targets []string) int {
+	paths := make(map[string]string, len(targets))
+	for _, target := range targets {
+		path, err := loader.GetCompiledProtoPath(id, target)
+		if err != nil {
+			return fail("%s: %v", target, err)
+		}
+		paths[target] = path
+	}
+	return lf.output(paths, func() {
+		for _, target := range targets {
+			if len(targets) == 1 {
+				fmt.Println(paths[target])
+			} else {
+				fmt.Printf("%s\t%s\n", target, paths[target])
+			}
+		}
+	})
+}
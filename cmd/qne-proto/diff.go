@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change
+const diffContext = 3
+
+// diffResult is the JSON output of diff
+type diffResult struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	OldVersion string `json:"old_version"`
+	NewVersion string `json:"new_version"`
+	Diff       string `json:"diff"` // Unified diff, empty when unchanged
+}
+
+// runDiff prints a unified diff between two versions of a proto. Like
+// diff(1) it exits with status 1 when they differ.
+func runDiff(ctx context.Context, args []string) int {
+	fs := newFlagSet("diff")
+	lf := addLoaderFlags(fs)
+	args, ok := parseArgs(fs, args, 3, 3)
+	if !ok {
+		return 2
+	}
+	id, err := parseID(args[0])
+	if err != nil {
+		return fail("%v", err)
+	}
+	loader, err := lf.loader()
+	if err != nil {
+		return fail("%v", err)
+	}
+	oldProto, err := loader.GetProtoVersion(ctx, id, args[1])
+	if err != nil {
+		return fail("%v", err)
+	}
+	newProto, err := loader.GetProtoVersion(ctx, id, args[2])
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	result := diffResult{
+		ID:         id,
+		Name:       newProto.Name,
+		OldVersion: oldProto.Version,
+		NewVersion: newProto.Version,
+		Diff: unified(
+			fmt.Sprintf("%s@%s", oldProto.Name, oldProto.Version),
+			fmt.Sprintf("%s@%s", newProto.Name, newProto.Version),
+			diffLines(splitLines(oldProto.Content), splitLines(newProto.Content))),
+	}
+	status := lf.output(result, func() {
+		fmt.Print(result.Diff)
+	})
+	if status == 0 && result.Diff != "" {
+		status = 1
+	}
+	return status
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// edit is a line kept (' '), removed ('-') or added ('+')
+type edit struct {
+	op   byte
+	line string
+}
+
+// diffLines returns a shortest edit script from a to b, with Myers'
+// algorithm
+func diffLines(a, b []string) []edit {
+	n, m := len(a), len(b)
+	max := n + m
+	off := max
+	v := make([]int, 2*max+2)
+	var trace [][]int
+
+search:
+	for d := 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	// Walk back from the end through the furthest points of each step
+	var edits []edit
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+			prevK = k + 1
+		}
+		prevX := v[off+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			edits = append(edits, edit{' ', a[x-1]})
+			x--
+			y--
+		}
+		if d == 0 {
+			break
+		}
+		if x == prevX {
+			edits = append(edits, edit{'+', b[y-1]})
+			y--
+		} else {
+			edits = append(edits, edit{'-', a[x-1]})
+			x--
+		}
+	}
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+// unified formats an edit script as a unified diff, or returns an empty
+// string when nothing changed
+func unified(oldName, newName string, edits []edit) string {
+	// Mark the changes and the context around them
+	show := make([]bool, len(edits))
+	changed := false
+	for i, e := range edits {
+		if e.op == ' ' {
+			continue
+		}
+		changed = true
+		for j := i - diffContext; j <= i+diffContext; j++ {
+			if j >= 0 && j < len(edits) {
+				show[j] = true
+			}
+		}
+	}
+	if !changed {
+		return ""
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+	oldLine, newLine := 0, 0
+	for i := 0; i < len(edits); {
+		if !show[i] {
+			oldLine++
+			newLine++
+			i++
+			continue
+		}
+		end := i
+		for end < len(edits) && show[end] {
+			end++
+		}
+		oldCount, newCount := 0, 0
+		for _, e := range edits[i:end] {
+			if e.op != '+' {
+				oldCount++
+			}
+			if e.op != '-' {
+				newCount++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(oldLine, oldCount), hunkRange(newLine, newCount))
+		for _, e := range edits[i:end] {
+			fmt.Fprintf(&out, "%c%s\n", e.op, e.line)
+		}
+		oldLine += oldCount
+		newLine += newCount
+		i = end
+	}
+	return out.String()
+}
+
+// hunkRange formats the lines of a hunk after the first skipped ones
+func hunkRange(skipped, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", skipped)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", skipped+1)
+	}
+	return fmt.Sprintf("%d,%d", skipped+1, count)
+}
@@ -0,0 +1,199 @@
+// Command qne-proto works with the QNE proto registry from the shell:
+//
+//	go run ./cmd/qne-proto list chat
+//	go run ./cmd/qne-proto compile 123 -target go -target ts
+//	go run ./cmd/qne-proto compat 123 v1 v2
+//
+// The registry is reached through the gateway given by -gateway-url or
+// QNE_GATEWAY_URL. Every command prints JSON with -json. Commands exit with
+// status 1 when the check they run fails and 2 on errors.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/qnepff/qne-node-v12/internal/protoloader"
+)
+
+// command is a subcommand. run returns the exit status.
+type command struct {
+	usage string
+	help  string
+	run   func(ctx context.Context, args []string) int
+}
+
+// commands is filled in init, as commands refer to it for their usage
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"namespaces": {"", "list the registry's namespaces", runNamespaces},
+		"list":       {"[namespace]", "list protos, of one namespace or all", runList},
+		"get":        {"<id>", "print a proto", runGet},
+		"search":     {"<term>", "find protos by name, namespace or content", runSearch},
+		"compile":    {"<id>", "generate code for a proto", runCompile},
+		"path":       {"<id>", "print the directory of a proto's generated code", runPath},
+		"cache":      {"stats|prune|clear", "inspect and clean the local cache", runCache},
+		"diff":       {"<id> <old-version> <new-version>", "show how a proto changed between versions", runDiff},
+		"compat":     {"<id> <old-version> [new-version]", "check whether a new version of a proto breaks the old one", runCompat},
+	}
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "qne-proto: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	status := cmd.run(ctx, flag.Args()[1:])
+	stop()
+	os.Exit(status)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: qne-proto <command> [flags] [args]\n\ncommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].help)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun qne-proto <command> -help for its flags.")
+}
+
+// loaderFlags are the flags every command takes to reach the registry and
+// the local cache
+type loaderFlags struct {
+	gatewayURL   *string
+	cacheDir     *string
+	compiledDir  *string
+	trustAnchors *string
+	jsonOutput   *bool
+}
+
+func addLoaderFlags(fs *flag.FlagSet) loaderFlags {
+	home, _ := os.UserHomeDir()
+	return loaderFlags{
+		gatewayURL:   fs.String("gateway-url", envOr("QNE_GATEWAY_URL", "https://qne.name"), "QNE gateway server URL (QNE_GATEWAY_URL)"),
+		cacheDir:     fs.String("cache-dir", envOr("QNE_PROTO_CACHE_DIR", filepath.Join(home, ".qne", "proto-cache")), "directory of downloaded protos (QNE_PROTO_CACHE_DIR)"),
+		compiledDir:  fs.String("compiled-dir", envOr("QNE_PROTO_COMPILED_DIR", filepath.Join(home, ".qne", "proto-compiled")), "directory of generated code (QNE_PROTO_COMPILED_DIR)"),
+		trustAnchors: fs.String("trust-anchors", os.Getenv("QNE_TRUST_ANCHORS"), "PEM file of registry keys protos must be signed with, required to load protos (QNE_TRUST_ANCHORS)"),
+		jsonOutput:   fs.Bool("json", false, "print machine-readable JSON"),
+	}
+}
+
+func (f loaderFlags) loader() (*protoloader.ProtoLoader, error) {
+	loader, err := protoloader.New(*f.gatewayURL, *f.cacheDir, *f.compiledDir)
+	if err != nil {
+		return nil, err
+	}
+	if *f.trustAnchors != "" {
+		keys, err := protoloader.LoadTrustAnchors(*f.trustAnchors)
+		if err != nil {
+			return nil, err
+		}
+		loader.SetTrustAnchors(keys...)
+	}
+	return loader, nil
+}
+
+// output prints v as JSON with -json, or calls text otherwise
+func (f loaderFlags) output(v interface{}, text func()) int {
+	if !*f.jsonOutput {
+		text()
+		return 0
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return fail("%v", err)
+	}
+	return 0
+}
+
+func envOr(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// newFlagSet returns the flag set of a command, with usage naming its
+// arguments
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: qne-proto %s [flags] %s\n\n%s\n\nflags:\n", name, commands[name].usage, commands[name].help)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses flags given before, between or after the arguments of a
+// command, and checks the number of arguments
+func parseArgs(fs *flag.FlagSet, args []string, min, max int) ([]string, bool) {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	if len(positional) < min || len(positional) > max {
+		fs.Usage()
+		return nil, false
+	}
+	return positional, true
+}
+
+func fail(format string, args ...interface{}) int {
+	fmt.Fprintf(os.Stderr, "qne-proto: "+format+"\n", args...)
+	return 2
+}
+
+func parseID(arg string) (int64, error) {
+	id, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid proto ID %q", arg)
+	}
+	return id, nil
+}
+
+// stringList is a flag that can be given several times, or as a comma
+// separated list
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ",") }
+
+func (s *stringList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*s = append(*s, v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/qnepff/qne-node-v12/internal/protoloader"
+)
+
+// protoSummary is a proto as listed, without its content
+type protoSummary struct {
+	ID        int64  `json:"id"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+}
+
+func summarize(p *protoloader.Proto) protoSummary {
+	return protoSummary{ID: p.ID, Namespace: p.Namespace, Name: p.Name, Version: p.Version}
+}
+
+func runNamespaces(ctx context.Context, args []string) int {
+	fs := newFlagSet("namespaces")
+	lf := addLoaderFlags(fs)
+	if _, ok := parseArgs(fs, args, 0, 0); !ok {
+		return 2
+	}
+	loader, err := lf.loader()
+	if err != nil {
+		return fail("%v", err)
+	}
+	namespaces, err := loader.Namespaces(ctx, protoloader.PageOptions{Prefetch: true}).All()
+	if err != nil {
+		return fail("%v", err)
+	}
+	if namespaces == nil {
+		namespaces = []string{}
+	}
+	return lf.output(namespaces, func() {
+		for _, ns := range namespaces {
+			fmt.Println(ns)
+		}
+	})
+}
+
+func runList(ctx context.Context, args []string) int {
+	fs := newFlagSet("list")
+	lf := addLoaderFlags(fs)
+	args, ok := parseArgs(fs, args, 0, 1)
+	if !ok {
+		return 2
+	}
+	namespace := ""
+	if len(args) == 1 {
+		namespace = args[0]
+	}
+	loader, err := lf.loader()
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	summaries := []protoSummary{}
+	it := loader.Protos(ctx, namespace, protoloader.PageOptions{Prefetch: true})
+	defer it.Close()
+	for it.Next() {
+		summaries = append(summaries, summarize(it.Value()))
+	}
+	if err := it.Err(); err != nil {
+		return fail("%v", err)
+	}
+	return lf.output(summaries, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAMESPACE\tNAME\tVERSION")
+		for _, s := range summaries {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", s.ID, s.Namespace, s.Name, s.Version)
+		}
+		w.Flush()
+	})
+}
+
+func runGet(ctx context.Context, args []string) int {
+	fs := newFlagSet("get")
+	lf := addLoaderFlags(fs)
+	version := fs.String("version", "", "version to get instead of the latest")
+	args, ok := parseArgs(fs, args, 1, 1)
+	if !ok {
+		return 2
+	}
+	id, err := parseID(args[0])
+	if err != nil {
+		return fail("%v", err)
+	}
+	loader, err := lf.loader()
+	if err != nil {
+		return fail("%v", err)
+	}
+	proto, err := loader.GetProtoVersion(ctx, id, *version)
+	if err != nil {
+		return fail("%v", err)
+	}
+	return lf.output(proto, func() {
+		fmt.Print(proto.Content)
+		if !strings.HasSuffix(proto.Content, "\n") {
+			fmt.Println()
+		}
+	})
+}
+
+// searchResult is a proto matching a search, with the matching lines of its
+// content
+type searchResult struct {
+	protoSummary
+	Lines []searchLine `json:"lines,omitempty"`
+}
+
+type searchLine struct {
+	Number int    `json:"number"`
+	Text   string `json:"text"`
+}
+
+// runSearch matches a term case-insensitively against the namespace, name
+// and content of every proto. It exits with status 1 when nothing matches.
+func runSearch(ctx context.Context, args []string) int {
+	fs := newFlagSet("search")
+	lf := addLoaderFlags(fs)
+	namespace := fs.String("namespace", "", "only search this namespace")
+	args, ok := parseArgs(fs, args, 1, 1)
+	if !ok {
+		return 2
+	}
+	term := strings.ToLower(args[0])
+	loader, err := lf.loader()
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	results := []searchResult{}
+	it := loader.Protos(ctx, *namespace, protoloader.PageOptions{Prefetch: true})
+	defer it.Close()
+	for it.Next() {
+		p := it.Value()
+		result := searchResult{protoSummary: summarize(p)}
+		for i, line := range strings.Split(p.Content, "\n") {
+			if strings.Contains(strings.ToLower(line), term) {
+				result.Lines = append(result.Lines, searchLine{Number: i + 1, Text: strings.TrimSpace(line)})
+			}
+		}
+		named := strings.Contains(strings.ToLower(p.Namespace+"/"+p.Name), term)
+		if named || len(result.Lines) > 0 {
+			results = append(results, result)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return fail("%v", err)
+	}
+
+	status := lf.output(results, func() {
+		for _, r := range results {
+			fmt.Printf("%d %s/%s %s\n", r.ID, r.Namespace, r.Name, r.Version)
+			for _, line := range r.Lines {
+				fmt.Printf("  %d: %s\n", line.Number, line.Text)
+			}
+		}
+	})
+	if status == 0 && len(results) == 0 {
+		status = 1
+	}
+	return status
+}
@@ -1,6 +1,6 @@
 import { ref } from 'vue'
 
-export const useWebRTC = () => {
+export const useWebRTC = (room = 'video-chat') => {
   const localStream = ref<MediaStream | null>(null)
   const remoteStream = ref<MediaStream | null>(null)
   const peerConnection = ref<RTCPeerConnection | null>(null)
@@ -8,25 +8,56 @@ export const useWebRTC = () => {
   const error = ref<string>('')
   const isCallEnabled = ref(false)
 
+  // Our name on the signaling hub, the peers in the room and the one we talk to
+  const name = `web-${Math.random().toString(36).slice(2, 10)}`
+  const peers = ref<string[]>([])
+  const remotePeer = ref<string | null>(null)
+
   const config = {
     iceServers: [
       { urls: 'stun:stun.l.google.com:19302' }
     ]
   }
 
+  // The hub drops messages without a target peer or room
+  const send = (message: Record<string, any>) => {
+    ws.value?.send(JSON.stringify({ ...message, to: remotePeer.value, room }))
+  }
+
   const connectSignaling = () => {
     const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:'
-    const wsUrl = `${protocol}//${window.location.host}/ws`
+    const wsUrl = `${protocol}//${window.location.host}/ws?name=${encodeURIComponent(name)}`
     ws.value = new WebSocket(wsUrl)
 
     ws.value.onopen = () => {
-      console.log('Connected to signaling server')
+      console.log('Connected to signaling server as', name)
+    }
+
+    ws.value.onclose = () => {
+      isCallEnabled.value = false
     }
 
     ws.value.onmessage = async (event) => {
       const message = JSON.parse(event.data)
-      
+
       switch (message.type) {
+        case 'welcome':
+          ws.value?.send(JSON.stringify({ type: 'join', room }))
+          break
+        case 'joined':
+          peers.value = message.peers || []
+          break
+        case 'peer-joined':
+          if (!peers.value.includes(message.from)) {
+            peers.value = [...peers.value, message.from]
+          }
+          break
+        case 'peer-left':
+          peers.value = peers.value.filter(peer => peer !== message.from)
+          if (message.from === remotePeer.value) {
+            hangUp()
+          }
+          break
         case 'offer':
           await handleOffer(message)
           break
@@ -36,13 +67,17 @@ export const useWebRTC = () => {
         case 'ice-candidate':
           await handleIceCandidate(message)
           break
+        case 'error':
+          console.error('Signaling error:', message.error)
+          error.value = message.error
+          break
       }
     }
   }
 
   const createPeerConnection = async () => {
     peerConnection.value = new RTCPeerConnection(config)
-    
+
     // Add local stream tracks to peer connection
     if (localStream.value) {
       localStream.value.getTracks().forEach(track => {
@@ -58,10 +93,10 @@ export const useWebRTC = () => {
     // Handle ICE candidates
     peerConnection.value.onicecandidate = (event) => {
       if (event.candidate && ws.value) {
-        ws.value.send(JSON.stringify({
+        send({
           type: 'ice-candidate',
           candidate: event.candidate
-        }))
+        })
       }
     }
 
@@ -71,7 +106,7 @@ export const useWebRTC = () => {
   const init = async () => {
     try {
       console.log('Requesting camera and microphone permissions...')
-      
+
       const constraints = {
         audio: {
           echoCancellation: true,
@@ -87,7 +122,7 @@ export const useWebRTC = () => {
 
       localStream.value = await navigator.mediaDevices.getUserMedia(constraints)
       console.log('Got media stream:', localStream.value.getTracks().map(track => track.kind))
-      
+
       // Connect to signaling server
       connectSignaling()
       isCallEnabled.value = true
@@ -106,6 +141,14 @@ export const useWebRTC = () => {
   }
 
   const startCall = async () => {
+    // Call the first peer in the room
+    if (peers.value.length === 0) {
+      error.value = 'Nobody else is in the room yet. Open this page in another browser to call it.'
+      return
+    }
+    error.value = ''
+    remotePeer.value = peers.value[0]
+
     if (!peerConnection.value) {
       await createPeerConnection()
     }
@@ -113,17 +156,19 @@ export const useWebRTC = () => {
     try {
       const offer = await peerConnection.value?.createOffer()
       await peerConnection.value?.setLocalDescription(offer)
-      
-      ws.value?.send(JSON.stringify({
+
+      send({
         type: 'offer',
         offer: offer
-      }))
+      })
     } catch (e) {
       console.error('Error creating offer:', e)
     }
   }
 
   const handleOffer = async (message: any) => {
+    remotePeer.value = message.from
+
     if (!peerConnection.value) {
       await createPeerConnection()
     }
@@ -132,17 +177,20 @@ export const useWebRTC = () => {
       await peerConnection.value?.setRemoteDescription(new RTCSessionDescription(message.offer))
       const answer = await peerConnection.value?.createAnswer()
       await peerConnection.value?.setLocalDescription(answer)
-      
-      ws.value?.send(JSON.stringify({
+
+      send({
         type: 'answer',
         answer: answer
-      }))
+      })
     } catch (e) {
       console.error('Error handling offer:', e)
     }
   }
 
   const handleAnswer = async (message: any) => {
+    if (message.from !== remotePeer.value) {
+      return
+    }
     try {
       await peerConnection.value?.setRemoteDescription(new RTCSessionDescription(message.answer))
     } catch (e) {
@@ -151,6 +199,9 @@ export const useWebRTC = () => {
   }
 
   const handleIceCandidate = async (message: any) => {
+    if (message.from !== remotePeer.value) {
+      return
+    }
     try {
       if (message.candidate) {
         await peerConnection.value?.addIceCandidate(new RTCIceCandidate(message.candidate))
@@ -160,13 +211,21 @@ export const useWebRTC = () => {
     }
   }
 
+  // hangUp closes the call but stays in the room for the next one
+  const hangUp = () => {
+    if (peerConnection.value) {
+      peerConnection.value.close()
+      peerConnection.value = null
+    }
+    remoteStream.value = null
+    remotePeer.value = null
+  }
+
   const cleanup = () => {
     if (localStream.value) {
       localStream.value.getTracks().forEach(track => track.stop())
     }
-    if (peerConnection.value) {
-      peerConnection.value.close()
-    }
+    hangUp()
     if (ws.value) {
       ws.value.close()
     }
@@ -175,6 +234,7 @@ export const useWebRTC = () => {
   return {
     localStream,
     remoteStream,
+    peers,
     error,
     isCallEnabled,
     init,
@@ -0,0 +1,278 @@
+// Package certmanager keeps the gateway-issued QNE certificate current. It
+// parses the certificate, renews it through the gateway before it expires
+// and hands the latest one to TLS servers through GetCertificate.
+package certmanager
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/qnepff/qne-node-v12/internal/rest"
+)
+
+var (
+	ErrNoCertificate = errors.New("no QNE certificate loaded")
+	ErrKeyMismatch   = errors.New("certificate does not match the node key")
+	ErrExpired       = errors.New("certificate has expired")
+)
+
+// IssueFunc asks the gateway for a certificate for the given CSR and returns
+// the PEM encoded certificate chain
+type IssueFunc func(ctx context.Context, csrPEM []byte) (string, error)
+
+type Config struct {
+	// Key is the node key certificates are issued for
+	Key crypto.Signer
+
+	// CommonName is put into the CSR, usually the node name
+	CommonName func() string
+
+	// Issue requests a certificate from the gateway
+	Issue IssueFunc
+
+	// RenewFraction is the part of the certificate lifetime that must remain
+	// before it is renewed. Defaults to one third.
+	RenewFraction float64
+
+	// RetryInterval is the wait between failed renewal attempts
+	RetryInterval time.Duration
+
+	// OnRenewed is called with every newly installed certificate, for example
+	// to persist it
+	OnRenewed func(certPEM string)
+
+	// OnRefused is called when the gateway refuses a renewal, which means the
+	// node identity is no longer valid
+	OnRefused func(ctx context.Context) error
+}
+
+// Manager holds the current QNE certificate. It is safe for concurrent use.
+type Manager struct {
+	cfg     Config
+	mu      sync.RWMutex
+	current *tls.Certificate
+	renewed chan struct{}
+}
+
+func New(cfg Config) (*Manager, error) {
+	if cfg.Key == nil || cfg.Issue == nil {
+		return nil, errors.New("certmanager: key and issue function are required")
+	}
+	if cfg.RenewFraction <= 0 || cfg.RenewFraction >= 1 {
+		cfg.RenewFraction = 1.0 / 3
+	}
+	if cfg.RetryInterval == 0 {
+		cfg.RetryInterval = time.Minute
+	}
+	return &Manager{
+		cfg:     cfg,
+		renewed: make(chan struct{}, 1),
+	}, nil
+}
+
+// Load parses a PEM encoded certificate chain and installs it when it is
+// valid for the node key
+func (m *Manager) Load(certPEM string) error {
+	cert, err := ParseCertificate(certPEM, m.cfg.Key)
+	if err != nil {
+		return err
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return ErrExpired
+	}
+
+	m.mu.Lock()
+	m.current = cert
+	m.mu.Unlock()
+
+	select {
+	case m.renewed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Renew requests a new certificate from the gateway and installs it
+func (m *Manager) Renew(ctx context.Context) error {
+	csr, err := m.csr()
+	if err != nil {
+		return err
+	}
+	certPEM, err := m.cfg.Issue(ctx, csr)
+	if err != nil {
+		return err
+	}
+	if err := m.Load(certPEM); err != nil {
+		return fmt.Errorf("gateway issued an unusable certificate: %w", err)
+	}
+	if m.cfg.OnRenewed != nil {
+		m.cfg.OnRenewed(certPEM)
+	}
+	return nil
+}
+
+// Certificate returns the current certificate
+func (m *Manager) Certificate() (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.current == nil {
+		return nil, ErrNoCertificate
+	}
+	return m.current, nil
+}
+
+// NotAfter returns the expiry of the current certificate, or the zero time
+// when none is loaded
+func (m *Manager) NotAfter() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.current == nil {
+		return time.Time{}
+	}
+	return m.current.Leaf.NotAfter
+}
+
+// GetCertificate implements tls.Config.GetCertificate. It returns the QNE
+// certificate when it covers the requested server name and nil otherwise, so
+// crypto/tls falls back to tls.Config.Certificates.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := m.Certificate()
+	if err != nil {
+		return nil, nil
+	}
+	if hello != nil && hello.ServerName != "" && cert.Leaf.VerifyHostname(hello.ServerName) != nil {
+		return nil, nil
+	}
+	return cert, nil
+}
+
+// Run renews the certificate whenever the remaining lifetime drops below the
+// configured fraction, until ctx is done
+func (m *Manager) Run(ctx context.Context) error {
+	for {
+		wait := m.untilRenewal()
+		log.Printf("Next QNE certificate renewal in %v", wait.Round(time.Second))
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-m.renewed:
+			// Installed from elsewhere, recompute the schedule
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+
+		err := m.Renew(ctx)
+		switch {
+		case err == nil:
+			// Already accounted for by the schedule computed next
+			select {
+			case <-m.renewed:
+			default:
+			}
+			log.Printf("Renewed QNE certificate, valid until %s", m.NotAfter().Format(time.RFC3339))
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case rest.IsRejected(err):
+			log.Printf("QNE certificate renewal refused: %v", err)
+			if m.cfg.OnRefused != nil {
+				if err := m.cfg.OnRefused(ctx); err != nil {
+					log.Printf("Failed to recover from refused renewal: %v", err)
+					m.waitRetry(ctx)
+				}
+			}
+		default:
+			log.Printf("QNE certificate renewal failed: %v", err)
+			m.waitRetry(ctx)
+		}
+	}
+}
+
+func (m *Manager) waitRetry(ctx context.Context) {
+	timer := time.NewTimer(m.cfg.RetryInterval)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// untilRenewal returns how long until the current certificate is due for
+// renewal. Without a certificate renewal is due immediately.
+func (m *Manager) untilRenewal() time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.current == nil {
+		return 0
+	}
+	leaf := m.current.Leaf
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	renewAt := leaf.NotAfter.Add(-time.Duration(float64(lifetime) * m.cfg.RenewFraction))
+	if wait := time.Until(renewAt); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+func (m *Manager) csr() ([]byte, error) {
+	var subject pkix.Name
+	if m.cfg.CommonName != nil {
+		subject.CommonName = m.cfg.CommonName()
+	}
+	template := &x509.CertificateRequest{Subject: subject}
+	if subject.CommonName != "" {
+		template.DNSNames = []string{subject.CommonName}
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, m.cfg.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate request: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// ParseCertificate decodes a PEM chain, leaf first, and pairs it with key
+func ParseCertificate(certPEM string, key crypto.Signer) (*tls.Certificate, error) {
+	var (
+		cert tls.Certificate
+		rest = []byte(certPEM)
+	)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("no certificate found in PEM data")
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %v", err)
+	}
+	pub, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(key.Public()) {
+		return nil, ErrKeyMismatch
+	}
+
+	cert.Leaf = leaf
+	cert.PrivateKey = key
+	return &cert, nil
+}
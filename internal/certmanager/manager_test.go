@@ -0,0 +1,241 @@
+package certmanager
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/qnepff/qne-node-v12/internal/rest"
+)
+
+// fakeGateway signs CSRs posted to /api/v1/certificate with a throwaway CA
+type fakeGateway struct {
+	*httptest.Server
+	caKey    *ecdsa.PrivateKey
+	caCert   *x509.Certificate
+	lifetime time.Duration
+	serial   atomic.Int64
+	refuse   atomic.Bool
+}
+
+func newFakeGateway(t *testing.T, lifetime time.Duration) *fakeGateway {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test QNE CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := &fakeGateway{caKey: caKey, caCert: caCert, lifetime: lifetime}
+	g.serial.Store(1)
+	g.Server = httptest.NewServer(http.HandlerFunc(g.handle))
+	t.Cleanup(g.Close)
+	return g
+}
+
+func (g *fakeGateway) handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/v1/certificate" {
+		http.NotFound(w, r)
+		return
+	}
+	if g.refuse.Load() {
+		http.Error(w, `{"error": "unknown node"}`, http.StatusForbidden)
+		return
+	}
+
+	var req rest.CertificateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	block, _ := pem.Decode([]byte(req.CSR))
+	if block == nil {
+		http.Error(w, "missing csr", http.StatusBadRequest)
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(g.serial.Add(1)),
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		NotBefore:    now,
+		NotAfter:     now.Add(g.lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, g.caCert, csr.PublicKey, g.caKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: g.caCert.Raw})...)
+	json.NewEncoder(w).Encode(rest.CertificateResponse{Certificate: string(chain), Success: true})
+}
+
+func newTestManager(t *testing.T, gatewayURL string, cfg Config) *Manager {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := rest.NewClient(gatewayURL)
+	client.SetRetryPolicy(rest.RetryPolicy{MaxAttempts: 1})
+
+	cfg.Key = key
+	cfg.CommonName = func() string { return "node-1.qne.name" }
+	cfg.Issue = func(ctx context.Context, csr []byte) (string, error) {
+		resp, err := client.RequestQNECertificateContext(ctx, rest.CertificateRequest{NodeID: 1, CSR: string(csr)})
+		if err != nil {
+			return "", err
+		}
+		return resp.Certificate, nil
+	}
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func serial(t *testing.T, m *Manager) int64 {
+	t.Helper()
+
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "node-1.qne.name"})
+	if err != nil || cert == nil {
+		t.Fatalf("expected a certificate, got %v %v", cert, err)
+	}
+	return cert.Leaf.SerialNumber.Int64()
+}
+
+func TestManager(t *testing.T) {
+	t.Run("Renew", func(t *testing.T) {
+		gateway := newFakeGateway(t, time.Hour)
+		var saved string
+		m := newTestManager(t, gateway.URL, Config{OnRenewed: func(pem string) { saved = pem }})
+
+		if cert, _ := m.GetCertificate(nil); cert != nil {
+			t.Fatal("expected no certificate before the first renewal")
+		}
+		if err := m.Renew(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if saved == "" {
+			t.Error("OnRenewed was not called")
+		}
+		if until := time.Until(m.NotAfter()); until < 59*time.Minute || until > time.Hour {
+			t.Errorf("unexpected NotAfter in %v", until)
+		}
+		if wait := m.untilRenewal(); wait < 39*time.Minute || wait > 41*time.Minute {
+			t.Errorf("expected renewal after two thirds of the lifetime, got %v", wait)
+		}
+
+		// Clients asking for another name fall back to the static certificates
+		if cert, _ := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "localhost"}); cert != nil {
+			t.Error("expected no certificate for a mismatching server name")
+		}
+	})
+
+	t.Run("Rotation", func(t *testing.T) {
+		gateway := newFakeGateway(t, 1500*time.Millisecond)
+		m := newTestManager(t, gateway.URL, Config{RetryInterval: 10 * time.Millisecond})
+		if err := m.Renew(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		first := serial(t, m)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go m.Run(ctx)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for serial(t, m) == first {
+			if time.Now().After(deadline) {
+				t.Fatal("certificate was not rotated")
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+
+	t.Run("Refused", func(t *testing.T) {
+		gateway := newFakeGateway(t, 1500*time.Millisecond)
+
+		var (
+			once    sync.Once
+			refused = make(chan struct{})
+		)
+		m := newTestManager(t, gateway.URL, Config{
+			RetryInterval: 10 * time.Millisecond,
+			OnRefused: func(ctx context.Context) error {
+				once.Do(func() { close(refused) })
+				return nil
+			},
+		})
+		if err := m.Renew(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		gateway.refuse.Store(true)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go m.Run(ctx)
+
+		select {
+		case <-refused:
+		case <-time.After(5 * time.Second):
+			t.Fatal("OnRefused was not called")
+		}
+	})
+
+	t.Run("KeyMismatch", func(t *testing.T) {
+		gateway := newFakeGateway(t, time.Hour)
+		issuer := newTestManager(t, gateway.URL, Config{})
+		if err := issuer.Renew(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		cert, _ := issuer.Certificate()
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+
+		other := newTestManager(t, gateway.URL, Config{})
+		if err := other.Load(string(certPEM)); err != ErrKeyMismatch {
+			t.Errorf("expected key mismatch, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,170 @@
+// Package certsource provides the certificates the node serves over TLS.
+// Both HTTP servers share one Source through the tls.Config built by
+// TLSConfig, so certificate changes reach HTTP/2 and HTTP/3 alike.
+package certsource
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Source returns a certificate for a TLS handshake. A nil certificate with a
+// nil error means the source has nothing suitable for this client.
+type Source interface {
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+var ErrNoCertificate = errors.New("no certificate available")
+
+// TLSConfig returns a server config that takes certificates from src
+func TLSConfig(src Source) *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := src.GetCertificate(hello)
+			if err != nil {
+				return nil, err
+			}
+			if cert == nil {
+				return nil, ErrNoCertificate
+			}
+			return cert, nil
+		},
+		NextProtos: []string{"h3", "h2"},
+	}
+}
+
+// Chain tries each source in order and returns the first certificate found
+type Chain []Source
+
+func (c Chain) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	for _, src := range c {
+		cert, err := src.GetCertificate(hello)
+		if err != nil {
+			return nil, err
+		}
+		if cert != nil {
+			return cert, nil
+		}
+	}
+	return nil, nil
+}
+
+// Files serves an operator-supplied certificate and key. The files are read
+// when the source is created and again on Reload, never per handshake.
+type Files struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+}
+
+func NewFiles(certFile, keyFile string) (*Files, error) {
+	f := &Files{certFile: certFile, keyFile: keyFile}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the certificate and key files again
+func (f *Files) Reload() error {
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate files: %v", err)
+	}
+	f.mu.Lock()
+	f.cert = &cert
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *Files) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.cert, nil
+}
+
+// selfSignedLifetime is the validity of a generated development certificate
+const selfSignedLifetime = 24 * time.Hour
+
+// SelfSigned generates a certificate for localhost in memory. It is meant for
+// development only, browsers and peers will not trust it.
+type SelfSigned struct {
+	hosts []string
+	mu    sync.Mutex
+	cert  *tls.Certificate
+}
+
+// NewSelfSigned creates a source covering localhost and the given extra hosts
+func NewSelfSigned(hosts ...string) *SelfSigned {
+	return &SelfSigned{hosts: append([]string{"localhost", "127.0.0.1", "::1"}, hosts...)}
+}
+
+func (s *SelfSigned) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Regenerate well before expiry so long-running dev nodes keep working
+	if s.cert == nil || time.Until(s.cert.Leaf.NotAfter) < selfSignedLifetime/4 {
+		cert, err := generateSelfSigned(s.hosts)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Serving a generated self-signed certificate for %s, clients will not trust it", strings.Join(s.hosts, ", "))
+		s.cert = cert
+	}
+	return s.cert, nil
+}
+
+func generateSelfSigned(hosts []string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "QNE development node"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(selfSignedLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
@@ -0,0 +1,93 @@
+package certsource
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type staticSource struct {
+	cert *tls.Certificate
+}
+
+func (s staticSource) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.cert, nil
+}
+
+func TestSources(t *testing.T) {
+	dev := NewSelfSigned("node.local")
+
+	t.Run("SelfSigned", func(t *testing.T) {
+		cert, err := dev.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, host := range []string{"localhost", "127.0.0.1", "node.local"} {
+			if err := cert.Leaf.VerifyHostname(host); err != nil {
+				t.Errorf("self-signed certificate does not cover %s: %v", host, err)
+			}
+		}
+
+		again, _ := dev.GetCertificate(nil)
+		if again != cert {
+			t.Error("expected the generated certificate to be reused")
+		}
+	})
+
+	t.Run("Files", func(t *testing.T) {
+		cert, _ := dev.GetCertificate(nil)
+		keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dir := t.TempDir()
+		certFile := filepath.Join(dir, "node.crt")
+		keyFile := filepath.Join(dir, "node.key")
+		os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0644)
+		os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+
+		files, err := NewFiles(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The files are only read on creation and reload
+		os.Remove(certFile)
+		loaded, err := files.GetCertificate(nil)
+		if err != nil || loaded == nil {
+			t.Fatalf("expected loaded certificate, got %v %v", loaded, err)
+		}
+		if err := files.Reload(); err == nil {
+			t.Error("expected reload of a missing file to fail")
+		}
+		if loaded, _ := files.GetCertificate(nil); loaded == nil {
+			t.Error("a failed reload must keep the previous certificate")
+		}
+
+		if _, err := NewFiles(filepath.Join(dir, "missing.crt"), keyFile); err == nil {
+			t.Error("expected missing files to be rejected")
+		}
+	})
+
+	t.Run("Chain", func(t *testing.T) {
+		primary := &tls.Certificate{}
+		fallback, _ := dev.GetCertificate(nil)
+
+		cert, _ := Chain{staticSource{}, staticSource{primary}, dev}.GetCertificate(nil)
+		if cert != primary {
+			t.Error("expected the first available certificate")
+		}
+		cert, _ = Chain{staticSource{}, dev}.GetCertificate(nil)
+		if cert != fallback {
+			t.Error("expected the fallback certificate")
+		}
+
+		if _, err := TLSConfig(Chain{staticSource{}}).GetCertificate(nil); err != ErrNoCertificate {
+			t.Errorf("expected ErrNoCertificate, got %v", err)
+		}
+	})
+}
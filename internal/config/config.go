@@ -0,0 +1,369 @@
+// Package config loads the settings of the node binary.
+//
+// Values are resolved in this order, later sources overriding earlier ones:
+//
+//  1. built-in defaults
+//  2. the YAML config file given by -config or QNE_CONFIG
+//  3. QNE_* environment variables
+//  4. command-line flags
+//
+// Every setting has a flag, an environment variable and a YAML key, listed
+// by -help. Lists, like the gRPC services under rpc, are only read from the
+// file.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Addr       string `yaml:"addr"`        // HTTP/2 and HTTP/3 listen address
+	NoiseAddr  string `yaml:"noise_addr"`  // UDP address for Noise peer traffic
+	GatewayURL string `yaml:"gateway_url"` // QNE gateway server URL
+	DataDir    string `yaml:"data_dir"`    // Directory for the node identity and state
+	StaticRoot string `yaml:"static_root"` // Directory served at /
+
+	// PublicAddr is the HTTPS address reported to the gateway. When empty only
+	// the port is reported and the gateway uses the address it observes.
+	PublicAddr string `yaml:"public_addr"`
+
+	// HeartbeatInterval is the wait between heartbeats until the gateway
+	// asks for another interval
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+
+	// ShutdownTimeout bounds deregistration and connection draining on exit
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	// TrustAnchors is a PEM file of the registry keys protos must be signed
+	// with. Without it the node loads no protos.
+	TrustAnchors string `yaml:"trust_anchors"`
+
+	TLS  TLSConfig  `yaml:"tls"`
+	QUIC QUICConfig `yaml:"quic"`
+	RPC  RPCConfig  `yaml:"rpc"`
+}
+
+// TLS certificate sources
+const (
+	TLSSourceQNE        = "qne"         // certificate issued by the QNE gateway
+	TLSSourceFiles      = "files"       // operator-supplied cert_file and key_file
+	TLSSourceSelfSigned = "self-signed" // generated in memory, development only
+)
+
+type TLSConfig struct {
+	// Source selects the primary certificate. With the QNE source, cert_file
+	// and key_file, when set, are served to clients the QNE certificate does
+	// not cover.
+	Source   string `yaml:"source"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+
+	// SelfSignedFallback serves a generated localhost certificate when no
+	// other source has one, which keeps local development working. Off by
+	// default, clients do not trust the certificate.
+	SelfSignedFallback bool `yaml:"self_signed_fallback"`
+}
+
+type QUICConfig struct {
+	MaxIdleTimeout        time.Duration `yaml:"max_idle_timeout"`
+	KeepAlivePeriod       time.Duration `yaml:"keep_alive_period"`
+	HandshakeIdleTimeout  time.Duration `yaml:"handshake_idle_timeout"`
+	MaxIncomingStreams    int64         `yaml:"max_incoming_streams"`
+	MaxIncomingUniStreams int64         `yaml:"max_incoming_uni_streams"`
+	Allow0RTT             bool          `yaml:"allow_0rtt"`
+	EnableDatagrams       bool          `yaml:"enable_datagrams"`
+}
+
+type RPCConfig struct {
+	// Services are registry services the node serves over gRPC, each
+	// forwarded to a local HTTP backend
+	Services []RPCService `yaml:"services"`
+}
+
+// RPCService routes the calls of a registry service to an HTTP backend
+type RPCService struct {
+	Proto   int64  `yaml:"proto"`   // Registry ID of the proto defining the service
+	Service string `yaml:"service"` // Service name, relative to the proto's package or fully qualified
+	Backend string `yaml:"backend"` // Base URL calls are POSTed to as JSON
+}
+
+// Default returns the settings used when nothing is overridden
+func Default() *Config {
+	return &Config{
+		Addr:       ":4445",
+		NoiseAddr:  ":4446",
+		GatewayURL: "https://qne.name",
+		DataDir:    ".qne",
+		StaticRoot: "frontend/.output/public",
+
+		HeartbeatInterval: 30 * time.Second,
+		ShutdownTimeout:   15 * time.Second,
+		TLS: TLSConfig{
+			Source: TLSSourceQNE,
+		},
+		QUIC: QUICConfig{
+			MaxIdleTimeout:        30 * time.Second,
+			KeepAlivePeriod:       10 * time.Second,
+			HandshakeIdleTimeout:  5 * time.Second,
+			MaxIncomingStreams:    1000,
+			MaxIncomingUniStreams: 1000,
+			Allow0RTT:             true,
+			EnableDatagrams:       true,
+		},
+	}
+}
+
+// option binds one setting to its flag and environment variable
+type option struct {
+	flag  string
+	env   string
+	usage string
+	value func(c *Config) interface{}
+}
+
+var options = []option{
+	{"addr", "QNE_ADDR", "HTTP/2 and HTTP/3 listen address", func(c *Config) interface{} { return &c.Addr }},
+	{"noise-addr", "QNE_NOISE_ADDR", "UDP listen address for Noise peer traffic", func(c *Config) interface{} { return &c.NoiseAddr }},
+	{"gateway-url", "QNE_GATEWAY_URL", "QNE gateway server URL", func(c *Config) interface{} { return &c.GatewayURL }},
+	{"data-dir", "QNE_DATA_DIR", "directory for the node identity and state", func(c *Config) interface{} { return &c.DataDir }},
+	{"static-root", "QNE_STATIC_ROOT", "directory of static files served at /", func(c *Config) interface{} { return &c.StaticRoot }},
+	{"public-addr", "QNE_PUBLIC_ADDR", "HTTPS address reported to the gateway, empty to use the observed address", func(c *Config) interface{} { return &c.PublicAddr }},
+	{"heartbeat-interval", "QNE_HEARTBEAT_INTERVAL", "time between gateway heartbeats", func(c *Config) interface{} { return &c.HeartbeatInterval }},
+	{"shutdown-timeout", "QNE_SHUTDOWN_TIMEOUT", "time allowed for a graceful shutdown", func(c *Config) interface{} { return &c.ShutdownTimeout }},
+	{"trust-anchors", "QNE_TRUST_ANCHORS", "PEM file of the registry keys protos must be signed with", func(c *Config) interface{} { return &c.TrustAnchors }},
+	{"tls-source", "QNE_TLS_SOURCE", "TLS certificate source: qne, files or self-signed", func(c *Config) interface{} { return &c.TLS.Source }},
+	{"tls-cert-file", "QNE_TLS_CERT_FILE", "TLS certificate file", func(c *Config) interface{} { return &c.TLS.CertFile }},
+	{"tls-key-file", "QNE_TLS_KEY_FILE", "TLS private key file", func(c *Config) interface{} { return &c.TLS.KeyFile }},
+	{"tls-self-signed-fallback", "QNE_TLS_SELF_SIGNED_FALLBACK", "serve a generated localhost certificate when no other is available (development)", func(c *Config) interface{} { return &c.TLS.SelfSignedFallback }},
+	{"quic-max-idle-timeout", "QNE_QUIC_MAX_IDLE_TIMEOUT", "QUIC idle timeout", func(c *Config) interface{} { return &c.QUIC.MaxIdleTimeout }},
+	{"quic-keep-alive-period", "QNE_QUIC_KEEP_ALIVE_PERIOD", "QUIC keep-alive period", func(c *Config) interface{} { return &c.QUIC.KeepAlivePeriod }},
+	{"quic-handshake-idle-timeout", "QNE_QUIC_HANDSHAKE_IDLE_TIMEOUT", "QUIC handshake idle timeout", func(c *Config) interface{} { return &c.QUIC.HandshakeIdleTimeout }},
+	{"quic-max-incoming-streams", "QNE_QUIC_MAX_INCOMING_STREAMS", "maximum concurrent bidirectional QUIC streams", func(c *Config) interface{} { return &c.QUIC.MaxIncomingStreams }},
+	{"quic-max-incoming-uni-streams", "QNE_QUIC_MAX_INCOMING_UNI_STREAMS", "maximum concurrent unidirectional QUIC streams", func(c *Config) interface{} { return &c.QUIC.MaxIncomingUniStreams }},
+	{"quic-allow-0rtt", "QNE_QUIC_ALLOW_0RTT", "accept 0-RTT QUIC connections", func(c *Config) interface{} { return &c.QUIC.Allow0RTT }},
+	{"quic-enable-datagrams", "QNE_QUIC_ENABLE_DATAGRAMS", "enable QUIC datagrams", func(c *Config) interface{} { return &c.QUIC.EnableDatagrams }},
+}
+
+func set(ptr interface{}, s string) error {
+	switch p := ptr.(type) {
+	case *string:
+		*p = s
+	case *time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		*p = d
+	case *int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		*p = n
+	case *bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		*p = b
+	default:
+		return fmt.Errorf("unsupported option type %T", ptr)
+	}
+	return nil
+}
+
+// optionValue adapts a Config field to flag.Value
+type optionValue struct {
+	ptr interface{}
+}
+
+func (v optionValue) String() string {
+	switch p := v.ptr.(type) {
+	case *string:
+		return *p
+	case *time.Duration:
+		return p.String()
+	case *int64:
+		return strconv.FormatInt(*p, 10)
+	case *bool:
+		return strconv.FormatBool(*p)
+	}
+	return ""
+}
+
+func (v optionValue) Set(s string) error {
+	return set(v.ptr, s)
+}
+
+func (v optionValue) IsBoolFlag() bool {
+	_, ok := v.ptr.(*bool)
+	return ok
+}
+
+// Load resolves the configuration from the given command-line arguments and
+// environment. It returns flag.ErrHelp when -help was requested.
+func Load(name string, args []string, getenv func(string) string) (*Config, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configPath := fs.String("config", "", "YAML config file (env QNE_CONFIG)")
+
+	// Flags are parsed into their own copy and applied last, so they
+	// override the file and environment no matter where those come from
+	flagged := Default()
+	byFlag := make(map[string]option, len(options))
+	for _, opt := range options {
+		fs.Var(optionValue{opt.value(flagged)}, opt.flag, fmt.Sprintf("%s (env %s)", opt.usage, opt.env))
+		byFlag[opt.flag] = opt
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	cfg := Default()
+
+	path := *configPath
+	if path == "" {
+		path = getenv("QNE_CONFIG")
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, opt := range options {
+		if v := getenv(opt.env); v != "" {
+			if err := set(opt.value(cfg), v); err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", opt.env, err)
+			}
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		if opt, ok := byFlag[f.Name]; ok {
+			set(opt.value(cfg), f.Value.String())
+		}
+	})
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %v", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// Validate checks that the configuration is usable
+func (c *Config) Validate() error {
+	var errs []string
+
+	for _, a := range []struct{ name, addr string }{{"addr", c.Addr}, {"noise_addr", c.NoiseAddr}} {
+		if _, _, err := net.SplitHostPort(a.addr); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", a.name, err))
+		}
+	}
+	if c.PublicAddr != "" {
+		if _, _, err := net.SplitHostPort(c.PublicAddr); err != nil {
+			errs = append(errs, fmt.Sprintf("public_addr: %v", err))
+		}
+	}
+	if c.Addr == c.NoiseAddr {
+		errs = append(errs, "addr and noise_addr must differ, both use UDP")
+	}
+
+	if u, err := url.Parse(c.GatewayURL); err != nil {
+		errs = append(errs, fmt.Sprintf("gateway_url: %v", err))
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, "gateway_url: must be an absolute http or https URL")
+	}
+
+	if c.DataDir == "" {
+		errs = append(errs, "data_dir: must not be empty")
+	}
+	if c.StaticRoot == "" {
+		errs = append(errs, "static_root: must not be empty")
+	}
+	if c.HeartbeatInterval <= 0 {
+		errs = append(errs, "heartbeat_interval: must be positive")
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, "shutdown_timeout: must be positive")
+	}
+	switch c.TLS.Source {
+	case TLSSourceQNE, TLSSourceFiles, TLSSourceSelfSigned:
+	default:
+		errs = append(errs, fmt.Sprintf("tls.source: unknown source %q", c.TLS.Source))
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, "tls: cert_file and key_file must be set together")
+	}
+	if c.TLS.Source == TLSSourceFiles && c.TLS.CertFile == "" {
+		errs = append(errs, "tls: the files source requires cert_file and key_file")
+	}
+
+	q := c.QUIC
+	if q.MaxIdleTimeout <= 0 {
+		errs = append(errs, "quic.max_idle_timeout: must be positive")
+	}
+	if q.HandshakeIdleTimeout <= 0 {
+		errs = append(errs, "quic.handshake_idle_timeout: must be positive")
+	}
+	if q.KeepAlivePeriod < 0 || (q.KeepAlivePeriod > 0 && q.KeepAlivePeriod >= q.MaxIdleTimeout) {
+		errs = append(errs, "quic.keep_alive_period: must be shorter than max_idle_timeout")
+	}
+	if q.MaxIncomingStreams <= 0 {
+		errs = append(errs, "quic.max_incoming_streams: must be positive")
+	}
+	if q.MaxIncomingUniStreams <= 0 {
+		errs = append(errs, "quic.max_incoming_uni_streams: must be positive")
+	}
+
+	if len(c.RPC.Services) > 0 && c.TrustAnchors == "" {
+		errs = append(errs, "trust_anchors: required to serve rpc.services")
+	}
+	for i, svc := range c.RPC.Services {
+		if svc.Proto <= 0 || svc.Service == "" {
+			errs = append(errs, fmt.Sprintf("rpc.services[%d]: proto and service are required", i))
+		}
+		if u, err := url.Parse(svc.Backend); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("rpc.services[%d].backend: must be an absolute http or https URL", i))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Port returns the port part of Addr
+func (c *Config) Port() string {
+	_, port, _ := net.SplitHostPort(c.Addr)
+	return port
+}
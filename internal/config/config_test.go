@@ -0,0 +1,141 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func env(vars map[string]string) func(string) string {
+	return func(key string) string {
+		return vars[key]
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.yaml")
+	err := os.WriteFile(path, []byte(`
+addr: ":5000"
+gateway_url: "http://localhost:4444"
+data_dir: "/var/lib/qne"
+trust_anchors: "/etc/qne/registry.pub"
+quic:
+  max_idle_timeout: 1m
+  max_incoming_streams: 10
+rpc:
+  services:
+    - proto: 12
+      service: Chat
+      backend: "http://localhost:8080"
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Defaults", func(t *testing.T) {
+		cfg, err := Load("qne-node", nil, env(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Addr != ":4445" || cfg.GatewayURL != "https://qne.name" || cfg.QUIC.MaxIncomingStreams != 1000 {
+			t.Errorf("unexpected defaults: %+v", cfg)
+		}
+		if cfg.TLS.SelfSignedFallback {
+			t.Error("expected the self-signed fallback to be off by default")
+		}
+	})
+
+	t.Run("Precedence", func(t *testing.T) {
+		cfg, err := Load("qne-node", []string{"-config", path, "-addr", ":6000", "-quic-allow-0rtt=false"}, env(map[string]string{
+			"QNE_ADDR":        ":5500",
+			"QNE_DATA_DIR":    "/tmp/qne",
+			"QNE_STATIC_ROOT": "public",
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Flag beats env beats file beats default
+		if cfg.Addr != ":6000" {
+			t.Errorf("expected flag to win for addr, got %s", cfg.Addr)
+		}
+		if cfg.DataDir != "/tmp/qne" {
+			t.Errorf("expected env to win for data_dir, got %s", cfg.DataDir)
+		}
+		if cfg.GatewayURL != "http://localhost:4444" {
+			t.Errorf("expected file value for gateway_url, got %s", cfg.GatewayURL)
+		}
+		if cfg.QUIC.MaxIdleTimeout != time.Minute || cfg.QUIC.MaxIncomingStreams != 10 {
+			t.Errorf("unexpected quic settings from file: %+v", cfg.QUIC)
+		}
+		if cfg.QUIC.KeepAlivePeriod != 10*time.Second {
+			t.Errorf("expected default keep-alive, got %v", cfg.QUIC.KeepAlivePeriod)
+		}
+		if cfg.StaticRoot != "public" || cfg.QUIC.Allow0RTT {
+			t.Errorf("unexpected overrides: %+v", cfg)
+		}
+	})
+
+	t.Run("ConfigFromEnv", func(t *testing.T) {
+		cfg, err := Load("qne-node", nil, env(map[string]string{"QNE_CONFIG": path}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Addr != ":5000" || cfg.TrustAnchors != "/etc/qne/registry.pub" {
+			t.Errorf("unexpected settings from file: %+v", cfg)
+		}
+		if len(cfg.RPC.Services) != 1 || cfg.RPC.Services[0] != (RPCService{Proto: 12, Service: "Chat", Backend: "http://localhost:8080"}) {
+			t.Errorf("unexpected rpc services from file: %+v", cfg.RPC.Services)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, tc := range []struct {
+			args []string
+			env  map[string]string
+			want string
+		}{
+			{[]string{"-gateway-url", "qne.name"}, nil, "gateway_url"},
+			{[]string{"-noise-addr", ":4445"}, nil, "must differ"},
+			{[]string{"-quic-keep-alive-period", "1m"}, nil, "keep_alive_period"},
+			{nil, map[string]string{"QNE_QUIC_MAX_INCOMING_STREAMS": "many"}, "QNE_QUIC_MAX_INCOMING_STREAMS"},
+			{[]string{"-addr", "4445"}, nil, "addr"},
+			{[]string{"-tls-source", "acme"}, nil, "tls.source"},
+			{[]string{"-tls-source", "files"}, nil, "requires cert_file"},
+			{[]string{"-tls-cert-file", "node.crt"}, nil, "set together"},
+			{nil, map[string]string{"QNE_SHUTDOWN_TIMEOUT": "0s"}, "shutdown_timeout"},
+			{[]string{"-public-addr", "node.example.org"}, nil, "public_addr"},
+		} {
+			_, err := Load("qne-node", tc.args, env(tc.env))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("args %v env %v: expected error mentioning %q, got %v", tc.args, tc.env, tc.want, err)
+			}
+		}
+	})
+
+	t.Run("UnknownFileKey", func(t *testing.T) {
+		bad := filepath.Join(t.TempDir(), "bad.yaml")
+		if err := os.WriteFile(bad, []byte("adr: \":1\"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load("qne-node", []string{"-config", bad}, env(nil)); err == nil {
+			t.Error("expected unknown key to be rejected")
+		}
+	})
+
+	t.Run("InvalidService", func(t *testing.T) {
+		bad := filepath.Join(t.TempDir(), "bad.yaml")
+		if err := os.WriteFile(bad, []byte("rpc:\n  services:\n    - proto: 1\n      service: Chat\n      backend: localhost:8080\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := Load("qne-node", []string{"-config", bad}, env(nil))
+		if err == nil || !strings.Contains(err.Error(), "rpc.services[0].backend") {
+			t.Errorf("expected a backend without scheme to be rejected, got %v", err)
+		}
+		if err == nil || !strings.Contains(err.Error(), "trust_anchors") {
+			t.Errorf("expected services without trust anchors to be rejected, got %v", err)
+		}
+	})
+}
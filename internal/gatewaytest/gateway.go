@@ -0,0 +1,367 @@
+// Package gatewaytest implements an in-memory QNE gateway for tests and
+// offline development. It registers nodes into segments, issues certificates
+// from a local CA, tracks heartbeats and serves a proto registry, speaking the
+// same JSON API as qne.name.
+package gatewaytest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qnepff/qne-node-v12/internal/rest"
+)
+
+type Config struct {
+	// CA issues node certificates. A throwaway CA is generated when nil.
+	CA *CA
+
+	// CertLifetime is the validity of issued certificates, 24 hours by default
+	CertLifetime time.Duration
+
+	// RegistryKey signs the protos served by the registry. A throwaway key is
+	// generated when nil.
+	RegistryKey ed25519.PrivateKey
+
+	// SegmentID is the segment every node is placed in
+	SegmentID string
+
+	// Logger receives one line per request when set
+	Logger *log.Logger
+}
+
+// Node is the gateway's view of a registered node
+type Node struct {
+	NodeID        int64
+	NodeName      string
+	SegmentID     string
+	Online        bool
+	Certificates  int       // Certificates issued so far
+	LastHeartbeat time.Time // Zero until the first heartbeat
+	Heartbeat     rest.HeartbeatRequest
+}
+
+type failure struct {
+	status int
+	count  int
+}
+
+// Gateway is an http.Handler serving the gateway API
+type Gateway struct {
+	cfg Config
+
+	mu       sync.Mutex
+	nodes    map[int64]*Node
+	nextNode int64
+	failures map[string]*failure
+	registry
+}
+
+func New(cfg Config) (*Gateway, error) {
+	if cfg.CA == nil {
+		ca, err := NewCA()
+		if err != nil {
+			return nil, err
+		}
+		cfg.CA = ca
+	}
+	if cfg.RegistryKey == nil {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate registry key: %v", err)
+		}
+		cfg.RegistryKey = key
+	}
+	if cfg.CertLifetime == 0 {
+		cfg.CertLifetime = 24 * time.Hour
+	}
+	if cfg.SegmentID == "" {
+		cfg.SegmentID = "segment-1"
+	}
+	return &Gateway{
+		cfg:      cfg,
+		nodes:    make(map[int64]*Node),
+		failures: make(map[string]*failure),
+		registry: newRegistry(cfg.RegistryKey),
+	}, nil
+}
+
+// NewServer starts a gateway on a local httptest server that is closed when
+// the test ends, and returns it along with its URL
+func NewServer(tb testing.TB, cfg Config) (*Gateway, string) {
+	tb.Helper()
+	g, err := New(cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	server := httptest.NewServer(g)
+	tb.Cleanup(server.Close)
+	return g, server.URL
+}
+
+// CA returns the CA issuing node certificates
+func (g *Gateway) CA() *CA {
+	return g.cfg.CA
+}
+
+// Node returns a copy of the gateway's record for a node
+func (g *Gateway) Node(id int64) (Node, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n, ok := g.nodes[id]
+	if !ok {
+		return Node{}, false
+	}
+	return *n, true
+}
+
+// Forget drops a node, as if the gateway had lost its registration. Further
+// requests for it are answered with rest.CodeUnknownNode.
+func (g *Gateway) Forget(id int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.nodes, id)
+}
+
+// FailNext answers the next count requests to path with status
+func (g *Gateway) FailNext(path string, status, count int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.failures[path] = &failure{status: status, count: count}
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if g.cfg.Logger != nil {
+		g.cfg.Logger.Printf("%s %s", r.Method, r.URL.RequestURI())
+	}
+	if id := r.Header.Get("X-Request-ID"); id != "" {
+		w.Header().Set("X-Request-ID", id)
+	}
+	if g.injectFailure(w, r.URL.Path) {
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/api/v1/segment/register":
+		g.post(w, r, g.register)
+	case r.URL.Path == "/api/v1/certificate":
+		g.post(w, r, g.certificate)
+	case r.URL.Path == "/api/v1/node/heartbeat":
+		g.post(w, r, g.heartbeat)
+	case r.URL.Path == "/api/v1/node/deregister":
+		g.post(w, r, g.deregister)
+	case r.URL.Path == "/api/v1/protos" && r.Method == http.MethodPost:
+		g.signed(w, r, g.publishProto)
+	case r.URL.Path == "/api/v1/protos":
+		g.get(w, r, g.listProtos)
+	case strings.HasPrefix(r.URL.Path, "/api/v1/protos/") && strings.HasSuffix(r.URL.Path, "/deprecate"):
+		g.signed(w, r, g.deprecateProto)
+	case strings.HasPrefix(r.URL.Path, "/api/v1/protos/"):
+		g.serveProto(w, r)
+	case r.URL.Path == "/api/v1/namespaces" && r.Method == http.MethodPost:
+		g.signed(w, r, g.createNamespace)
+	case r.URL.Path == "/api/v1/namespaces":
+		g.get(w, r, g.listNamespaces)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (g *Gateway) injectFailure(w http.ResponseWriter, path string) bool {
+	g.mu.Lock()
+	f := g.failures[path]
+	if f == nil || f.count == 0 {
+		g.mu.Unlock()
+		return false
+	}
+	f.count--
+	status := f.status
+	g.mu.Unlock()
+
+	writeError(w, status, "injected failure")
+	return true
+}
+
+// apiError is an error with the HTTP status to report it with
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string { return e.message }
+
+// errUnknownNode is answered with rest.CodeUnknownNode, on which nodes
+// register again
+var errUnknownNode = &apiError{http.StatusNotFound, "unknown node"}
+
+func badRequest(format string, args ...interface{}) error {
+	return &apiError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+func (g *Gateway) post(w http.ResponseWriter, r *http.Request, handle func(body json.RawMessage) (interface{}, error)) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	resp, err := handle(body)
+	respond(w, resp, err)
+}
+
+func (g *Gateway) get(w http.ResponseWriter, r *http.Request, handle func(r *http.Request) (interface{}, error)) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	resp, err := handle(r)
+	respond(w, resp, err)
+}
+
+func respond(w http.ResponseWriter, resp interface{}, err error) {
+	if err != nil {
+		status := http.StatusInternalServerError
+		if apiErr, ok := err.(*apiError); ok {
+			status = apiErr.status
+		}
+		body := map[string]interface{}{"success": false, "error": err.Error()}
+		if err == errUnknownNode {
+			body["code"] = rest.CodeUnknownNode
+		}
+		writeJSON(w, status, body)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]interface{}{"success": false, "error": message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (g *Gateway) register(json.RawMessage) (interface{}, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.nextNode++
+	n := &Node{
+		NodeID:    g.nextNode,
+		NodeName:  nodeName(g.nextNode),
+		SegmentID: g.cfg.SegmentID,
+		Online:    true,
+	}
+	g.nodes[n.NodeID] = n
+	return rest.SegmentRegistrationResponse{
+		NodeID:    n.NodeID,
+		NodeName:  n.NodeName,
+		SegmentID: n.SegmentID,
+		Success:   true,
+	}, nil
+}
+
+// lookupLocked finds the node a request is made for and checks that the
+// name matches the registration
+func (g *Gateway) lookupLocked(id int64, name string) (*Node, error) {
+	n, ok := g.nodes[id]
+	if !ok {
+		return nil, errUnknownNode
+	}
+	if name != "" && name != n.NodeName {
+		return nil, &apiError{http.StatusForbidden, "node name does not match registration"}
+	}
+	return n, nil
+}
+
+func (g *Gateway) certificate(body json.RawMessage) (interface{}, error) {
+	var req rest.CertificateRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, badRequest("invalid certificate request")
+	}
+	if req.CSR == "" {
+		return nil, badRequest("csr required")
+	}
+
+	g.mu.Lock()
+	n, err := g.lookupLocked(req.NodeID, req.NodeName)
+	g.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := g.cfg.CA.Issue([]byte(req.CSR), g.cfg.CertLifetime)
+	if err != nil {
+		return nil, badRequest("%v", err)
+	}
+
+	g.mu.Lock()
+	n.Certificates++
+	n.Online = true
+	g.mu.Unlock()
+	return rest.CertificateResponse{Certificate: chain, Success: true}, nil
+}
+
+func (g *Gateway) heartbeat(body json.RawMessage) (interface{}, error) {
+	var req rest.HeartbeatRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, badRequest("invalid heartbeat")
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n, err := g.lookupLocked(req.NodeID, req.NodeName)
+	if err != nil {
+		return nil, err
+	}
+	n.Online = true
+	n.LastHeartbeat = time.Now()
+	n.Heartbeat = req
+	return rest.HeartbeatResponse{Success: true}, nil
+}
+
+func (g *Gateway) deregister(body json.RawMessage) (interface{}, error) {
+	var req rest.DeregisterRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, badRequest("invalid deregistration")
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n, err := g.lookupLocked(req.NodeID, req.NodeName)
+	if err != nil {
+		return nil, err
+	}
+	n.Online = false
+	return rest.DeregisterResponse{Success: true}, nil
+}
+
+var (
+	nameAdjectives = []string{"quiet", "brave", "swift", "calm", "bright", "gentle", "bold", "clever"}
+	nameAnimals    = []string{"fox", "owl", "otter", "lynx", "heron", "badger", "wren", "hare"}
+)
+
+// nodeName returns the temporary name for a node ID, unique per ID
+func nodeName(id int64) string {
+	i := int(id-1) % (len(nameAdjectives) * len(nameAnimals))
+	name := nameAdjectives[i%len(nameAdjectives)] + "-" + nameAnimals[i/len(nameAdjectives)]
+	if round := (id - 1) / int64(len(nameAdjectives)*len(nameAnimals)); round > 0 {
+		name = fmt.Sprintf("%s-%d", name, round+1)
+	}
+	return name
+}
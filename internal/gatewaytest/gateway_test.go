@@ -0,0 +1,170 @@
+package gatewaytest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/qnepff/qne-node-v12/internal/certmanager"
+	"github.com/qnepff/qne-node-v12/internal/protoloader"
+	"github.com/qnepff/qne-node-v12/internal/rest"
+)
+
+func TestGateway(t *testing.T) {
+	gateway, url := NewServer(t, Config{})
+	client := rest.NewClient(url)
+	client.SetRetryPolicy(rest.RetryPolicy{MaxAttempts: 1})
+	ctx := context.Background()
+
+	reg, err := client.RegisterInSegmentContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.NodeID != 1 || reg.NodeName != "quiet-fox" || reg.SegmentID != "segment-1" {
+		t.Errorf("unexpected registration: %+v", reg)
+	}
+
+	t.Run("Certificate", func(t *testing.T) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject:  pkix.Name{CommonName: reg.NodeName},
+			DNSNames: []string{reg.NodeName},
+		}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		csr := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+
+		resp, err := client.RequestQNECertificateContext(ctx, rest.CertificateRequest{
+			NodeID:    reg.NodeID,
+			NodeName:  reg.NodeName,
+			SegmentID: reg.SegmentID,
+			CSR:       string(csr),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := certmanager.ParseCertificate(resp.Certificate, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(gateway.CA().Cert)
+		if _, err := cert.Leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: reg.NodeName}); err != nil {
+			t.Errorf("issued certificate does not verify against the CA: %v", err)
+		}
+
+		_, err = client.RequestQNECertificateContext(ctx, rest.CertificateRequest{NodeID: 99, CSR: string(csr)})
+		if !rest.IsRejected(err) {
+			t.Errorf("expected certificate for an unknown node to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("Heartbeat", func(t *testing.T) {
+		_, err := client.HeartbeatContext(ctx, rest.HeartbeatRequest{
+			NodeID:    reg.NodeID,
+			NodeName:  reg.NodeName,
+			Protocols: []string{"h3"},
+			Load:      rest.LoadReport{Connections: 3},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		node, _ := gateway.Node(reg.NodeID)
+		if node.LastHeartbeat.IsZero() || node.Heartbeat.Load.Connections != 3 {
+			t.Errorf("heartbeat not recorded: %+v", node)
+		}
+
+		if err := client.DeregisterContext(ctx, rest.DeregisterRequest{NodeID: reg.NodeID, NodeName: reg.NodeName}); err != nil {
+			t.Fatal(err)
+		}
+		if node, _ := gateway.Node(reg.NodeID); node.Online {
+			t.Error("expected node to be offline after deregistration")
+		}
+
+		gateway.Forget(reg.NodeID)
+		_, err = client.HeartbeatContext(ctx, rest.HeartbeatRequest{NodeID: reg.NodeID})
+		if !rest.IsUnknownNode(err) {
+			t.Errorf("expected unknown node after Forget, got %v", err)
+		}
+	})
+
+	t.Run("FailNext", func(t *testing.T) {
+		gateway.FailNext("/api/v1/segment/register", http.StatusServiceUnavailable, 1)
+		if _, err := client.RegisterInSegmentContext(ctx); !rest.IsUnavailable(err) {
+			t.Errorf("expected injected failure, got %v", err)
+		}
+		if _, err := client.RegisterInSegmentContext(ctx); err != nil {
+			t.Errorf("expected failure to be used up, got %v", err)
+		}
+	})
+
+	t.Run("Registry", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			gateway.AddProto(protoloader.Proto{
+				Namespace: []string{"chat", "sensors"}[i%2],
+				Name:      fmt.Sprintf("m%d.proto", i),
+				Content:   `syntax = "proto3";`,
+				Version:   "v1",
+			})
+		}
+		gateway.AddNamespace("empty")
+
+		loader, err := protoloader.New(url, t.TempDir(), t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		loader.SetTrustAnchors(gateway.RegistryKey())
+
+		proto, err := loader.GetProto(ctx, 2)
+		if err != nil || proto.Name != "m1.proto" || proto.Namespace != "sensors" {
+			t.Errorf("unexpected proto %+v: %v", proto, err)
+		}
+		if _, err := loader.GetProto(ctx, 42); err == nil {
+			t.Error("expected missing proto to fail")
+		}
+
+		protos, hasMore, lastID, err := loader.ListProtos(ctx, "chat", 2, 0)
+		if err != nil || len(protos) != 2 || !hasMore || lastID != 3 {
+			t.Errorf("unexpected first page: %d protos, more %v, last %d: %v", len(protos), hasMore, lastID, err)
+		}
+		protos, hasMore, _, err = loader.ListProtos(ctx, "chat", 2, lastID)
+		if err != nil || len(protos) != 1 || hasMore {
+			t.Errorf("unexpected last page: %d protos, more %v: %v", len(protos), hasMore, err)
+		}
+
+		namespaces, hasMore, err := loader.ListNamespaces(ctx, 2, 1)
+		if err != nil || len(namespaces) != 2 || namespaces[0] != "chat" || !hasMore {
+			t.Errorf("unexpected first namespace page %v, more %v: %v", namespaces, hasMore, err)
+		}
+		namespaces, hasMore, err = loader.ListNamespaces(ctx, 2, 2)
+		if err != nil || len(namespaces) != 1 || namespaces[0] != "sensors" || hasMore {
+			t.Errorf("unexpected second namespace page %v, more %v: %v", namespaces, hasMore, err)
+		}
+	})
+}
+
+func TestLoadOrCreateCA(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := LoadOrCreateCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := LoadOrCreateCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.Cert.Equal(ca.Cert) {
+		t.Error("expected the saved CA to be reused")
+	}
+}
@@ -0,0 +1,143 @@
+package gatewaytest
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/qnepff/qne-node-v12/internal/protoloader"
+)
+
+// maxWriteBody bounds the body of a registry write
+const maxWriteBody = 4 << 20
+
+// signed answers a registry write. The request has to be signed with a node
+// certificate issued by the gateway's CA, see protoloader.SignRequest, and
+// is accepted once.
+func (g *Gateway) signed(w http.ResponseWriter, r *http.Request, handle func(r *http.Request, node *x509.Certificate, body []byte) (interface{}, error)) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(g.cfg.CA.Cert)
+	node, body, err := protoloader.VerifyRequest(r, roots, &g.nonces, maxWriteBody)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	resp, err := handle(r, node, body)
+	respond(w, resp, err)
+}
+
+// checkOwnerLocked refuses writes to a namespace created by another node
+func (r *registry) checkOwnerLocked(namespace string, node *x509.Certificate) error {
+	if owner := r.owners[namespace]; owner != "" && owner != node.Subject.CommonName {
+		return &apiError{http.StatusForbidden, fmt.Sprintf("namespace %s is owned by %s", namespace, owner)}
+	}
+	return nil
+}
+
+// publishProto answers POST /api/v1/protos. A proto with the namespace and
+// name of an existing one becomes its new version.
+func (g *Gateway) publishProto(_ *http.Request, node *x509.Certificate, body []byte) (interface{}, error) {
+	var req struct {
+		Namespace string `json:"namespace"`
+		Name      string `json:"name"`
+		Version   string `json:"version"`
+		Content   string `json:"content"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, badRequest("invalid JSON body")
+	}
+	if req.Namespace == "" || req.Name == "" || req.Version == "" {
+		return nil, badRequest("namespace, name and version are required")
+	}
+
+	g.regMu.Lock()
+	defer g.regMu.Unlock()
+	if !g.namespaces[req.Namespace] {
+		return nil, &apiError{http.StatusNotFound, "unknown namespace"}
+	}
+	if err := g.checkOwnerLocked(req.Namespace, node); err != nil {
+		return nil, err
+	}
+	var id int64
+	for _, p := range g.protos {
+		if p.Namespace == req.Namespace && p.Name == req.Name && p.ID > id {
+			id = p.ID
+		}
+	}
+	for _, v := range g.versions[id] {
+		if v.Version == req.Version {
+			return nil, &apiError{http.StatusConflict, "version already exists"}
+		}
+	}
+	p := g.addProtoLocked(protoloader.Proto{
+		ID:        id,
+		Namespace: req.Namespace,
+		Name:      req.Name,
+		Version:   req.Version,
+		Content:   req.Content,
+	})
+	return p, nil
+}
+
+// deprecateProto answers POST /api/v1/protos/{id}/deprecate, marking every
+// version of the proto
+func (g *Gateway) deprecateProto(r *http.Request, node *x509.Certificate, body []byte) (interface{}, error) {
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/protos/"), "/deprecate")
+	id, err := strconv.ParseInt(path, 10, 64)
+	if err != nil {
+		return nil, badRequest("invalid proto id")
+	}
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.Reason == "" {
+		return nil, badRequest("reason is required")
+	}
+
+	g.regMu.Lock()
+	defer g.regMu.Unlock()
+	latest := g.protos[id]
+	if latest == nil {
+		return nil, &apiError{http.StatusNotFound, "proto not found"}
+	}
+	if err := g.checkOwnerLocked(latest.Namespace, node); err != nil {
+		return nil, err
+	}
+	// Protos are replaced rather than changed, responses may still be
+	// encoding them
+	versions := g.versions[id]
+	for i, p := range versions {
+		deprecated := *p
+		deprecated.Deprecated = req.Reason
+		versions[i] = &deprecated
+	}
+	g.protos[id] = versions[len(versions)-1]
+	return map[string]bool{"success": true}, nil
+}
+
+// createNamespace answers POST /api/v1/namespaces. The node creating a
+// namespace owns it.
+func (g *Gateway) createNamespace(_ *http.Request, node *x509.Certificate, body []byte) (interface{}, error) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.Name == "" {
+		return nil, badRequest("name is required")
+	}
+
+	g.regMu.Lock()
+	defer g.regMu.Unlock()
+	if g.namespaces[req.Name] {
+		return nil, &apiError{http.StatusConflict, "namespace already exists"}
+	}
+	g.namespaces[req.Name] = true
+	g.owners[req.Name] = node.Subject.CommonName
+	return map[string]bool{"success": true}, nil
+}
@@ -0,0 +1,271 @@
+package gatewaytest
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/qnepff/qne-node-v12/internal/protoloader"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
+// registry holds the protos served under /api/v1/protos
+type registry struct {
+	regMu      sync.Mutex
+	protos     map[int64]*protoloader.Proto   // Latest version
+	versions   map[int64][]*protoloader.Proto // Every version, oldest first
+	namespaces map[string]bool
+	owners     map[string]string // Node owning a namespace created through the API
+	nextProto  int64
+	key        ed25519.PrivateKey
+	nonces     protoloader.NonceCache // Nonces of signed writes, against replays
+}
+
+func newRegistry(key ed25519.PrivateKey) registry {
+	return registry{
+		key:        key,
+		protos:     make(map[int64]*protoloader.Proto),
+		versions:   make(map[int64][]*protoloader.Proto),
+		namespaces: make(map[string]bool),
+		owners:     make(map[string]string),
+	}
+}
+
+// AddProto adds a proto to the registry, assigning the next free ID when
+// p.ID is zero, and returns the stored copy. Adding a new version of an
+// existing ID makes it the latest, older versions stay available. The proto
+// is signed with the registry key.
+func (r *registry) AddProto(p protoloader.Proto) protoloader.Proto {
+	r.regMu.Lock()
+	defer r.regMu.Unlock()
+	return r.addProtoLocked(p)
+}
+
+func (r *registry) addProtoLocked(p protoloader.Proto) protoloader.Proto {
+	if p.ID == 0 {
+		p.ID = r.nextProto + 1
+	}
+	if p.ID > r.nextProto {
+		r.nextProto = p.ID
+	}
+	protoloader.Sign(&p, r.key)
+
+	versions := r.versions[p.ID]
+	for i, v := range versions {
+		if v.Version == p.Version {
+			versions = append(versions[:i:i], versions[i+1:]...)
+			break
+		}
+	}
+	r.versions[p.ID] = append(versions, &p)
+	r.protos[p.ID] = &p
+	r.namespaces[p.Namespace] = true
+	return p
+}
+
+// AddNamespace adds a namespace, which may stay empty
+func (r *registry) AddNamespace(ns string) {
+	r.regMu.Lock()
+	defer r.regMu.Unlock()
+	r.namespaces[ns] = true
+}
+
+// LoadProtoDir adds every .proto file and .avsc Avro schema below dir. The
+// directory a file is in becomes its namespace, files directly in dir go to
+// the "default" namespace.
+func (r *registry) LoadProtoDir(dir string) (int, error) {
+	count := 0
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if ext := filepath.Ext(path); ext != ".proto" && ext != protoloader.AvroExt {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, filepath.Dir(path))
+		ns := filepath.ToSlash(rel)
+		if ns == "." {
+			ns = "default"
+		}
+		r.AddProto(protoloader.Proto{
+			Namespace: ns,
+			Name:      filepath.Base(path),
+			Content:   string(content),
+			Version:   "v1",
+		})
+		count++
+		return nil
+	})
+	if err != nil {
+		return count, fmt.Errorf("failed to load protos: %v", err)
+	}
+	return count, nil
+}
+
+// serveProto answers GET /api/v1/protos/{id}, optionally for ?version=, with
+// ETag revalidation
+func (g *Gateway) serveProto(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(req.URL.Path, "/api/v1/protos/"), 10, 64)
+	if err != nil {
+		respond(w, nil, badRequest("invalid proto id"))
+		return
+	}
+
+	p := g.findProto(id, req.URL.Query().Get("version"))
+	if p == nil {
+		respond(w, nil, &apiError{http.StatusNotFound, "proto not found"})
+		return
+	}
+
+	etag := protoETag(p)
+	w.Header().Set("ETag", etag)
+	if req.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	respond(w, p, nil)
+}
+
+func (r *registry) findProto(id int64, version string) *protoloader.Proto {
+	r.regMu.Lock()
+	defer r.regMu.Unlock()
+	if version == "" {
+		return r.protos[id]
+	}
+	for _, p := range r.versions[id] {
+		if p.Version == version {
+			return p
+		}
+	}
+	return nil
+}
+
+func protoETag(p *protoloader.Proto) string {
+	sum := sha256.Sum256([]byte(p.Version + "\x00" + p.Deprecated + "\x00" + p.Content))
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+func (g *Gateway) listProtos(req *http.Request) (interface{}, error) {
+	query := req.URL.Query()
+	pageSize, err := pageSizeParam(query.Get("page_size"))
+	if err != nil {
+		return nil, err
+	}
+	lastSeen, err := intParam(query.Get("last_seen_id"), 0)
+	if err != nil {
+		return nil, badRequest("invalid last_seen_id")
+	}
+	namespace := query.Get("namespace")
+
+	g.regMu.Lock()
+	var matching []*protoloader.Proto
+	for _, p := range g.protos {
+		if p.ID > lastSeen && (namespace == "" || p.Namespace == namespace) {
+			matching = append(matching, p)
+		}
+	}
+	g.regMu.Unlock()
+	sort.Slice(matching, func(i, j int) bool { return matching[i].ID < matching[j].ID })
+
+	result := struct {
+		Protos  []*protoloader.Proto `json:"protos"`
+		HasMore bool                 `json:"has_more"`
+		LastID  int64                `json:"last_id"`
+	}{Protos: []*protoloader.Proto{}, LastID: lastSeen}
+	if len(matching) > int(pageSize) {
+		matching = matching[:pageSize]
+		result.HasMore = true
+	}
+	if len(matching) > 0 {
+		result.Protos = matching
+		result.LastID = matching[len(matching)-1].ID
+	}
+	return result, nil
+}
+
+func (g *Gateway) listNamespaces(req *http.Request) (interface{}, error) {
+	query := req.URL.Query()
+	pageSize, err := pageSizeParam(query.Get("page_size"))
+	if err != nil {
+		return nil, err
+	}
+	// Pages are numbered from 1
+	page, err := intParam(query.Get("page"), 1)
+	if err != nil {
+		return nil, badRequest("invalid page")
+	}
+	if page < 1 {
+		page = 1
+	}
+
+	g.regMu.Lock()
+	namespaces := make([]string, 0, len(g.namespaces))
+	for ns := range g.namespaces {
+		namespaces = append(namespaces, ns)
+	}
+	g.regMu.Unlock()
+	sort.Strings(namespaces)
+
+	result := struct {
+		Namespaces []string `json:"namespaces"`
+		HasMore    bool     `json:"has_more"`
+	}{Namespaces: []string{}}
+	start := (page - 1) * pageSize
+	if start < int64(len(namespaces)) {
+		end := start + pageSize
+		if end >= int64(len(namespaces)) {
+			end = int64(len(namespaces))
+		} else {
+			result.HasMore = true
+		}
+		result.Namespaces = namespaces[start:end]
+	}
+	return result, nil
+}
+
+func pageSizeParam(value string) (int64, error) {
+	n, err := intParam(value, defaultPageSize)
+	if err != nil {
+		return 0, badRequest("invalid page_size")
+	}
+	if n > maxPageSize {
+		n = maxPageSize
+	}
+	return n, nil
+}
+
+// intParam parses a non-negative query parameter, using def when it is
+// absent or zero
+func intParam(value string, def int64) (int64, error) {
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid value %q", value)
+	}
+	if n == 0 {
+		return def, nil
+	}
+	return n, nil
+}
@@ -0,0 +1,73 @@
+package gatewaytest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// LoadOrCreateRegistryKey reads the registry signing key from registry.key
+// in dir, generating it when it does not exist yet. The public key is kept
+// next to it in registry.pub, ready to be used as a protoloader trust anchor.
+func LoadOrCreateRegistryKey(dir string) (ed25519.PrivateKey, error) {
+	keyPath := filepath.Join(dir, "registry.key")
+	keyPEM, err := os.ReadFile(keyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate registry key: %v", err)
+		}
+		return key, saveRegistryKey(dir, key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registry key: %v", err)
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("invalid registry key file")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse registry key: %v", err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("registry key is not an Ed25519 key")
+	}
+	return key, nil
+}
+
+func saveRegistryKey(dir string, key ed25519.PrivateKey) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create key directory: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode registry key: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "registry.key"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return fmt.Errorf("failed to save registry key: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "registry.pub"), PublicKeyPEM(key.Public().(ed25519.PublicKey)), 0644); err != nil {
+		return fmt.Errorf("failed to save registry public key: %v", err)
+	}
+	return nil
+}
+
+// PublicKeyPEM returns a public key in the PEM format read by
+// protoloader.LoadTrustAnchors
+func PublicKeyPEM(key ed25519.PublicKey) []byte {
+	der, _ := x509.MarshalPKIXPublicKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// RegistryKey returns the public key protos are signed with
+func (g *Gateway) RegistryKey() ed25519.PublicKey {
+	return g.cfg.RegistryKey.Public().(ed25519.PublicKey)
+}
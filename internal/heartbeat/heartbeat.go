@@ -0,0 +1,115 @@
+// Package heartbeat keeps the gateway informed that the node is alive. It
+// periodically reports the node's addresses, protocols and load, and starts
+// a new registration when the gateway no longer knows the node.
+package heartbeat
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/qnepff/qne-node-v12/internal/rest"
+)
+
+type Config struct {
+	// Client sends the heartbeats
+	Client *rest.Client
+
+	// Interval between heartbeats, the gateway may change it in its responses.
+	// Defaults to 30 seconds.
+	Interval time.Duration
+
+	// Report returns the heartbeat to send, or false while the node is not
+	// registered and has nothing to report
+	Report func() (rest.HeartbeatRequest, bool)
+
+	// OnUnknownNode is called when the gateway no longer knows the node
+	OnUnknownNode func(ctx context.Context) error
+}
+
+// Reporter sends heartbeats to the gateway
+type Reporter struct {
+	cfg      Config
+	mu       sync.Mutex
+	interval time.Duration
+}
+
+func New(cfg Config) (*Reporter, error) {
+	if cfg.Client == nil || cfg.Report == nil {
+		return nil, errors.New("heartbeat: client and report function are required")
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 30 * time.Second
+	}
+	return &Reporter{cfg: cfg, interval: cfg.Interval}, nil
+}
+
+// Interval returns the current wait between heartbeats
+func (r *Reporter) Interval() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.interval
+}
+
+// Beat sends a single heartbeat. It does nothing while the node is not
+// registered.
+func (r *Reporter) Beat(ctx context.Context) error {
+	req, ok := r.cfg.Report()
+	if !ok {
+		return nil
+	}
+
+	// A heartbeat that is still retrying when the next one is due is stale
+	ctx, cancel := context.WithTimeout(ctx, r.Interval())
+	defer cancel()
+
+	resp, err := r.cfg.Client.HeartbeatContext(ctx, req)
+	if err != nil {
+		return err
+	}
+	if resp.Interval > 0 {
+		r.mu.Lock()
+		r.interval = time.Duration(resp.Interval) * time.Second
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+// Run sends heartbeats until ctx is done
+func (r *Reporter) Run(ctx context.Context) error {
+	failing := false
+	for {
+		err := r.Beat(ctx)
+		switch {
+		case err == nil:
+			if failing {
+				log.Printf("Gateway heartbeats recovered")
+				failing = false
+			}
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case rest.IsUnknownNode(err):
+			log.Printf("Gateway no longer knows this node, registering again: %v", err)
+			if r.cfg.OnUnknownNode != nil {
+				if err := r.cfg.OnUnknownNode(ctx); err != nil {
+					log.Printf("Failed to register again: %v", err)
+				}
+			}
+		default:
+			if !failing {
+				log.Printf("Gateway heartbeat failed: %v", err)
+				failing = true
+			}
+		}
+
+		timer := time.NewTimer(r.Interval())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
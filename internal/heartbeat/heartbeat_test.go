@@ -0,0 +1,101 @@
+package heartbeat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/qnepff/qne-node-v12/internal/rest"
+)
+
+func TestReporter(t *testing.T) {
+	var (
+		known atomic.Bool
+		beats atomic.Int32
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req rest.HeartbeatRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		beats.Add(1)
+		if !known.Load() || req.NodeID != 7 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"success": false, "error": "unknown node"}`))
+			return
+		}
+		w.Write([]byte(`{"success": true}`))
+	}))
+	defer server.Close()
+
+	var registered atomic.Bool
+	reregistered := make(chan struct{}, 1)
+	reporter, err := New(Config{
+		Client:   rest.NewClient(server.URL),
+		Interval: 10 * time.Millisecond,
+		Report: func() (rest.HeartbeatRequest, bool) {
+			return rest.HeartbeatRequest{NodeID: 7}, registered.Load()
+		},
+		OnUnknownNode: func(ctx context.Context) error {
+			known.Store(true)
+			reregistered <- struct{}{}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("SkipWhileUnregistered", func(t *testing.T) {
+		if err := reporter.Beat(context.Background()); err != nil || beats.Load() != 0 {
+			t.Errorf("expected no heartbeat before registration, got %v after %d beats", err, beats.Load())
+		}
+	})
+
+	t.Run("UnknownNode", func(t *testing.T) {
+		registered.Store(true)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- reporter.Run(ctx) }()
+
+		select {
+		case <-reregistered:
+		case <-time.After(5 * time.Second):
+			t.Fatal("unknown node did not trigger a new registration")
+		}
+
+		// Heartbeats continue once the node is known again
+		before := beats.Load()
+		deadline := time.Now().Add(5 * time.Second)
+		for beats.Load() < before+2 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		cancel()
+		if err := <-done; err != context.Canceled {
+			t.Errorf("expected Run to stop with the context, got %v", err)
+		}
+		if beats.Load() < before+2 {
+			t.Error("heartbeats stopped after registering again")
+		}
+	})
+
+	t.Run("GatewayInterval", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"interval": 60, "success": true}`))
+		}))
+		defer server.Close()
+
+		reporter, _ := New(Config{
+			Client: rest.NewClient(server.URL),
+			Report: func() (rest.HeartbeatRequest, bool) { return rest.HeartbeatRequest{}, true },
+		})
+		if err := reporter.Beat(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if reporter.Interval() != time.Minute {
+			t.Errorf("expected interval from gateway, got %v", reporter.Interval())
+		}
+	})
+}
@@ -0,0 +1,202 @@
+// Package identity persists the node identity assigned by the QNE gateway
+// together with the node's long-term keypair.
+package identity
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	fnoise "github.com/flynn/noise"
+
+	"github.com/qnepff/qne-node-v12/internal/noise"
+)
+
+// FileName is the name of the identity file inside the data directory
+const FileName = "identity.json"
+
+type Identity struct {
+	NodeID       int64     `json:"node_id"`
+	NodeName     string    `json:"node_name"`
+	SegmentID    string    `json:"segment_id"`
+	Certificate  string    `json:"certificate,omitempty"`
+	RegisteredAt time.Time `json:"registered_at,omitempty"`
+
+	// StaticPrivateKey is the Curve25519 private key of the node. It is
+	// generated once and survives re-registration.
+	StaticPrivateKey []byte `json:"static_private_key"`
+
+	// TLSPrivateKey is the PKCS#8 encoded key the QNE certificate is issued
+	// for. Like the static key it is kept across re-registration.
+	TLSPrivateKey []byte `json:"tls_private_key"`
+}
+
+// Registered reports whether the gateway has assigned this identity
+func (i Identity) Registered() bool {
+	return i.NodeID != 0 && i.NodeName != "" && i.SegmentID != ""
+}
+
+// Store keeps the current identity in memory and mirrors every change to a
+// JSON file in the data directory
+type Store struct {
+	path    string
+	current Identity
+	mu      sync.RWMutex
+}
+
+// Open loads the identity from dataDir, creating the directory and a fresh
+// keypair when no identity has been saved yet
+func Open(dataDir string) (*Store, error) {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %v", err)
+	}
+
+	s := &Store{path: filepath.Join(dataDir, FileName)}
+
+	data, err := os.ReadFile(s.path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &s.current); err != nil {
+			return nil, fmt.Errorf("failed to decode identity %s: %v", s.path, err)
+		}
+	case errors.Is(err, os.ErrNotExist):
+	default:
+		return nil, fmt.Errorf("failed to read identity: %v", err)
+	}
+
+	changed := false
+	if len(s.current.StaticPrivateKey) == 0 {
+		key, err := noise.GenerateStaticKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate static key: %v", err)
+		}
+		s.current.StaticPrivateKey = key.Private
+		changed = true
+	}
+	if len(s.current.TLSPrivateKey) == 0 {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate TLS key: %v", err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode TLS key: %v", err)
+		}
+		s.current.TLSPrivateKey = der
+		changed = true
+	}
+	if changed {
+		if err := s.save(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// Path returns the location of the identity file
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Get returns a copy of the current identity
+func (s *Store) Get() Identity {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.current
+}
+
+// StaticKey returns the long-term Noise keypair of the node
+func (s *Store) StaticKey() (fnoise.DHKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return noise.StaticKeyFromPrivate(s.current.StaticPrivateKey)
+}
+
+// TLSKey returns the private key the QNE certificate is issued for
+func (s *Store) TLSKey() (crypto.Signer, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, err := x509.ParsePKCS8PrivateKey(s.current.TLSPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse TLS key: %v", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS key type %T", key)
+	}
+	return signer, nil
+}
+
+// SetRegistration records the node ID, name and segment assigned by the
+// gateway. Any certificate from a previous registration is dropped.
+func (s *Store) SetRegistration(nodeID int64, nodeName, segmentID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current.NodeID = nodeID
+	s.current.NodeName = nodeName
+	s.current.SegmentID = segmentID
+	s.current.Certificate = ""
+	s.current.RegisteredAt = time.Now().UTC()
+	return s.save()
+}
+
+// SetCertificate records the QNE certificate issued for the current identity
+func (s *Store) SetCertificate(certificate string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current.Certificate = certificate
+	return s.save()
+}
+
+// ClearRegistration forgets the gateway-assigned identity, for example after
+// it has been revoked. The keypair is kept.
+func (s *Store) ClearRegistration() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current = Identity{
+		StaticPrivateKey: s.current.StaticPrivateKey,
+		TLSPrivateKey:    s.current.TLSPrivateKey,
+	}
+	return s.save()
+}
+
+// save writes the identity to a temporary file and renames it into place so
+// a crash never leaves a truncated identity behind. Callers must hold mu.
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.current, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode identity: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), FileName+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create identity file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write identity file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync identity file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write identity file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to save identity file: %v", err)
+	}
+	return nil
+}
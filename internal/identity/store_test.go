@@ -0,0 +1,87 @@
+package identity
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	dataDir := t.TempDir()
+
+	store, err := Open(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Get().Registered() {
+		t.Fatal("new store should not be registered")
+	}
+	key, err := store.StaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.TLSKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.SetRegistration(42, "swift-otter", "eu-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetCertificate("cert"); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(store.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected identity file mode 0600, got %v", info.Mode().Perm())
+	}
+
+	t.Run("Reopen", func(t *testing.T) {
+		reopened, err := Open(dataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		id := reopened.Get()
+		if !id.Registered() || id.NodeID != 42 || id.NodeName != "swift-otter" || id.SegmentID != "eu-1" {
+			t.Errorf("unexpected identity: %+v", id)
+		}
+		if id.Certificate != "cert" {
+			t.Errorf("expected certificate to be kept, got %q", id.Certificate)
+		}
+
+		reopenedKey, err := reopened.StaticKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(reopenedKey.Public, key.Public) {
+			t.Error("static key changed across reopen")
+		}
+	})
+
+	t.Run("ClearRegistration", func(t *testing.T) {
+		if err := store.ClearRegistration(); err != nil {
+			t.Fatal(err)
+		}
+
+		reopened, err := Open(dataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := reopened.Get()
+		if id.Registered() || id.Certificate != "" {
+			t.Errorf("expected registration to be cleared: %+v", id)
+		}
+
+		clearedKey, err := reopened.StaticKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(clearedKey.Public, key.Public) {
+			t.Error("static key should survive clearing the registration")
+		}
+	})
+}
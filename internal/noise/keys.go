@@ -0,0 +1,29 @@
+package noise
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	fnoise "github.com/flynn/noise"
+	"golang.org/x/crypto/curve25519"
+)
+
+// GenerateStaticKey creates a new Curve25519 static keypair
+func GenerateStaticKey() (fnoise.DHKey, error) {
+	return fnoise.DH25519.GenerateKeypair(rand.Reader)
+}
+
+// StaticKeyFromPrivate derives the full keypair from a Curve25519 private key
+func StaticKeyFromPrivate(private []byte) (fnoise.DHKey, error) {
+	if len(private) != curve25519.ScalarSize {
+		return fnoise.DHKey{}, fmt.Errorf("invalid private key length: %d", len(private))
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return fnoise.DHKey{}, fmt.Errorf("failed to derive public key: %v", err)
+	}
+	return fnoise.DHKey{
+		Private: append([]byte(nil), private...),
+		Public:  public,
+	}, nil
+}
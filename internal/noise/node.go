@@ -0,0 +1,628 @@
+// Package noise implements the peer-to-peer transport of a QNE node: UDP
+// datagrams secured with Noise_XX_25519_ChaChaPoly_BLAKE2s.
+package noise
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	fnoise "github.com/flynn/noise"
+)
+
+// Packet types, carried in the first byte of every datagram
+const (
+	packetHandshake1 byte = iota + 1
+	packetHandshake2
+	packetHandshake3
+	packetTransport
+)
+
+const (
+	// transportHeaderSize is the type byte followed by the 64-bit nonce
+	transportHeaderSize = 1 + 8
+
+	// maxDatagramSize is the largest UDP payload over IPv4
+	maxDatagramSize = 65507
+
+	// MaxMessageSize is the largest payload accepted by Send
+	MaxMessageSize = maxDatagramSize - transportHeaderSize - 16
+)
+
+// Protocol is the Noise protocol name, reported to the gateway
+const Protocol = "Noise_XX_25519_ChaChaPoly_BLAKE2s"
+
+var cipherSuite = fnoise.NewCipherSuite(fnoise.DH25519, fnoise.CipherChaChaPoly, fnoise.HashBLAKE2s)
+
+var (
+	ErrClosed           = errors.New("noise: node closed")
+	ErrHandshakeTimeout = errors.New("noise: handshake timed out")
+	ErrMessageTooLarge  = errors.New("noise: message too large")
+
+	errMalformed   = errors.New("malformed packet")
+	errUnknownPeer = errors.New("no handshake with this address")
+)
+
+type Config struct {
+	// StaticKey is the long-term identity of the node. It should be kept in
+	// the identity store so peers see the same key across restarts.
+	StaticKey fnoise.DHKey
+
+	// HandshakeTimeout is how long to wait for a reply before retransmitting
+	HandshakeTimeout time.Duration
+
+	// HandshakeRetries is the number of retransmissions before giving up
+	HandshakeRetries int
+
+	// RekeyAfterMessages rotates the transport keys after this many messages
+	RekeyAfterMessages uint64
+
+	// SessionLifetime forces a fresh handshake once a session is this old.
+	// Peers idle for longer are forgotten.
+	SessionLifetime time.Duration
+
+	// ReceiveBuffer is the number of decrypted messages queued for Receive
+	ReceiveBuffer int
+}
+
+func (c *Config) setDefaults() {
+	if c.HandshakeTimeout == 0 {
+		c.HandshakeTimeout = time.Second
+	}
+	if c.HandshakeRetries == 0 {
+		c.HandshakeRetries = 5
+	}
+	if c.RekeyAfterMessages == 0 {
+		c.RekeyAfterMessages = 1 << 20
+	}
+	if c.SessionLifetime == 0 {
+		c.SessionLifetime = time.Hour
+	}
+	if c.ReceiveBuffer == 0 {
+		c.ReceiveBuffer = 256
+	}
+}
+
+// Message is a decrypted datagram received from a peer
+type Message struct {
+	Peer    string // UDP address of the sender
+	PeerKey []byte // Static public key the sender authenticated with
+	Data    []byte
+}
+
+type peer struct {
+	addr *net.UDPAddr
+	mu   sync.Mutex
+
+	// In-progress handshake
+	hs        *fnoise.HandshakeState
+	initiator bool
+	lastRecv  []byte // last handshake packet received, to detect retransmissions
+	lastSent  []byte // last handshake packet sent, resent on timeout or duplicate
+	pending   *session
+
+	sess  *session
+	ready chan struct{} // closed when the current handshake completes
+
+	lastActive time.Time // last packet accepted from or sent to the peer
+}
+
+// expiredLocked reports whether the peer can be forgotten. A handshake that
+// has not completed within handshakeWindow is abandoned, an established
+// session once the remote side has stopped using it too.
+func (p *peer) expiredLocked(now time.Time, handshakeWindow, sessionLifetime time.Duration) bool {
+	idle := now.Sub(p.lastActive)
+	if p.sess == nil {
+		return idle > handshakeWindow
+	}
+	return idle > sessionLifetime+handshakeWindow
+}
+
+// beginHandshakeLocked resets the handshake state. Goroutines already waiting
+// for a session keep their channel so they are woken by whichever handshake
+// completes first.
+func (p *peer) beginHandshakeLocked() {
+	p.hs = nil
+	p.lastRecv = nil
+	p.lastSent = nil
+	p.pending = nil
+	if p.ready == nil {
+		p.ready = make(chan struct{})
+	}
+}
+
+func (p *peer) establishLocked(s *session) {
+	p.sess = s
+	p.hs = nil
+	p.pending = nil
+	if p.ready != nil {
+		close(p.ready)
+		p.ready = nil
+	}
+}
+
+// Node sends and receives encrypted datagrams on a single UDP socket. Sessions
+// are established on demand by Send and by incoming handshakes.
+type Node struct {
+	cfg      Config
+	conn     *net.UDPConn
+	peers    map[string]*peer
+	mu       sync.Mutex
+	incoming chan *Message
+	closed   chan struct{}
+	once     sync.Once
+	wg       sync.WaitGroup
+}
+
+// Listen opens a UDP socket on addr and starts processing datagrams
+func Listen(addr string, cfg Config) (*Node, error) {
+	if len(cfg.StaticKey.Private) == 0 || len(cfg.StaticKey.Public) == 0 {
+		return nil, errors.New("noise: static key required")
+	}
+	cfg.setDefaults()
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve address: %v", err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %v", err)
+	}
+
+	n := &Node{
+		cfg:      cfg,
+		conn:     conn,
+		peers:    make(map[string]*peer),
+		incoming: make(chan *Message, cfg.ReceiveBuffer),
+		closed:   make(chan struct{}),
+	}
+	n.wg.Add(2)
+	go n.readLoop()
+	go n.expireLoop()
+	return n, nil
+}
+
+// Addr returns the local UDP address of the node
+func (n *Node) Addr() net.Addr {
+	return n.conn.LocalAddr()
+}
+
+// PublicKey returns the static public key of the node
+func (n *Node) PublicKey() []byte {
+	return append([]byte(nil), n.cfg.StaticKey.Public...)
+}
+
+// PeerKey returns the static public key of an established peer
+func (n *Node) PeerKey(addr string) ([]byte, bool) {
+	p, err := n.lookup(addr, false)
+	if err != nil || p == nil {
+		return nil, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sess == nil {
+		return nil, false
+	}
+	return append([]byte(nil), p.sess.remoteStatic...), true
+}
+
+// Sessions returns the number of peers with an established session
+func (n *Node) Sessions() int {
+	n.mu.Lock()
+	peers := make([]*peer, 0, len(n.peers))
+	for _, p := range n.peers {
+		peers = append(peers, p)
+	}
+	n.mu.Unlock()
+
+	count := 0
+	for _, p := range peers {
+		p.mu.Lock()
+		if p.sess != nil {
+			count++
+		}
+		p.mu.Unlock()
+	}
+	return count
+}
+
+// Send encrypts data and sends it to the peer at addr, performing a handshake
+// first when there is no usable session
+func (n *Node) Send(addr string, data []byte) error {
+	if len(data) > MaxMessageSize {
+		return ErrMessageTooLarge
+	}
+	p, err := n.lookup(addr, true)
+	if err != nil {
+		return err
+	}
+
+	for {
+		s, err := n.session(p)
+		if err != nil {
+			return err
+		}
+
+		p.mu.Lock()
+		if p.sess != s {
+			// Replaced while we were waiting, use the new one
+			p.mu.Unlock()
+			continue
+		}
+		packet, err := s.seal(data)
+		if errors.Is(err, errExhausted) {
+			p.sess = nil
+			p.mu.Unlock()
+			continue
+		}
+		p.lastActive = time.Now()
+		p.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to encrypt message: %v", err)
+		}
+		return n.write(p.addr, packet)
+	}
+}
+
+// Receive blocks until a message arrives or the node is closed
+func (n *Node) Receive() (*Message, error) {
+	select {
+	case msg := <-n.incoming:
+		return msg, nil
+	case <-n.closed:
+		return nil, ErrClosed
+	}
+}
+
+// Close stops the node and releases the socket
+func (n *Node) Close() error {
+	var err error
+	n.once.Do(func() {
+		close(n.closed)
+		err = n.conn.Close()
+		n.wg.Wait()
+	})
+	return err
+}
+
+func (n *Node) lookup(addr string, create bool) (*peer, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve peer address: %v", err)
+	}
+	return n.peerFor(udpAddr, create), nil
+}
+
+func (n *Node) peerFor(addr *net.UDPAddr, create bool) *peer {
+	key := addr.String()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	p, ok := n.peers[key]
+	if !ok && create {
+		p = &peer{addr: addr, lastActive: time.Now()}
+		n.peers[key] = p
+	}
+	return p
+}
+
+// handshakeWindow is how long a handshake may take including retransmissions
+func (n *Node) handshakeWindow() time.Duration {
+	return n.cfg.HandshakeTimeout * time.Duration(n.cfg.HandshakeRetries+1)
+}
+
+// expireLoop forgets peers that never completed a handshake or went idle, so
+// datagrams from spoofed addresses cannot grow the peer table without bound
+func (n *Node) expireLoop() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.handshakeWindow())
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			n.expirePeers(now)
+		case <-n.closed:
+			return
+		}
+	}
+}
+
+func (n *Node) expirePeers(now time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for key, p := range n.peers {
+		p.mu.Lock()
+		expired := p.expiredLocked(now, n.handshakeWindow(), n.cfg.SessionLifetime)
+		p.mu.Unlock()
+		if expired {
+			delete(n.peers, key)
+		}
+	}
+}
+
+// session returns an established session with p, initiating a handshake and
+// retransmitting on timeout as needed
+func (n *Node) session(p *peer) (*session, error) {
+	for attempt := 0; attempt <= n.cfg.HandshakeRetries; attempt++ {
+		p.mu.Lock()
+		if p.sess != nil && time.Since(p.sess.established) < n.cfg.SessionLifetime {
+			s := p.sess
+			p.mu.Unlock()
+			return s, nil
+		}
+		if p.hs == nil {
+			if err := n.initiateLocked(p); err != nil {
+				p.mu.Unlock()
+				return nil, err
+			}
+		}
+		packet, ready := p.lastSent, p.ready
+		p.lastActive = time.Now()
+		p.mu.Unlock()
+
+		if packet != nil {
+			if err := n.write(p.addr, packet); err != nil {
+				return nil, err
+			}
+		}
+
+		select {
+		case <-ready:
+			attempt--
+		case <-time.After(n.cfg.HandshakeTimeout):
+		case <-n.closed:
+			return nil, ErrClosed
+		}
+	}
+
+	p.mu.Lock()
+	if p.hs != nil && p.initiator {
+		p.beginHandshakeLocked()
+	}
+	p.mu.Unlock()
+	return nil, ErrHandshakeTimeout
+}
+
+func (n *Node) newHandshake(initiator bool) (*fnoise.HandshakeState, error) {
+	return fnoise.NewHandshakeState(fnoise.Config{
+		CipherSuite:   cipherSuite,
+		Random:        rand.Reader,
+		Pattern:       fnoise.HandshakeXX,
+		Initiator:     initiator,
+		StaticKeypair: n.cfg.StaticKey,
+	})
+}
+
+// initiateLocked starts a new handshake as initiator (-> e)
+func (n *Node) initiateLocked(p *peer) error {
+	hs, err := n.newHandshake(true)
+	if err != nil {
+		return fmt.Errorf("failed to create handshake: %v", err)
+	}
+	msg, _, _, err := hs.WriteMessage([]byte{packetHandshake1}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to write handshake message: %v", err)
+	}
+	p.beginHandshakeLocked()
+	p.hs = hs
+	p.initiator = true
+	p.lastSent = msg
+	return nil
+}
+
+func (n *Node) write(addr *net.UDPAddr, packet []byte) error {
+	if _, err := n.conn.WriteToUDP(packet, addr); err != nil {
+		select {
+		case <-n.closed:
+			return ErrClosed
+		default:
+		}
+		return fmt.Errorf("failed to send datagram: %v", err)
+	}
+	return nil
+}
+
+func (n *Node) readLoop() {
+	defer n.wg.Done()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		size, addr, err := n.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-n.closed:
+				return
+			default:
+			}
+			log.Printf("Noise: failed to read datagram: %v", err)
+			continue
+		}
+		if size == 0 {
+			continue
+		}
+
+		packet := append([]byte(nil), buf[:size]...)
+		if err := n.handlePacket(addr, packet); err != nil {
+			log.Printf("Noise: dropping packet from %s: %v", addr, err)
+		}
+	}
+}
+
+func (n *Node) handlePacket(addr *net.UDPAddr, packet []byte) error {
+	p := n.peerFor(addr, false)
+	if p == nil {
+		// Only a valid first handshake message makes an address a peer
+		if packet[0] != packetHandshake1 {
+			return errUnknownPeer
+		}
+		hs, err := n.newHandshake(false)
+		if err != nil {
+			return err
+		}
+		if _, _, _, err := hs.ReadMessage(nil, packet[1:]); err != nil {
+			return fmt.Errorf("invalid handshake message 1: %v", err)
+		}
+		p = n.peerFor(addr, true)
+	}
+
+	var (
+		reply []byte
+		msg   *Message
+	)
+	p.mu.Lock()
+	var err error
+	switch packet[0] {
+	case packetHandshake1:
+		reply, err = n.handleHandshake1(p, packet)
+	case packetHandshake2:
+		reply, err = n.handleHandshake2(p, packet)
+	case packetHandshake3:
+		reply, err = n.handleHandshake3(p, packet)
+	case packetTransport:
+		msg, err = n.handleTransport(p, packet)
+	default:
+		err = errMalformed
+	}
+	if err == nil {
+		p.lastActive = time.Now()
+	}
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if reply != nil {
+		if err := n.write(addr, reply); err != nil {
+			return err
+		}
+	}
+	if msg != nil {
+		select {
+		case n.incoming <- msg:
+		default:
+			return errors.New("receive buffer full")
+		}
+	}
+	return nil
+}
+
+// handleHandshake1 responds to <- e with -> e, ee, s, es
+func (n *Node) handleHandshake1(p *peer, packet []byte) ([]byte, error) {
+	if p.hs != nil && !p.initiator && bytes.Equal(p.lastRecv, packet) {
+		return p.lastSent, nil
+	}
+	if p.hs != nil && p.initiator && p.hs.MessageIndex() == 1 {
+		// Both sides initiated at once; the lower ephemeral key stays initiator
+		if len(packet) < 33 {
+			return nil, errMalformed
+		}
+		if bytes.Compare(p.hs.LocalEphemeral().Public, packet[1:33]) < 0 {
+			return nil, nil
+		}
+	}
+
+	hs, err := n.newHandshake(false)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, _, err := hs.ReadMessage(nil, packet[1:]); err != nil {
+		return nil, fmt.Errorf("invalid handshake message 1: %v", err)
+	}
+	reply, _, _, err := hs.WriteMessage([]byte{packetHandshake2}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	p.beginHandshakeLocked()
+	p.hs = hs
+	p.initiator = false
+	p.lastRecv = packet
+	p.lastSent = reply
+	return reply, nil
+}
+
+// handleHandshake2 completes the initiator side with -> s, se
+func (n *Node) handleHandshake2(p *peer, packet []byte) ([]byte, error) {
+	if p.hs == nil || !p.initiator {
+		return nil, errors.New("unexpected handshake message 2")
+	}
+	if bytes.Equal(p.lastRecv, packet) {
+		return p.lastSent, nil
+	}
+	if p.hs.MessageIndex() != 1 {
+		return nil, errors.New("unexpected handshake message 2")
+	}
+	if _, _, _, err := p.hs.ReadMessage(nil, packet[1:]); err != nil {
+		return nil, fmt.Errorf("invalid handshake message 2: %v", err)
+	}
+	reply, cs1, cs2, err := p.hs.WriteMessage([]byte{packetHandshake3}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// The session is confirmed once the responder's first transport packet
+	// arrives; until then message 3 is retransmitted on timeout
+	p.pending = newSession(cs1, cs2, p.hs.PeerStatic(), n.cfg.RekeyAfterMessages)
+	p.lastRecv = packet
+	p.lastSent = reply
+	return reply, nil
+}
+
+// handleHandshake3 completes the responder side and confirms the session with
+// an empty transport packet
+func (n *Node) handleHandshake3(p *peer, packet []byte) ([]byte, error) {
+	if p.sess != nil && p.hs == nil && bytes.Equal(p.lastRecv, packet) {
+		return p.sess.seal(nil)
+	}
+	if p.hs == nil || p.initiator || p.hs.MessageIndex() != 2 {
+		return nil, errors.New("unexpected handshake message 3")
+	}
+	_, cs1, cs2, err := p.hs.ReadMessage(nil, packet[1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid handshake message 3: %v", err)
+	}
+	p.establishLocked(newSession(cs2, cs1, p.hs.PeerStatic(), n.cfg.RekeyAfterMessages))
+	p.lastRecv = packet
+	p.lastSent = nil
+	return p.sess.seal(nil)
+}
+
+func (n *Node) handleTransport(p *peer, packet []byte) (*Message, error) {
+	var (
+		data []byte
+		s    *session
+		err  error
+	)
+	if p.sess != nil {
+		s = p.sess
+		data, err = s.open(packet)
+	}
+	if (p.sess == nil || err != nil) && p.pending != nil {
+		s = p.pending
+		if data, err = s.open(packet); err == nil {
+			p.establishLocked(s)
+		}
+	}
+	if s == nil {
+		return nil, errors.New("no session")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == 0 {
+		// Session confirmation or keepalive
+		return nil, nil
+	}
+	return &Message{
+		Peer:    p.addr.String(),
+		PeerKey: append([]byte(nil), s.remoteStatic...),
+		Data:    data,
+	}, nil
+}
@@ -0,0 +1,274 @@
+package noise
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	fnoise "github.com/flynn/noise"
+)
+
+func newTestNode(t *testing.T, cfg Config) *Node {
+	t.Helper()
+
+	if len(cfg.StaticKey.Private) == 0 {
+		key, err := GenerateStaticKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.StaticKey = key
+	}
+	if cfg.HandshakeTimeout == 0 {
+		cfg.HandshakeTimeout = 200 * time.Millisecond
+	}
+
+	node, err := Listen("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { node.Close() })
+	return node
+}
+
+func receive(t *testing.T, node *Node) *Message {
+	t.Helper()
+
+	done := make(chan *Message, 1)
+	go func() {
+		msg, err := node.Receive()
+		if err != nil {
+			t.Error(err)
+		}
+		done <- msg
+	}()
+	select {
+	case msg := <-done:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+		return nil
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	alice := newTestNode(t, Config{})
+	bob := newTestNode(t, Config{})
+
+	if err := alice.Send(bob.Addr().String(), []byte("hello bob")); err != nil {
+		t.Fatal(err)
+	}
+	msg := receive(t, bob)
+	if string(msg.Data) != "hello bob" {
+		t.Errorf("unexpected message: %q", msg.Data)
+	}
+	if msg.Peer != alice.Addr().String() {
+		t.Errorf("expected message from %s, got %s", alice.Addr(), msg.Peer)
+	}
+	if !bytes.Equal(msg.PeerKey, alice.PublicKey()) {
+		t.Error("peer key does not match alice's static key")
+	}
+
+	// The responder reuses the session established by the initiator
+	if err := bob.Send(alice.Addr().String(), []byte("hello alice")); err != nil {
+		t.Fatal(err)
+	}
+	msg = receive(t, alice)
+	if string(msg.Data) != "hello alice" {
+		t.Errorf("unexpected message: %q", msg.Data)
+	}
+	if key, ok := alice.PeerKey(bob.Addr().String()); !ok || !bytes.Equal(key, bob.PublicKey()) {
+		t.Error("peer key does not match bob's static key")
+	}
+	if alice.Sessions() != 1 {
+		t.Errorf("expected one session, got %d", alice.Sessions())
+	}
+}
+
+func TestSimultaneousHandshake(t *testing.T) {
+	alice := newTestNode(t, Config{})
+	bob := newTestNode(t, Config{})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for _, pair := range [][2]*Node{{alice, bob}, {bob, alice}} {
+		from, to := pair[0], pair[1]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- from.Send(to.Addr().String(), []byte("ping"))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, node := range []*Node{alice, bob} {
+		if msg := receive(t, node); string(msg.Data) != "ping" {
+			t.Errorf("unexpected message: %q", msg.Data)
+		}
+	}
+}
+
+func TestRekey(t *testing.T) {
+	alice := newTestNode(t, Config{RekeyAfterMessages: 3})
+	bob := newTestNode(t, Config{RekeyAfterMessages: 3})
+
+	for i := 0; i < 20; i++ {
+		if err := alice.Send(bob.Addr().String(), []byte(fmt.Sprintf("message %d", i))); err != nil {
+			t.Fatal(err)
+		}
+		if msg := receive(t, bob); string(msg.Data) != fmt.Sprintf("message %d", i) {
+			t.Fatalf("unexpected message %d: %q", i, msg.Data)
+		}
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	alice := newTestNode(t, Config{HandshakeTimeout: 20 * time.Millisecond, HandshakeRetries: 2})
+	bob := newTestNode(t, Config{})
+	addr := bob.Addr().String()
+	bob.Close()
+
+	if err := alice.Send(addr, []byte("anyone?")); err != ErrHandshakeTimeout {
+		t.Errorf("expected handshake timeout, got %v", err)
+	}
+}
+
+func TestSessionReplayAndReorder(t *testing.T) {
+	alice := newTestNode(t, Config{})
+	bob := newTestNode(t, Config{})
+	if err := alice.Send(bob.Addr().String(), []byte("setup")); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, bob)
+
+	sender := alice.peerFor(bob.conn.LocalAddr().(*net.UDPAddr), false)
+	receiver := bob.peerFor(alice.conn.LocalAddr().(*net.UDPAddr), false)
+
+	sender.mu.Lock()
+	sender.sess.rekeyAfter = 2
+	receiver.sess.rekeyAfter = 2
+	var packets [][]byte
+	for i := 0; i < 6; i++ {
+		packet, err := sender.sess.seal([]byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, packet)
+	}
+	sender.mu.Unlock()
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	// Out of order, across key epoch boundaries. The handshake already used
+	// nonce 0, so packet i carries nonce i+1 and epoch (i+1)/2.
+	for _, i := range []int{2, 0, 1, 3} {
+		data, err := receiver.sess.open(packets[i])
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if data[0] != byte(i) {
+			t.Errorf("packet %d decrypted to %d", i, data[0])
+		}
+	}
+	if _, err := receiver.sess.open(packets[1]); err != errReplay {
+		t.Errorf("expected replay to be rejected, got %v", err)
+	}
+
+	tampered := append([]byte(nil), packets[4]...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := receiver.sess.open(tampered); err == nil {
+		t.Error("expected tampered packet to be rejected")
+	}
+	if _, err := receiver.sess.open(packets[4]); err != nil {
+		t.Errorf("expected original packet to be accepted: %v", err)
+	}
+}
+
+func TestPeerExpiry(t *testing.T) {
+	node := newTestNode(t, Config{})
+	peers := func() int {
+		node.mu.Lock()
+		defer node.mu.Unlock()
+		return len(node.peers)
+	}
+
+	conn, err := net.DialUDP("udp", nil, node.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, packet := range [][]byte{
+		{packetTransport, 1, 2, 3},
+		{packetHandshake3, 1, 2, 3},
+		{packetHandshake1, 1, 2, 3},
+	} {
+		conn.Write(packet)
+	}
+
+	// A valid first handshake message is the only way to become a peer
+	key, err := GenerateStaticKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs, err := fnoise.NewHandshakeState(fnoise.Config{
+		CipherSuite:   cipherSuite,
+		Pattern:       fnoise.HandshakeXX,
+		Initiator:     true,
+		StaticKeypair: key,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _, _, err := hs.WriteMessage([]byte{packetHandshake1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(msg)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, maxDatagramSize)); err != nil {
+		t.Fatalf("expected handshake message 2: %v", err)
+	}
+	if n := peers(); n != 1 {
+		t.Fatalf("expected only the handshaking address to become a peer, got %d peers", n)
+	}
+
+	// Never completed
+	node.expirePeers(time.Now().Add(node.handshakeWindow() / 2))
+	if n := peers(); n != 1 {
+		t.Fatalf("expected the handshake to be kept within its window, got %d peers", n)
+	}
+	node.expirePeers(time.Now().Add(node.handshakeWindow() + time.Second))
+	if n := peers(); n != 0 {
+		t.Fatalf("expected the abandoned handshake to expire, got %d peers", n)
+	}
+
+	// Idle session
+	other := newTestNode(t, Config{})
+	if err := other.Send(node.Addr().String(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, node)
+	node.expirePeers(time.Now().Add(node.handshakeWindow() + time.Second))
+	if node.Sessions() != 1 {
+		t.Fatal("expected an established session to outlive the handshake window")
+	}
+	node.expirePeers(time.Now().Add(node.cfg.SessionLifetime + node.handshakeWindow() + time.Second))
+	if n := peers(); n != 0 {
+		t.Fatalf("expected the idle session to expire, got %d peers", n)
+	}
+}
+
+func TestProtocolName(t *testing.T) {
+	if name := "Noise_XX_" + string(cipherSuite.Name()); name != Protocol {
+		t.Errorf("Protocol %s does not match the cipher suite %s", Protocol, name)
+	}
+}
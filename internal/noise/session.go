@@ -0,0 +1,177 @@
+package noise
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+
+	fnoise "github.com/flynn/noise"
+)
+
+// replayWindowSize is the number of nonces below the highest seen nonce that
+// are still accepted, so reordered datagrams are not dropped
+const replayWindowSize = 1024
+
+// maxEpochJump limits how many rekeys a receiver performs for a single packet
+const maxEpochJump = 8
+
+var (
+	errReplay    = errors.New("replayed or too old nonce")
+	errStaleKey  = errors.New("nonce belongs to an expired key epoch")
+	errExhausted = errors.New("session nonces exhausted")
+)
+
+// cipherKey is a transport key with its instantiated AEAD. Nonces are carried
+// explicitly in every datagram because UDP can drop and reorder packets.
+type cipherKey struct {
+	k [32]byte
+	c fnoise.Cipher
+}
+
+func newCipherKey(cs *fnoise.CipherState) cipherKey {
+	k := cs.UnsafeKey()
+	return cipherKey{k: k, c: cipherSuite.Cipher(k)}
+}
+
+// rekey implements the REKEY function of the Noise specification
+func (ck cipherKey) rekey() cipherKey {
+	var zeros [32]byte
+	out := ck.c.Encrypt(nil, math.MaxUint64, nil, zeros[:])
+	var next cipherKey
+	copy(next.k[:], out[:32])
+	next.c = cipherSuite.Cipher(next.k)
+	return next
+}
+
+// replayWindow is a sliding bitmap of received nonces
+type replayWindow struct {
+	highest uint64
+	seen    [replayWindowSize / 64]uint64
+	started bool
+}
+
+func (w *replayWindow) check(n uint64) bool {
+	if !w.started || n > w.highest {
+		return true
+	}
+	if w.highest-n >= replayWindowSize {
+		return false
+	}
+	bit := n % replayWindowSize
+	return w.seen[bit/64]&(1<<(bit%64)) == 0
+}
+
+func (w *replayWindow) mark(n uint64) {
+	if !w.started || n > w.highest {
+		start := w.highest + 1
+		if !w.started || n-w.highest >= replayWindowSize {
+			w.seen = [replayWindowSize / 64]uint64{}
+		} else {
+			for i := start; i <= n; i++ {
+				bit := i % replayWindowSize
+				w.seen[bit/64] &^= 1 << (bit % 64)
+			}
+		}
+		w.highest = n
+		w.started = true
+	}
+	bit := n % replayWindowSize
+	w.seen[bit/64] |= 1 << (bit % 64)
+}
+
+// session holds the transport state of a completed handshake with one peer.
+// Callers must hold the owning peer's lock.
+type session struct {
+	send      cipherKey
+	sendNonce uint64
+	sendEpoch uint64
+
+	recv      cipherKey
+	prevRecv  *cipherKey
+	recvEpoch uint64
+	window    replayWindow
+
+	remoteStatic []byte
+	established  time.Time
+	rekeyAfter   uint64
+}
+
+func newSession(send, recv *fnoise.CipherState, remoteStatic []byte, rekeyAfter uint64) *session {
+	return &session{
+		send:         newCipherKey(send),
+		recv:         newCipherKey(recv),
+		remoteStatic: append([]byte(nil), remoteStatic...),
+		established:  time.Now(),
+		rekeyAfter:   rekeyAfter,
+	}
+}
+
+func (s *session) epoch(n uint64) uint64 {
+	return n / s.rekeyAfter
+}
+
+// seal encrypts a transport datagram. The key is rotated every rekeyAfter
+// messages and the receiver derives the epoch from the explicit nonce.
+func (s *session) seal(plaintext []byte) ([]byte, error) {
+	if s.sendNonce >= fnoise.MaxNonce {
+		return nil, errExhausted
+	}
+	n := s.sendNonce
+	for e := s.epoch(n); s.sendEpoch < e; s.sendEpoch++ {
+		s.send = s.send.rekey()
+	}
+	s.sendNonce++
+
+	header := make([]byte, transportHeaderSize, transportHeaderSize+len(plaintext)+16)
+	header[0] = packetTransport
+	binary.BigEndian.PutUint64(header[1:], n)
+	return s.send.c.Encrypt(header, n, header, plaintext), nil
+}
+
+// open authenticates and decrypts a transport datagram
+func (s *session) open(packet []byte) ([]byte, error) {
+	if len(packet) < transportHeaderSize+16 {
+		return nil, errMalformed
+	}
+	header := packet[:transportHeaderSize]
+	n := binary.BigEndian.Uint64(header[1:])
+	if !s.window.check(n) {
+		return nil, errReplay
+	}
+
+	e := s.epoch(n)
+	var (
+		key      cipherKey
+		advanced []cipherKey
+	)
+	switch {
+	case e == s.recvEpoch:
+		key = s.recv
+	case e+1 == s.recvEpoch && s.prevRecv != nil:
+		key = *s.prevRecv
+	case e > s.recvEpoch && e-s.recvEpoch <= maxEpochJump:
+		key = s.recv
+		for i := s.recvEpoch; i < e; i++ {
+			advanced = append(advanced, key)
+			key = key.rekey()
+		}
+	default:
+		return nil, errStaleKey
+	}
+
+	plaintext, err := key.c.Decrypt(nil, n, header, packet[transportHeaderSize:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Only move to a newer epoch once a packet authenticated under it
+	if len(advanced) > 0 {
+		prev := advanced[len(advanced)-1]
+		s.prevRecv = &prev
+		s.recv = key
+		s.recvEpoch = e
+	}
+	s.window.mark(n)
+	return plaintext, nil
+}
@@ -0,0 +1,213 @@
+package protoloader
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers carrying the node's proof of identity on registry writes. Requests
+// are signed rather than sent over mutual TLS so they survive proxies that
+// terminate TLS in front of the registry.
+const (
+	HeaderCertificate = "X-QNE-Certificate" // Comma separated base64 DER chain, leaf first
+	HeaderTimestamp   = "X-QNE-Timestamp"   // Unix seconds
+	HeaderNonce       = "X-QNE-Nonce"       // Random hex, unique per request
+	HeaderSignature   = "X-QNE-Signature"   // Base64 signature of requestSignedData
+)
+
+// MaxRequestSkew is how far the timestamp of a signed request may be from
+// the registry's clock
+const MaxRequestSkew = 5 * time.Minute
+
+// maxNonceLength bounds the nonces a NonceCache remembers
+const maxNonceLength = 64
+
+// NonceCache remembers the nonces of verified requests while their
+// timestamps are accepted, so that a captured request cannot be replayed.
+// The zero value is ready to use.
+type NonceCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time // nonce to when its request's timestamp expires
+}
+
+// use records a nonce, returning false when it was already used
+func (c *NonceCache) use(nonce string, expires, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seen == nil {
+		c.seen = make(map[string]time.Time)
+	}
+	for n, exp := range c.seen {
+		if now.After(exp) {
+			delete(c.seen, n)
+		}
+	}
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+	c.seen[nonce] = expires
+	return true
+}
+
+// SetCertificate sets where the node's QNE certificate comes from, such as
+// certmanager.Manager.Certificate. Registry writes are signed with its key;
+// reads do not need it.
+func (l *ProtoLoader) SetCertificate(source func() (*tls.Certificate, error)) {
+	l.cacheMutex.Lock()
+	defer l.cacheMutex.Unlock()
+	l.nodeCert = source
+}
+
+// requestSignedData returns the bytes covered by a request signature. It
+// binds the method, path and query, time, nonce and body of the request.
+func requestSignedData(method, uri, timestamp, nonce string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	return []byte(strings.Join([]string{
+		"qne-request/2",
+		method,
+		uri,
+		timestamp,
+		nonce,
+		hex.EncodeToString(sum[:]),
+	}, "\x00"))
+}
+
+// SignRequest signs a request with a node certificate, setting the
+// X-QNE-Certificate, X-QNE-Timestamp, X-QNE-Nonce and X-QNE-Signature
+// headers. body must be the request's body. A signed request is accepted
+// once, so it must be signed again before it is resent.
+func SignRequest(req *http.Request, body []byte, cert *tls.Certificate) error {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return errors.New("no certificate to sign with")
+	}
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("certificate key is a %T, which cannot sign", cert.PrivateKey)
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	data := requestSignedData(req.Method, req.URL.RequestURI(), timestamp, hex.EncodeToString(nonce), body)
+	var (
+		sig []byte
+		err error
+	)
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		sig, err = signer.Sign(rand.Reader, data, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(data)
+		sig, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to sign request: %v", err)
+	}
+
+	chain := make([]string, len(cert.Certificate))
+	for i, der := range cert.Certificate {
+		chain[i] = base64.StdEncoding.EncodeToString(der)
+	}
+	req.Header.Set(HeaderCertificate, strings.Join(chain, ","))
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, hex.EncodeToString(nonce))
+	req.Header.Set(HeaderSignature, base64.StdEncoding.EncodeToString(sig))
+	return nil
+}
+
+// VerifyRequest checks the signature of a request made with SignRequest
+// against roots, and returns the node certificate that signed it along with
+// the body, which it reads in full. Requests whose nonce is already in
+// nonces are refused as replays.
+func VerifyRequest(req *http.Request, roots *x509.CertPool, nonces *NonceCache, maxBody int64) (*x509.Certificate, []byte, error) {
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxBody+1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read body: %v", err)
+	}
+	if int64(len(body)) > maxBody {
+		return nil, nil, fmt.Errorf("body larger than %d bytes", maxBody)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	encoded := req.Header.Get(HeaderCertificate)
+	if encoded == "" {
+		return nil, nil, errors.New("request is not signed")
+	}
+	var chain []*x509.Certificate
+	for _, part := range strings.Split(encoded, ",") {
+		der, err := base64.StdEncoding.DecodeString(part)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid certificate encoding: %v", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid certificate: %v", err)
+		}
+		chain = append(chain, cert)
+	}
+
+	timestamp := req.Header.Get(HeaderTimestamp)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, nil, errors.New("invalid timestamp")
+	}
+	signedAt := time.Unix(unix, 0)
+	if skew := time.Since(signedAt); skew > MaxRequestSkew || skew < -MaxRequestSkew {
+		return nil, nil, fmt.Errorf("timestamp %s is too far from now", signedAt.UTC().Format(time.RFC3339))
+	}
+	nonce := req.Header.Get(HeaderNonce)
+	if nonce == "" || len(nonce) > maxNonceLength {
+		return nil, nil, errors.New("invalid nonce")
+	}
+
+	leaf := chain[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   signedAt,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("untrusted certificate: %v", err)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(req.Header.Get(HeaderSignature))
+	if err != nil {
+		return nil, nil, errors.New("invalid signature encoding")
+	}
+	algorithm := x509.ECDSAWithSHA256
+	switch leaf.PublicKeyAlgorithm {
+	case x509.Ed25519:
+		algorithm = x509.PureEd25519
+	case x509.RSA:
+		algorithm = x509.SHA256WithRSA
+	}
+	data := requestSignedData(req.Method, req.URL.RequestURI(), timestamp, nonce, body)
+	if err := leaf.CheckSignature(algorithm, data, sig); err != nil {
+		return nil, nil, errors.New("invalid signature")
+	}
+	if !nonces.use(nonce, signedAt.Add(MaxRequestSkew), time.Now()) {
+		return nil, nil, errors.New("request already seen")
+	}
+	return leaf, body, nil
+}
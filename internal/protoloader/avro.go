@@ -0,0 +1,179 @@
+package protoloader
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hamba/avro/v2"
+	"github.com/hamba/avro/v2/pkg/crc64"
+)
+
+// AvroExt is the file extension of Avro schemas in the registry. They are
+// served like protos and share their cache, versions and verification.
+const AvroExt = ".avsc"
+
+// singleObjectMagic starts every Avro single-object encoded record
+var singleObjectMagic = []byte{0xC3, 0x01}
+
+// singleObjectHeaderLen is the magic followed by the schema fingerprint
+const singleObjectHeaderLen = 10
+
+// AvroSchema is a parsed Avro schema from the registry
+type AvroSchema struct {
+	ID      int64
+	Version string
+	Schema  avro.Schema
+
+	// Fingerprint is the Rabin fingerprint (CRC-64-AVRO) of the schema's
+	// parsing canonical form, as used by single-object encoding
+	Fingerprint uint64
+}
+
+// IsAvro reports whether a registry entry is an Avro schema
+func (p *Proto) IsAvro() bool {
+	return strings.HasSuffix(p.Name, AvroExt)
+}
+
+// ParseAvroSchema parses the content of a registry entry as an Avro schema.
+// Schemas have to be self-contained.
+func ParseAvroSchema(p *Proto) (*AvroSchema, error) {
+	// A private cache keeps named types of different schemas apart
+	schema, err := avro.ParseWithCache(p.Content, "", &avro.SchemaCache{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Avro schema %d (%s): %w", p.ID, p.Name, err)
+	}
+	return &AvroSchema{
+		ID:          p.ID,
+		Version:     p.Version,
+		Schema:      schema,
+		Fingerprint: Fingerprint(schema),
+	}, nil
+}
+
+// Fingerprint returns the Rabin fingerprint of a schema
+func Fingerprint(schema avro.Schema) uint64 {
+	h := crc64.New()
+	h.Write([]byte(schema.String()))
+	return h.Sum64()
+}
+
+// AvroSchema fetches and parses the latest version of an Avro schema
+func (l *ProtoLoader) AvroSchema(ctx context.Context, id int64) (*AvroSchema, error) {
+	proto, err := l.GetProto(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get schema: %w", err)
+	}
+
+	l.cacheMutex.RLock()
+	parsed, ok := l.avroCache[id]
+	l.cacheMutex.RUnlock()
+	if ok && parsed.Version == proto.Version {
+		return parsed, nil
+	}
+
+	schema, err := l.parseAvro(proto)
+	if err != nil {
+		return nil, err
+	}
+	l.cacheMutex.Lock()
+	l.avroCache[id] = schema
+	l.cacheMutex.Unlock()
+	return schema, nil
+}
+
+// AvroSchemaVersion fetches and parses a specific version of an Avro schema,
+// for example to read records written with it
+func (l *ProtoLoader) AvroSchemaVersion(ctx context.Context, id int64, version string) (*AvroSchema, error) {
+	proto, err := l.GetProtoVersion(ctx, id, version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get schema: %w", err)
+	}
+	return l.parseAvro(proto)
+}
+
+// AvroSchemaByFingerprint returns a schema loaded earlier by its fingerprint
+func (l *ProtoLoader) AvroSchemaByFingerprint(fingerprint uint64) (*AvroSchema, bool) {
+	l.cacheMutex.RLock()
+	defer l.cacheMutex.RUnlock()
+	schema, ok := l.fingerprints[fingerprint]
+	return schema, ok
+}
+
+// DecodeSingleObject decodes a single-object encoded record into v, with
+// the schema named by its fingerprint. The schema must have been loaded
+// with AvroSchema or AvroSchemaVersion before.
+func (l *ProtoLoader) DecodeSingleObject(data []byte, v any) (*AvroSchema, error) {
+	fingerprint, err := SingleObjectFingerprint(data)
+	if err != nil {
+		return nil, err
+	}
+	schema, ok := l.AvroSchemaByFingerprint(fingerprint)
+	if !ok {
+		return nil, fmt.Errorf("unknown Avro schema fingerprint %016x", fingerprint)
+	}
+	return schema, schema.DecodeSingle(data, v)
+}
+
+// parseAvro parses a schema and indexes it by fingerprint
+func (l *ProtoLoader) parseAvro(proto *Proto) (*AvroSchema, error) {
+	if !proto.IsAvro() {
+		return nil, fmt.Errorf("proto %d (%s) is not an Avro schema", proto.ID, proto.Name)
+	}
+	schema, err := ParseAvroSchema(proto)
+	if err != nil {
+		return nil, err
+	}
+	l.cacheMutex.Lock()
+	l.fingerprints[schema.Fingerprint] = schema
+	l.cacheMutex.Unlock()
+	return schema, nil
+}
+
+// Encode encodes a Go value or a map[string]any in the Avro binary encoding
+func (s *AvroSchema) Encode(v any) ([]byte, error) {
+	return avro.Marshal(s.Schema, v)
+}
+
+// Decode decodes the Avro binary encoding into a pointer to a Go value or a
+// map[string]any
+func (s *AvroSchema) Decode(data []byte, v any) error {
+	return avro.Unmarshal(s.Schema, data, v)
+}
+
+// EncodeSingle encodes a value as a single object: a header naming the
+// schema by fingerprint, followed by the binary encoding
+func (s *AvroSchema) EncodeSingle(v any) ([]byte, error) {
+	body, err := s.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, singleObjectHeaderLen, singleObjectHeaderLen+len(body))
+	copy(out, singleObjectMagic)
+	binary.LittleEndian.PutUint64(out[2:], s.Fingerprint)
+	return append(out, body...), nil
+}
+
+// DecodeSingle decodes a single object written with this schema
+func (s *AvroSchema) DecodeSingle(data []byte, v any) error {
+	fingerprint, err := SingleObjectFingerprint(data)
+	if err != nil {
+		return err
+	}
+	if fingerprint != s.Fingerprint {
+		return fmt.Errorf("record was written with schema %016x, not %016x", fingerprint, s.Fingerprint)
+	}
+	return s.Decode(data[singleObjectHeaderLen:], v)
+}
+
+// SingleObjectFingerprint returns the schema fingerprint from the header of
+// a single-object encoded record
+func SingleObjectFingerprint(data []byte) (uint64, error) {
+	if len(data) < singleObjectHeaderLen || !bytes.Equal(data[:2], singleObjectMagic) {
+		return 0, errors.New("not an Avro single-object encoded record")
+	}
+	return binary.LittleEndian.Uint64(data[2:singleObjectHeaderLen]), nil
+}
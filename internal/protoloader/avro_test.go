@@ -0,0 +1,214 @@
+package protoloader
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const userSchema = `{
+  "type": "record",
+  "name": "User",
+  "namespace": "qne.chat",
+  "fields": [
+    {"name": "name", "type": "string"},
+    {"name": "age", "type": "int"},
+    {"name": "email", "type": ["null", "string"], "default": null},
+    {"name": "role", "type": {"type": "enum", "name": "Role", "symbols": ["MEMBER", "ADMIN"]}},
+    {"name": "tags", "type": {"type": "array", "items": "string"}},
+    {"name": "scores", "type": {"type": "map", "values": "long"}},
+    {"name": "avatar", "type": "bytes"},
+    {"name": "id", "type": {"type": "fixed", "name": "ID", "size": 4}}
+  ]
+}`
+
+type user struct {
+	Name   string           `avro:"name"`
+	Age    int              `avro:"age"`
+	Email  *string          `avro:"email"`
+	Role   string           `avro:"role"`
+	Tags   []string         `avro:"tags"`
+	Scores map[string]int64 `avro:"scores"`
+	Avatar []byte           `avro:"avatar"`
+	ID     [4]byte          `avro:"id"`
+}
+
+func TestAvro(t *testing.T) {
+	email := "fox@example.com"
+	alice := user{
+		Name: "quiet-fox", Age: 7, Email: &email, Role: "ADMIN",
+		Tags: []string{"a", "b"}, Scores: map[string]int64{"x": 1},
+		Avatar: []byte{0x00, 0xff}, ID: [4]byte{1, 2, 3, 4},
+	}
+	server := newTestRegistry(t,
+		Proto{ID: 1, Namespace: "chat", Name: "user.avsc", Version: "v1", Content: userSchema},
+		Proto{ID: 2, Namespace: "chat", Name: "int.avsc", Version: "v1", Content: `"int"`},
+		Proto{ID: 3, Namespace: "chat", Name: "chat.proto", Version: "v1", Content: `syntax = "proto3";`},
+		Proto{ID: 4, Namespace: "chat", Name: "broken.avsc", Version: "v1", Content: `{"type": "record"}`},
+	)
+	loader := newTestLoader(t, server.URL)
+	ctx := context.Background()
+
+	schema, err := loader.AvroSchema(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Fingerprint", func(t *testing.T) {
+		// From the test vectors of the Avro specification
+		intSchema, err := loader.AvroSchema(ctx, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if intSchema.Fingerprint != 8247732601305521295 {
+			t.Errorf("unexpected fingerprint %d", intSchema.Fingerprint)
+		}
+		again, _ := loader.AvroSchema(ctx, 1)
+		if again != schema {
+			t.Error("expected the parsed schema to be cached")
+		}
+	})
+
+	t.Run("Binary", func(t *testing.T) {
+		data, err := schema.Encode(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded user
+		if err := schema.Decode(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, alice) {
+			t.Errorf("struct changed in a round trip: %+v", decoded)
+		}
+
+		var generic map[string]any
+		if err := schema.Decode(data, &generic); err != nil {
+			t.Fatal(err)
+		}
+		if generic["name"] != "quiet-fox" {
+			t.Errorf("unexpected map %v", generic)
+		}
+		fromMap, err := schema.Encode(generic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(fromMap) != string(data) {
+			t.Error("map encoding differs from struct encoding")
+		}
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		data, err := schema.EncodeJSON(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `{"name":"quiet-fox","age":7,"email":{"string":"fox@example.com"},"role":"ADMIN",` +
+			`"tags":["a","b"],"scores":{"x":1},"avatar":"\u0000ÿ","id":"\u0001\u0002\u0003\u0004"}`
+		if string(data) != want {
+			t.Errorf("unexpected JSON\n got %s\nwant %s", data, want)
+		}
+
+		var decoded user
+		if err := schema.DecodeJSON(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, alice) {
+			t.Errorf("struct changed in a JSON round trip: %+v", decoded)
+		}
+
+		// Fields with defaults may be left out
+		minimal := `{"name":"a","age":1,"role":"MEMBER","tags":[],"scores":{},"avatar":"","id":"abcd"}`
+		var generic map[string]any
+		if err := schema.DecodeJSON([]byte(minimal), &generic); err != nil {
+			t.Fatal(err)
+		}
+		if generic["email"] != nil {
+			t.Errorf("expected the default email, got %v", generic["email"])
+		}
+	})
+
+	t.Run("JSONErrors", func(t *testing.T) {
+		for name, input := range map[string]string{
+			"MissingField":  `{"name":"a"}`,
+			"WrongType":     `{"name":1}`,
+			"UnknownSymbol": `{"name":"a","age":1,"role":"OWNER","tags":[],"scores":{},"avatar":"","id":"abcd"}`,
+			"BareUnion":     `{"name":"a","age":1,"email":"x","role":"MEMBER","tags":[],"scores":{},"avatar":"","id":"abcd"}`,
+			"IntOverflow":   `{"name":"a","age":4294967296,"role":"MEMBER","tags":[],"scores":{},"avatar":"","id":"abcd"}`,
+			"FixedSize":     `{"name":"a","age":1,"role":"MEMBER","tags":[],"scores":{},"avatar":"","id":"abc"}`,
+			"NotAByte":      `{"name":"a","age":1,"role":"MEMBER","tags":[],"scores":{},"avatar":"€","id":"abcd"}`,
+		} {
+			var decoded user
+			if err := schema.DecodeJSON([]byte(input), &decoded); err == nil {
+				t.Errorf("%s: expected an error", name)
+			}
+		}
+	})
+
+	t.Run("SingleObject", func(t *testing.T) {
+		data, err := schema.EncodeSingle(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data[0] != 0xC3 || data[1] != 0x01 {
+			t.Errorf("unexpected header % x", data[:2])
+		}
+		if fp, err := SingleObjectFingerprint(data); err != nil || fp != schema.Fingerprint {
+			t.Errorf("unexpected fingerprint %016x: %v", fp, err)
+		}
+
+		var decoded user
+		found, err := loader.DecodeSingleObject(data, &decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != schema || !reflect.DeepEqual(decoded, alice) {
+			t.Errorf("unexpected record %+v", decoded)
+		}
+
+		intSchema, _ := loader.AvroSchema(ctx, 2)
+		var n int
+		if err := intSchema.DecodeSingle(data, &n); err == nil || !strings.Contains(err.Error(), "written with schema") {
+			t.Errorf("expected a fingerprint mismatch, got %v", err)
+		}
+		if _, err := newTestLoader(t, server.URL).DecodeSingleObject(data, &decoded); err == nil {
+			t.Error("expected an unknown fingerprint to fail")
+		}
+		if _, err := SingleObjectFingerprint([]byte("{}")); err == nil {
+			t.Error("expected a record without header to fail")
+		}
+	})
+
+	t.Run("NotAvro", func(t *testing.T) {
+		if _, err := loader.AvroSchema(ctx, 3); err == nil {
+			t.Error("expected a proto not to parse as Avro")
+		}
+		if _, err := loader.AvroSchema(ctx, 4); err == nil || !strings.Contains(err.Error(), "broken.avsc") {
+			t.Errorf("expected a parse error naming the file, got %v", err)
+		}
+		if err := loader.CompileProto(ctx, 1); err == nil {
+			t.Error("expected compiling an Avro schema to fail")
+		}
+		if _, err := loader.FileDescriptor(ctx, 1); err == nil {
+			t.Error("expected an Avro schema to have no descriptor")
+		}
+	})
+
+	t.Run("JSONOrder", func(t *testing.T) {
+		data, _ := schema.EncodeJSON(alice)
+		var fields []string
+		dec := json.NewDecoder(strings.NewReader(string(data)))
+		dec.Token()
+		for dec.More() {
+			key, _ := dec.Token()
+			fields = append(fields, key.(string))
+			var skip json.RawMessage
+			dec.Decode(&skip)
+		}
+		if strings.Join(fields, ",") != "name,age,email,role,tags,scores,avatar,id" {
+			t.Errorf("record fields out of schema order: %v", fields)
+		}
+	})
+}
@@ -0,0 +1,358 @@
+package protoloader
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/hamba/avro/v2"
+)
+
+// EncodeJSON encodes a Go value or a map[string]any in the Avro JSON
+// encoding, where unions are written as {"type": value} and bytes as strings
+// of code points up to U+00FF
+func (s *AvroSchema) EncodeJSON(v any) ([]byte, error) {
+	data, err := s.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	r := avro.NewReader(bytes.NewReader(data), len(data)+1)
+	value := readJSON(r, s.Schema)
+	if r.Error != nil {
+		return nil, r.Error
+	}
+	return json.Marshal(value)
+}
+
+// DecodeJSON decodes the Avro JSON encoding into a pointer to a Go value or
+// a map[string]any
+func (s *AvroSchema) DecodeJSON(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value any
+	if err := dec.Decode(&value); err != nil {
+		return fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	var buf bytes.Buffer
+	w := avro.NewWriter(&buf, 512)
+	if err := writeJSON(w, s.Schema, value, "$"); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return s.Decode(buf.Bytes(), v)
+}
+
+// jsonObject is a JSON object that keeps its keys in order, like the fields
+// of a record
+type jsonObject []jsonMember
+
+type jsonMember struct {
+	key   string
+	value any
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, m := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(m.key)
+		buf.Write(key)
+		buf.WriteByte(':')
+		value, err := json.Marshal(m.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// branchName names a union branch in the JSON encoding
+func branchName(schema avro.Schema) string {
+	if ref, ok := schema.(*avro.RefSchema); ok {
+		schema = ref.Schema()
+	}
+	if named, ok := schema.(avro.NamedSchema); ok {
+		return named.FullName()
+	}
+	return string(schema.Type())
+}
+
+// readJSON reads a binary encoded value as its JSON encoding
+func readJSON(r *avro.Reader, schema avro.Schema) any {
+	switch s := schema.(type) {
+	case *avro.RefSchema:
+		return readJSON(r, s.Schema())
+	case *avro.RecordSchema:
+		obj := make(jsonObject, 0, len(s.Fields()))
+		for _, field := range s.Fields() {
+			obj = append(obj, jsonMember{field.Name(), readJSON(r, field.Type())})
+		}
+		return obj
+	case *avro.EnumSchema:
+		symbol, _ := s.Symbol(int(r.ReadInt()))
+		return symbol
+	case *avro.FixedSchema:
+		b := make([]byte, s.Size())
+		r.Read(b)
+		return bytesToJSON(b)
+	case *avro.ArraySchema:
+		arr := []any{}
+		for r.Error == nil {
+			n, _ := r.ReadBlockHeader()
+			if n == 0 {
+				break
+			}
+			for i := int64(0); i < n && r.Error == nil; i++ {
+				arr = append(arr, readJSON(r, s.Items()))
+			}
+		}
+		return arr
+	case *avro.MapSchema:
+		obj := map[string]any{}
+		for r.Error == nil {
+			n, _ := r.ReadBlockHeader()
+			if n == 0 {
+				break
+			}
+			for i := int64(0); i < n && r.Error == nil; i++ {
+				key := r.ReadString()
+				obj[key] = readJSON(r, s.Values())
+			}
+		}
+		return obj
+	case *avro.UnionSchema:
+		i := int(r.ReadLong())
+		if i < 0 || i >= len(s.Types()) {
+			r.ReportError("read union", "unknown union branch")
+			return nil
+		}
+		branch := s.Types()[i]
+		if branch.Type() == avro.Null {
+			return nil
+		}
+		return jsonObject{{branchName(branch), readJSON(r, branch)}}
+	}
+
+	switch schema.Type() {
+	case avro.Boolean:
+		return r.ReadBool()
+	case avro.Int:
+		return r.ReadInt()
+	case avro.Long:
+		return r.ReadLong()
+	case avro.Float:
+		return r.ReadFloat()
+	case avro.Double:
+		return r.ReadDouble()
+	case avro.String:
+		return r.ReadString()
+	case avro.Bytes:
+		return bytesToJSON(r.ReadBytes())
+	}
+	return nil
+}
+
+// writeJSON writes a value decoded from the JSON encoding in the binary
+// encoding. path locates the value for error messages.
+func writeJSON(w *avro.Writer, schema avro.Schema, v any, path string) error {
+	mismatch := func() error {
+		return fmt.Errorf("%s: expected %s, got %T", path, schema.Type(), v)
+	}
+
+	switch s := schema.(type) {
+	case *avro.RefSchema:
+		return writeJSON(w, s.Schema(), v, path)
+	case *avro.RecordSchema:
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return mismatch()
+		}
+		for _, field := range s.Fields() {
+			value, ok := obj[field.Name()]
+			if !ok {
+				if !field.HasDefault() {
+					return fmt.Errorf("%s.%s: missing field", path, field.Name())
+				}
+				data, err := avro.Marshal(field.Type(), field.Default())
+				if err != nil {
+					return fmt.Errorf("%s.%s: invalid default: %v", path, field.Name(), err)
+				}
+				w.Write(data)
+				continue
+			}
+			if err := writeJSON(w, field.Type(), value, path+"."+field.Name()); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *avro.EnumSchema:
+		symbol, ok := v.(string)
+		if !ok {
+			return mismatch()
+		}
+		for i, sym := range s.Symbols() {
+			if sym == symbol {
+				w.WriteInt(int32(i))
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: unknown symbol %q", path, symbol)
+	case *avro.FixedSchema:
+		b, err := jsonToBytes(v, path)
+		if err != nil {
+			return err
+		}
+		if len(b) != s.Size() {
+			return fmt.Errorf("%s: expected %d bytes, got %d", path, s.Size(), len(b))
+		}
+		w.Write(b)
+		return nil
+	case *avro.ArraySchema:
+		arr, ok := v.([]any)
+		if !ok {
+			return mismatch()
+		}
+		if len(arr) > 0 {
+			w.WriteBlockHeader(int64(len(arr)), 0)
+			for i, item := range arr {
+				if err := writeJSON(w, s.Items(), item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+		w.WriteLong(0)
+		return nil
+	case *avro.MapSchema:
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return mismatch()
+		}
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if len(keys) > 0 {
+			w.WriteBlockHeader(int64(len(keys)), 0)
+			for _, key := range keys {
+				w.WriteString(key)
+				if err := writeJSON(w, s.Values(), obj[key], path+"."+key); err != nil {
+					return err
+				}
+			}
+		}
+		w.WriteLong(0)
+		return nil
+	case *avro.UnionSchema:
+		name := "null"
+		var value any
+		if v != nil {
+			obj, ok := v.(map[string]any)
+			if !ok || len(obj) != 1 {
+				return fmt.Errorf("%s: expected a union as {\"type\": value}", path)
+			}
+			for name, value = range obj {
+			}
+		}
+		for i, branch := range s.Types() {
+			if branchName(branch) == name {
+				w.WriteLong(int64(i))
+				return writeJSON(w, branch, value, path)
+			}
+		}
+		return fmt.Errorf("%s: union has no branch %s", path, name)
+	}
+
+	switch schema.Type() {
+	case avro.Null:
+		if v != nil {
+			return mismatch()
+		}
+	case avro.Boolean:
+		b, ok := v.(bool)
+		if !ok {
+			return mismatch()
+		}
+		w.WriteBool(b)
+	case avro.Int, avro.Long:
+		n, ok := v.(json.Number)
+		if !ok {
+			return mismatch()
+		}
+		i, err := n.Int64()
+		if err != nil {
+			return fmt.Errorf("%s: %s is not an integer", path, n)
+		}
+		if schema.Type() == avro.Int {
+			if i < math.MinInt32 || i > math.MaxInt32 {
+				return fmt.Errorf("%s: %d overflows int", path, i)
+			}
+			w.WriteInt(int32(i))
+		} else {
+			w.WriteLong(i)
+		}
+	case avro.Float, avro.Double:
+		n, ok := v.(json.Number)
+		if !ok {
+			return mismatch()
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return fmt.Errorf("%s: %s is not a number", path, n)
+		}
+		if schema.Type() == avro.Float {
+			w.WriteFloat(float32(f))
+		} else {
+			w.WriteDouble(f)
+		}
+	case avro.String:
+		str, ok := v.(string)
+		if !ok {
+			return mismatch()
+		}
+		w.WriteString(str)
+	case avro.Bytes:
+		b, err := jsonToBytes(v, path)
+		if err != nil {
+			return err
+		}
+		w.WriteBytes(b)
+	default:
+		return fmt.Errorf("%s: unsupported type %s", path, schema.Type())
+	}
+	return nil
+}
+
+// bytesToJSON maps each byte to the code point of the same value
+func bytesToJSON(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+func jsonToBytes(v any, path string) ([]byte, error) {
+	str, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected bytes as a string, got %T", path, v)
+	}
+	b := make([]byte, 0, len(str))
+	for _, r := range str {
+		if r > 0xFF {
+			return nil, fmt.Errorf("%s: code point %U is not a byte", path, r)
+		}
+		b = append(b, byte(r))
+	}
+	return b, nil
+}
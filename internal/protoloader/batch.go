@@ -0,0 +1,56 @@
+package protoloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DefaultFetchConcurrency is how many protos GetProtos fetches at once
+const DefaultFetchConcurrency = 8
+
+// SetFetchConcurrency sets how many protos GetProtos fetches at once
+func (l *ProtoLoader) SetFetchConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+	l.cacheMutex.Lock()
+	defer l.cacheMutex.Unlock()
+	l.fetchLimit = n
+}
+
+// GetProtos returns the latest versions of several protos, in the order of
+// ids. Cached protos are served right away and the others fetched in
+// parallel. Protos that fail are left nil and their errors joined.
+func (l *ProtoLoader) GetProtos(ctx context.Context, ids []int64) ([]*Proto, error) {
+	l.cacheMutex.RLock()
+	limit := l.fetchLimit
+	l.cacheMutex.RUnlock()
+
+	protos := make([]*Proto, len(ids))
+	errs := make([]error, len(ids))
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = fmt.Errorf("proto %d: %w", id, ctx.Err())
+			continue
+		}
+		wg.Add(1)
+		go func(i int, id int64) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			proto, err := l.GetProto(ctx, id)
+			if err != nil {
+				errs[i] = fmt.Errorf("proto %d: %w", id, err)
+				return
+			}
+			protos[i] = proto
+		}(i, id)
+	}
+	wg.Wait()
+	return protos, errors.Join(errs...)
+}
@@ -0,0 +1,339 @@
+package protoloader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DefaultMaxAge is how long a fetched proto is served before it is
+// revalidated against the registry
+const DefaultMaxAge = 5 * time.Minute
+
+// touchInterval throttles refreshing the modification time of cache files
+// served from memory, which CollectGarbage reads as their last use
+const touchInterval = time.Hour
+
+var ErrNotFound = errors.New("proto not found")
+
+// cacheKey identifies a cached proto. An empty version stands for the latest
+// version, which is revalidated, while pinned versions never change.
+type cacheKey struct {
+	id      int64
+	version string
+}
+
+// cacheEntry is a cached proto as kept in memory and on disk
+type cacheEntry struct {
+	Proto     *Proto    `json:"proto"`
+	ETag      string    `json:"etag,omitempty"`
+	FetchedAt time.Time `json:"fetched_at"`
+
+	touched time.Time // Last refresh of the file's modification time
+}
+
+// SetMaxAge sets how long the latest version of a proto is served from the
+// cache before it is revalidated. Zero revalidates on every GetProto.
+func (l *ProtoLoader) SetMaxAge(d time.Duration) {
+	l.cacheMutex.Lock()
+	defer l.cacheMutex.Unlock()
+	l.maxAge = d
+}
+
+// GetProtoVersion returns a specific version of a proto. Versions are
+// immutable, so a cached copy is never revalidated.
+func (l *ProtoLoader) GetProtoVersion(ctx context.Context, id int64, version string) (*Proto, error) {
+	if version == "" {
+		return l.GetProto(ctx, id)
+	}
+	key := cacheKey{id, version}
+	if entry := l.cached(key); entry != nil {
+		return entry.Proto, nil
+	}
+
+	return l.coalesce(ctx, key, func() (*Proto, error) {
+		entry, _, err := l.fetch(ctx, id, version, "")
+		if err != nil {
+			return nil, err
+		}
+		if entry.Proto.Version != version {
+			return nil, fmt.Errorf("registry returned version %s of proto %d instead of %s", entry.Proto.Version, id, version)
+		}
+		l.store(key, entry)
+		return entry.Proto, nil
+	})
+}
+
+// Refresh revalidates the latest version of a proto with the registry now,
+// regardless of its age
+func (l *ProtoLoader) Refresh(ctx context.Context, id int64) (*Proto, error) {
+	key := cacheKey{id: id}
+	cached := l.cached(key)
+	return l.coalesce(ctx, key, func() (*Proto, error) {
+		return l.revalidate(ctx, id, cached)
+	})
+}
+
+// coalesce runs fn for key unless a call for the same key is in flight, in
+// which case it waits for that call's result instead. A caller whose own
+// context is still live retries when the call it joined was canceled.
+func (l *ProtoLoader) coalesce(ctx context.Context, key cacheKey, fn func() (*Proto, error)) (*Proto, error) {
+	name := fmt.Sprintf("%d@%s", key.id, key.version)
+	for {
+		ch := l.flights.DoChan(name, func() (interface{}, error) {
+			return fn()
+		})
+		select {
+		case res := <-ch:
+			canceled := errors.Is(res.Err, context.Canceled) || errors.Is(res.Err, context.DeadlineExceeded)
+			if res.Shared && canceled && ctx.Err() == nil {
+				continue
+			}
+			proto, _ := res.Val.(*Proto)
+			return proto, res.Err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Invalidate drops the cached latest version of a proto from memory and
+// disk, so the next GetProto fetches it again. Pinned versions are kept.
+func (l *ProtoLoader) Invalidate(id int64) {
+	key := cacheKey{id: id}
+	l.cacheMutex.Lock()
+	l.protoCache.remove(key)
+	delete(l.descCache, id)
+	delete(l.avroCache, id)
+	l.cacheMutex.Unlock()
+	os.Remove(l.cachePath(key))
+}
+
+// revalidate fetches the latest version of a proto, sending the ETag of the
+// cached entry so an unchanged proto is not transferred again. The cached
+// entry is served when the registry cannot be reached.
+func (l *ProtoLoader) revalidate(ctx context.Context, id int64, cached *cacheEntry) (*Proto, error) {
+	etag := ""
+	if cached != nil {
+		etag = cached.ETag
+	}
+	entry, notModified, err := l.fetch(ctx, id, "", etag)
+	switch {
+	case err == nil && notModified:
+		refreshed := *cached
+		refreshed.FetchedAt = time.Now()
+		entry = &refreshed
+	case errors.Is(err, ErrNotFound):
+		l.Invalidate(id)
+		return nil, err
+	case errors.As(err, new(*IntegrityError)):
+		// Not a reason to fall back: the registry answered with a bad proto
+		return nil, err
+	case err != nil && cached != nil:
+		log.Printf("Serving cached proto %d, revalidation failed: %v", id, err)
+		return cached.Proto, nil
+	case err != nil:
+		return nil, err
+	}
+
+	l.storeLatest(entry)
+	return entry.Proto, nil
+}
+
+// storeLatest stores the latest version of a proto, and a copy under its
+// version so every version seen is kept side by side for GetProtoVersion
+func (l *ProtoLoader) storeLatest(entry *cacheEntry) {
+	l.store(cacheKey{id: entry.Proto.ID}, entry)
+	if entry.Proto.Version != "" {
+		l.store(cacheKey{entry.Proto.ID, entry.Proto.Version}, &cacheEntry{Proto: entry.Proto, FetchedAt: entry.FetchedAt})
+	}
+}
+
+// fresh reports whether a cached latest version can be served without
+// revalidation
+func (l *ProtoLoader) fresh(entry *cacheEntry) bool {
+	l.cacheMutex.RLock()
+	maxAge := l.maxAge
+	l.cacheMutex.RUnlock()
+	return time.Since(entry.FetchedAt) < maxAge
+}
+
+// cached returns an entry from memory or, failing that, from disk
+func (l *ProtoLoader) cached(key cacheKey) *cacheEntry {
+	path := l.cachePath(key)
+	l.cacheMutex.Lock()
+	entry, ok := l.protoCache.get(key)
+	stale := false
+	if ok {
+		l.stats.Hits++
+		if now := time.Now(); now.Sub(entry.touched) > touchInterval {
+			entry.touched = now
+			stale = true
+		}
+	}
+	l.cacheMutex.Unlock()
+	if ok {
+		if stale {
+			touch(path)
+		}
+		return entry
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		l.countMiss()
+		return nil
+	}
+	entry = &cacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil || entry.Proto == nil {
+		if err == nil {
+			err = errors.New("no proto")
+		}
+		l.quarantine(path, err)
+		l.countMiss()
+		return nil
+	}
+	if entry.Proto.ID != key.id || (key.version != "" && entry.Proto.Version != key.version) {
+		l.quarantine(path, fmt.Errorf("holds proto %d version %s", entry.Proto.ID, entry.Proto.Version))
+		l.countMiss()
+		return nil
+	}
+	// Anything able to write to the cache dir could have changed the file
+	if err := l.verify(entry.Proto); err != nil {
+		log.Printf("Refusing cached proto from %s: %v", path, err)
+		l.countMiss()
+		return nil
+	}
+	touch(path)
+	entry.touched = time.Now()
+
+	l.cacheMutex.Lock()
+	l.stats.DiskHits++
+	l.stats.Evictions += int64(l.protoCache.add(key, entry))
+	l.cacheMutex.Unlock()
+	return entry
+}
+
+// quarantine moves a cache file that cannot be read aside, keeping it for
+// inspection until CollectGarbage removes it
+func (l *ProtoLoader) quarantine(path string, reason error) {
+	if err := os.Rename(path, path+".corrupt"); err != nil {
+		log.Printf("Failed to quarantine corrupt cache file %s: %v", path, err)
+		return
+	}
+	log.Printf("Quarantined corrupt cache file %s: %v", path, reason)
+	l.cacheMutex.Lock()
+	l.stats.Quarantined++
+	l.cacheMutex.Unlock()
+}
+
+func (l *ProtoLoader) countMiss() {
+	l.cacheMutex.Lock()
+	l.stats.Misses++
+	l.cacheMutex.Unlock()
+}
+
+// store puts an entry into memory and onto disk
+func (l *ProtoLoader) store(key cacheKey, entry *cacheEntry) {
+	l.cacheMutex.Lock()
+	entry.touched = time.Now()
+	l.stats.Evictions += int64(l.protoCache.add(key, entry))
+	l.cacheMutex.Unlock()
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if err := writeFileAtomic(l.cachePath(key), data, 0644); err != nil {
+		log.Printf("Failed to write proto cache: %v", err)
+	}
+}
+
+// writeFileAtomic writes a file through a temporary file in the same
+// directory, so readers and crashes never see it half written. The
+// temporary name matches its target's, for CollectGarbage to clean up
+// after a crash.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// cachePath returns the disk cache file for a key. The latest version keeps
+// the name used before versioning.
+func (l *ProtoLoader) cachePath(key cacheKey) string {
+	if key.version == "" {
+		return filepath.Join(l.cacheDir, fmt.Sprintf("proto_%d.json", key.id))
+	}
+	return filepath.Join(l.cacheDir, fmt.Sprintf("proto_%d@%s.json", key.id, url.PathEscape(key.version)))
+}
+
+// fetch requests a proto from the registry. With an ETag the request is
+// conditional and notModified reports a 304 answer.
+func (l *ProtoLoader) fetch(ctx context.Context, id int64, version, etag string) (entry *cacheEntry, notModified bool, err error) {
+	reqURL := fmt.Sprintf("%s/api/v1/protos/%d", l.serverURL, id)
+	if version != "" {
+		reqURL += "?" + url.Values{"version": {version}}.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create request: %v", err)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := l.httpClient.Do(req)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to fetch proto: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && etag != "":
+		return nil, true, nil
+	case resp.StatusCode == http.StatusNotFound && version != "":
+		return nil, false, fmt.Errorf("%w: %d version %s", ErrNotFound, id, version)
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, false, fmt.Errorf("%w: %d", ErrNotFound, id)
+	case resp.StatusCode != http.StatusOK:
+		return nil, false, fmt.Errorf("server returned status %d", resp.StatusCode)
+	}
+
+	var proto Proto
+	if err := json.NewDecoder(resp.Body).Decode(&proto); err != nil {
+		return nil, false, fmt.Errorf("failed to decode response: %v", err)
+	}
+	if proto.ID != id {
+		return nil, false, &IntegrityError{ID: id, Version: proto.Version, Reason: fmt.Sprintf("registry returned proto %d", proto.ID)}
+	}
+	if err := l.verify(&proto); err != nil {
+		return nil, false, err
+	}
+	return &cacheEntry{Proto: &proto, ETag: resp.Header.Get("ETag"), FetchedAt: time.Now()}, false, nil
+}
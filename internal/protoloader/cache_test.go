@@ -0,0 +1,274 @@
+package protoloader_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/qnepff/qne-node-v12/internal/gatewaytest"
+	"github.com/qnepff/qne-node-v12/internal/protoloader"
+)
+
+func TestVersionedCache(t *testing.T) {
+	gateway, err := gatewaytest.New(gatewaytest.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway.AddProto(protoloader.Proto{ID: 1, Namespace: "chat", Name: "chat.proto", Version: "v1",
+		Content: "syntax = \"proto3\";\nmessage First {}\n"})
+
+	var requests, conditional atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("If-None-Match") != "" {
+			conditional.Add(1)
+		}
+		gateway.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	cacheDir := t.TempDir()
+	compiledDir := t.TempDir()
+	loader, err := protoloader.New(server.URL, cacheDir, compiledDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loader.SetTrustAnchors(gateway.RegistryKey())
+	ctx := context.Background()
+
+	t.Run("Fresh", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			proto, err := loader.GetProto(ctx, 1)
+			if err != nil || proto.Version != "v1" {
+				t.Fatalf("unexpected proto %+v: %v", proto, err)
+			}
+		}
+		if requests.Load() != 1 {
+			t.Errorf("expected one request while fresh, got %d", requests.Load())
+		}
+	})
+
+	t.Run("Revalidate", func(t *testing.T) {
+		loader.SetMaxAge(0)
+		if _, err := loader.GetProto(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+		if conditional.Load() != 1 {
+			t.Errorf("expected a conditional request, got %d", conditional.Load())
+		}
+
+		gateway.AddProto(protoloader.Proto{ID: 1, Namespace: "chat", Name: "chat.proto", Version: "v2",
+			Content: "syntax = \"proto3\";\nmessage Second {}\n"})
+		proto, err := loader.GetProto(ctx, 1)
+		if err != nil || proto.Version != "v2" {
+			t.Fatalf("expected the new version, got %+v: %v", proto, err)
+		}
+		if _, err := loader.MessageType(ctx, 1, "Second"); err != nil {
+			t.Errorf("descriptor not updated to the new version: %v", err)
+		}
+	})
+
+	t.Run("Pinned", func(t *testing.T) {
+		before := requests.Load()
+		proto, err := loader.GetProtoVersion(ctx, 1, "v1")
+		if err != nil || proto.Version != "v1" {
+			t.Fatalf("unexpected pinned proto %+v: %v", proto, err)
+		}
+		if requests.Load() != before {
+			t.Error("expected a version seen before to be served from the cache")
+		}
+
+		for _, name := range []string{"proto_1.json", "proto_1@v1.json", "proto_1@v2.json"} {
+			if _, err := os.Stat(filepath.Join(cacheDir, name)); err != nil {
+				t.Errorf("expected cache file %s: %v", name, err)
+			}
+		}
+
+		if _, err := loader.GetProtoVersion(ctx, 1, "v9"); !errors.Is(err, protoloader.ErrNotFound) {
+			t.Errorf("expected ErrNotFound for a missing version, got %v", err)
+		}
+
+		// A fresh loader finds pinned versions on disk
+		restarted, _ := protoloader.New(server.URL, cacheDir, compiledDir)
+		restarted.SetTrustAnchors(gateway.RegistryKey())
+		before = requests.Load()
+		if proto, err := restarted.GetProtoVersion(ctx, 1, "v2"); err != nil || proto.Version != "v2" {
+			t.Errorf("unexpected pinned proto from disk %+v: %v", proto, err)
+		}
+		if requests.Load() != before {
+			t.Error("expected pinned version to be read from disk")
+		}
+	})
+
+	t.Run("InvalidateAndRefresh", func(t *testing.T) {
+		loader.SetMaxAge(protoloader.DefaultMaxAge)
+		loader.Invalidate(1)
+		if _, err := os.Stat(filepath.Join(cacheDir, "proto_1.json")); !os.IsNotExist(err) {
+			t.Error("expected invalidated proto to be removed from disk")
+		}
+		if _, err := os.Stat(filepath.Join(cacheDir, "proto_1@v1.json")); err != nil {
+			t.Error("pinned versions must survive Invalidate")
+		}
+
+		before := requests.Load()
+		if _, err := loader.GetProto(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loader.Refresh(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+		if requests.Load() != before+2 {
+			t.Errorf("expected a fetch after Invalidate and one for Refresh, got %d", requests.Load()-before)
+		}
+	})
+
+	t.Run("Offline", func(t *testing.T) {
+		loader.SetMaxAge(0)
+		server.Close()
+		proto, err := loader.GetProto(ctx, 1)
+		if err != nil || proto.Version != "v2" {
+			t.Errorf("expected the cached proto while offline, got %+v: %v", proto, err)
+		}
+	})
+}
+
+func TestConcurrentFetch(t *testing.T) {
+	gateway, err := gatewaytest.New(gatewaytest.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := int64(1); id <= 20; id++ {
+		gateway.AddProto(protoloader.Proto{ID: id, Namespace: "chat", Name: fmt.Sprintf("p%d.proto", id), Version: "v1",
+			Content: "syntax = \"proto3\";\n"})
+	}
+
+	var requests, active, maxActive atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		n := active.Add(1)
+		defer active.Add(-1)
+		for m := maxActive.Load(); n > m && !maxActive.CompareAndSwap(m, n); m = maxActive.Load() {
+		}
+		<-release
+		gateway.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	cacheDir := t.TempDir()
+	loader, err := protoloader.New(server.URL, cacheDir, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	loader.SetTrustAnchors(gateway.RegistryKey())
+	ctx := context.Background()
+
+	t.Run("SingleFlight", func(t *testing.T) {
+		var wg sync.WaitGroup
+		errs := make(chan error, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := loader.GetProto(ctx, 1); err != nil {
+					errs <- err
+				}
+			}()
+		}
+		// Let every caller join before the registry answers
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+		if requests.Load() != 1 {
+			t.Errorf("expected concurrent callers to share one request, got %d", requests.Load())
+		}
+	})
+
+	t.Run("CanceledLeader", func(t *testing.T) {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, err := loader.GetProtoVersion(canceled, 2, "v1"); !errors.Is(err, context.Canceled) {
+			t.Errorf("expected a canceled context to fail, got %v", err)
+		}
+		if _, err := loader.GetProtoVersion(ctx, 2, "v1"); err != nil {
+			t.Errorf("expected a later caller to fetch again: %v", err)
+		}
+	})
+
+	t.Run("AtomicWrites", func(t *testing.T) {
+		entries, _ := os.ReadDir(cacheDir)
+		for _, entry := range entries {
+			if strings.Contains(entry.Name(), ".tmp") {
+				t.Errorf("temporary file %s left behind", entry.Name())
+			}
+		}
+	})
+
+	t.Run("Corrupt", func(t *testing.T) {
+		path := filepath.Join(cacheDir, "proto_1.json")
+		data, _ := os.ReadFile(path)
+		os.WriteFile(path, data[:len(data)/2], 0644)
+		os.WriteFile(filepath.Join(cacheDir, "proto_3@v1.json"), data, 0644)
+		bare, _ := json.Marshal(protoloader.Proto{ID: 2, Namespace: "chat", Name: "chat.proto", Version: "v1"})
+		os.WriteFile(filepath.Join(cacheDir, "proto_2.json"), bare, 0644)
+
+		restarted, _ := protoloader.New(server.URL, cacheDir, t.TempDir())
+		restarted.SetTrustAnchors(gateway.RegistryKey())
+		before := requests.Load()
+		if proto, err := restarted.GetProto(ctx, 1); err != nil || proto.ID != 1 {
+			t.Fatalf("expected a truncated file to be fetched again, got %+v: %v", proto, err)
+		}
+		if proto, err := restarted.GetProtoVersion(ctx, 3, "v1"); err != nil || proto.ID != 3 {
+			t.Fatalf("expected a file holding another proto to be fetched again, got %+v: %v", proto, err)
+		}
+		if proto, err := restarted.GetProto(ctx, 2); err != nil || proto.ID != 2 {
+			t.Fatalf("expected a file without a cache entry to be fetched again, got %+v: %v", proto, err)
+		}
+		if requests.Load() != before+3 {
+			t.Errorf("expected 3 requests, got %d", requests.Load()-before)
+		}
+		for _, name := range []string{"proto_1.json.corrupt", "proto_3@v1.json.corrupt", "proto_2.json.corrupt"} {
+			if _, err := os.Stat(filepath.Join(cacheDir, name)); err != nil {
+				t.Errorf("expected quarantined file %s: %v", name, err)
+			}
+		}
+		if stats := restarted.Stats(); stats.Quarantined != 3 {
+			t.Errorf("expected 3 quarantined files, got %d", stats.Quarantined)
+		}
+	})
+
+	t.Run("GetProtos", func(t *testing.T) {
+		loader.SetFetchConcurrency(3)
+		maxActive.Store(0)
+		ids := []int64{5, 4, 404, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 1}
+		protos, err := loader.GetProtos(ctx, ids)
+		if err == nil || !strings.Contains(err.Error(), "proto 404") || !errors.Is(err, protoloader.ErrNotFound) {
+			t.Errorf("expected an error for the missing proto, got %v", err)
+		}
+		for i, id := range ids {
+			switch {
+			case id == 404 && protos[i] != nil:
+				t.Error("expected no proto for a missing ID")
+			case id != 404 && (protos[i] == nil || protos[i].ID != id):
+				t.Errorf("expected proto %d at %d, got %+v", id, i, protos[i])
+			}
+		}
+		if maxActive.Load() > 3 {
+			t.Errorf("expected at most 3 concurrent fetches, got %d", maxActive.Load())
+		}
+	})
+}
@@ -0,0 +1,308 @@
+package protoloader
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Severity tells who a change breaks
+type Severity string
+
+const (
+	// WireBreaking changes break peers exchanging messages across versions
+	WireBreaking Severity = "wire"
+	// SourceBreaking changes only break code generated from the old version,
+	// or the JSON encoding
+	SourceBreaking Severity = "source"
+)
+
+// Change is one incompatibility between two versions of a proto
+type Change struct {
+	Severity Severity `json:"severity"`
+	Element  string   `json:"element"` // Name relative to the package
+	Message  string   `json:"message"`
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %s: %s", c.Severity, c.Element, c.Message)
+}
+
+// CompatReport is the result of comparing two versions of a proto
+type CompatReport struct {
+	ID             int64    `json:"id"`
+	Name           string   `json:"name"`
+	OldVersion     string   `json:"old_version"`
+	NewVersion     string   `json:"new_version"`
+	WireBreaking   bool     `json:"wire_breaking"`
+	SourceBreaking bool     `json:"source_breaking"`
+	Changes        []Change `json:"changes"`
+}
+
+// CheckCompatibility compares two versions of a proto. An empty newVersion
+// stands for the latest one.
+func (l *ProtoLoader) CheckCompatibility(ctx context.Context, id int64, oldVersion, newVersion string) (*CompatReport, error) {
+	oldProto, err := l.GetProtoVersion(ctx, id, oldVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get version %s: %w", oldVersion, err)
+	}
+	newProto, err := l.GetProtoVersion(ctx, id, newVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get version %s: %w", newVersion, err)
+	}
+	if oldProto.IsAvro() || newProto.IsAvro() {
+		return nil, fmt.Errorf("proto %d (%s) is an Avro schema", id, newProto.Name)
+	}
+
+	oldFile, err := l.parseProto(ctx, oldProto)
+	if err != nil {
+		return nil, err
+	}
+	newFile, err := l.parseProto(ctx, newProto)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CompatReport{
+		ID:         id,
+		Name:       newProto.Name,
+		OldVersion: oldProto.Version,
+		NewVersion: newProto.Version,
+		Changes:    CompareDescriptors(oldFile, newFile),
+	}
+	report.classify()
+	return report, nil
+}
+
+// classify sets WireBreaking and SourceBreaking from the changes
+func (r *CompatReport) classify() {
+	for _, c := range r.Changes {
+		switch c.Severity {
+		case WireBreaking:
+			r.WireBreaking = true
+		case SourceBreaking:
+			r.SourceBreaking = true
+		}
+	}
+}
+
+// CompareDescriptors lists the changes from old to new that break peers or
+// code still using old. Wire-breaking changes come first.
+func CompareDescriptors(old, new protoreflect.FileDescriptor) []Change {
+	c := &comparer{changes: []Change{}}
+	if old.Package() != new.Package() {
+		c.add(WireBreaking, string(new.Package()), "package renamed from %q", old.Package())
+	}
+	c.messages(old.Messages(), new.Messages())
+	c.enums(old.Enums(), new.Enums())
+	c.services(old.Services(), new.Services())
+
+	sort.SliceStable(c.changes, func(i, j int) bool {
+		if c.changes[i].Severity != c.changes[j].Severity {
+			return c.changes[i].Severity == WireBreaking
+		}
+		return c.changes[i].Element < c.changes[j].Element
+	})
+	return c.changes
+}
+
+type comparer struct {
+	changes []Change
+}
+
+func (c *comparer) add(severity Severity, element, format string, args ...interface{}) {
+	c.changes = append(c.changes, Change{Severity: severity, Element: element, Message: fmt.Sprintf(format, args...)})
+}
+
+// rel returns a name relative to its file's package, so declarations can be
+// matched across a package rename
+func rel(d protoreflect.Descriptor) string {
+	name := string(d.FullName())
+	if pkg := string(d.ParentFile().Package()); pkg != "" {
+		name = strings.TrimPrefix(name, pkg+".")
+	}
+	return name
+}
+
+func (c *comparer) messages(old, new protoreflect.MessageDescriptors) {
+	byName := make(map[protoreflect.Name]protoreflect.MessageDescriptor, new.Len())
+	for i := 0; i < new.Len(); i++ {
+		byName[new.Get(i).Name()] = new.Get(i)
+	}
+	for i := 0; i < old.Len(); i++ {
+		o := old.Get(i)
+		if o.IsMapEntry() {
+			continue
+		}
+		n, ok := byName[o.Name()]
+		if !ok {
+			c.add(SourceBreaking, rel(o), "message removed")
+			continue
+		}
+		c.fields(o, n)
+		c.messages(o.Messages(), n.Messages())
+		c.enums(o.Enums(), n.Enums())
+	}
+}
+
+func (c *comparer) fields(old, new protoreflect.MessageDescriptor) {
+	oldFields, newFields := old.Fields(), new.Fields()
+	for i := 0; i < oldFields.Len(); i++ {
+		o := oldFields.Get(i)
+		element := rel(old) + "." + string(o.Name())
+		n := newFields.ByNumber(o.Number())
+
+		if moved := newFields.ByName(o.Name()); moved != nil && moved.Number() != o.Number() {
+			c.add(WireBreaking, element, "field renumbered from %d to %d", o.Number(), moved.Number())
+			continue
+		}
+		if n == nil {
+			if o.Cardinality() == protoreflect.Required {
+				c.add(WireBreaking, element, "required field %d removed", o.Number())
+			} else if !new.ReservedRanges().Has(o.Number()) {
+				c.add(SourceBreaking, element, "field %d removed without reserving its number", o.Number())
+			} else {
+				c.add(SourceBreaking, element, "field %d removed", o.Number())
+			}
+			continue
+		}
+
+		if n.Name() != o.Name() {
+			if oldFields.ByName(n.Name()) == nil && fieldType(o) == fieldType(n) {
+				c.add(SourceBreaking, element, "field %d renamed to %s", o.Number(), n.Name())
+			} else {
+				c.add(WireBreaking, element, "field number %d reused by %s", o.Number(), n.Name())
+				continue
+			}
+		}
+		c.fieldType(element, o, n)
+	}
+
+	for i := 0; i < newFields.Len(); i++ {
+		n := newFields.Get(i)
+		if n.Cardinality() == protoreflect.Required && oldFields.ByNumber(n.Number()) == nil {
+			c.add(WireBreaking, rel(new)+"."+string(n.Name()), "required field %d added", n.Number())
+		}
+	}
+}
+
+func (c *comparer) fieldType(element string, o, n protoreflect.FieldDescriptor) {
+	if o.Cardinality() != n.Cardinality() {
+		severity := WireBreaking
+		// Optional and repeated scalars parse each other's encoding, but a
+		// packed repeated field is one length-delimited record an optional
+		// field cannot read
+		if o.Cardinality() != protoreflect.Required && n.Cardinality() != protoreflect.Required &&
+			o.Kind() != protoreflect.MessageKind && o.Kind() != protoreflect.StringKind && o.Kind() != protoreflect.BytesKind &&
+			o.Kind() == n.Kind() && !o.IsPacked() && !n.IsPacked() {
+			severity = SourceBreaking
+		}
+		c.add(severity, element, "cardinality changed from %s to %s", o.Cardinality(), n.Cardinality())
+	}
+	if o.IsMap() != n.IsMap() {
+		c.add(WireBreaking, element, "changed between map and repeated field")
+		return
+	}
+
+	oldType, newType := fieldType(o), fieldType(n)
+	if oldType == newType {
+		if o.Name() == n.Name() && o.JSONName() != n.JSONName() {
+			c.add(SourceBreaking, element, "JSON name changed from %s to %s", o.JSONName(), n.JSONName())
+		}
+		return
+	}
+	if wireGroup(o.Kind()) != "" && wireGroup(o.Kind()) == wireGroup(n.Kind()) {
+		c.add(SourceBreaking, element, "type changed from %s to %s, compatible on the wire", oldType, newType)
+		return
+	}
+	c.add(WireBreaking, element, "type changed from %s to %s", oldType, newType)
+}
+
+// fieldType describes a field's type, naming message and enum types
+// relative to their package
+func fieldType(fd protoreflect.FieldDescriptor) string {
+	if fd.IsMap() {
+		return fmt.Sprintf("map<%s, %s>", fieldType(fd.MapKey()), fieldType(fd.MapValue()))
+	}
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return rel(fd.Message())
+	case protoreflect.EnumKind:
+		return rel(fd.Enum())
+	}
+	return fd.Kind().String()
+}
+
+// wireGroup returns the group of kinds whose encodings parse as each other
+func wireGroup(kind protoreflect.Kind) string {
+	switch kind {
+	case protoreflect.Int32Kind, protoreflect.Uint32Kind, protoreflect.Int64Kind, protoreflect.Uint64Kind,
+		protoreflect.BoolKind, protoreflect.EnumKind:
+		return "varint"
+	case protoreflect.Sint32Kind, protoreflect.Sint64Kind:
+		return "zigzag"
+	case protoreflect.Fixed32Kind, protoreflect.Sfixed32Kind:
+		return "fixed32"
+	case protoreflect.Fixed64Kind, protoreflect.Sfixed64Kind:
+		return "fixed64"
+	case protoreflect.StringKind, protoreflect.BytesKind:
+		return "bytes"
+	}
+	return ""
+}
+
+func (c *comparer) enums(old, new protoreflect.EnumDescriptors) {
+	for i := 0; i < old.Len(); i++ {
+		o := old.Get(i)
+		n := new.ByName(o.Name())
+		if n == nil {
+			c.add(SourceBreaking, rel(o), "enum removed")
+			continue
+		}
+		oldValues, newValues := o.Values(), n.Values()
+		for j := 0; j < oldValues.Len(); j++ {
+			ov := oldValues.Get(j)
+			element := rel(o) + "." + string(ov.Name())
+			switch nv := newValues.ByName(ov.Name()); {
+			case nv != nil && nv.Number() != ov.Number():
+				c.add(WireBreaking, element, "value renumbered from %d to %d", ov.Number(), nv.Number())
+			case nv == nil && newValues.ByNumber(ov.Number()) != nil:
+				c.add(SourceBreaking, element, "value %d renamed to %s", ov.Number(), newValues.ByNumber(ov.Number()).Name())
+			case nv == nil:
+				c.add(SourceBreaking, element, "value %d removed", ov.Number())
+			}
+		}
+	}
+}
+
+func (c *comparer) services(old, new protoreflect.ServiceDescriptors) {
+	for i := 0; i < old.Len(); i++ {
+		o := old.Get(i)
+		n := new.ByName(o.Name())
+		if n == nil {
+			c.add(WireBreaking, rel(o), "service removed")
+			continue
+		}
+		for j := 0; j < o.Methods().Len(); j++ {
+			om := o.Methods().Get(j)
+			element := rel(o) + "." + string(om.Name())
+			nm := n.Methods().ByName(om.Name())
+			if nm == nil {
+				c.add(WireBreaking, element, "method removed")
+				continue
+			}
+			if rel(om.Input()) != rel(nm.Input()) {
+				c.add(WireBreaking, element, "request type changed from %s to %s", rel(om.Input()), rel(nm.Input()))
+			}
+			if rel(om.Output()) != rel(nm.Output()) {
+				c.add(WireBreaking, element, "response type changed from %s to %s", rel(om.Output()), rel(nm.Output()))
+			}
+			if om.IsStreamingClient() != nm.IsStreamingClient() || om.IsStreamingServer() != nm.IsStreamingServer() {
+				c.add(WireBreaking, element, "streaming changed")
+			}
+		}
+	}
+}
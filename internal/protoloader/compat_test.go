@@ -0,0 +1,134 @@
+package protoloader_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/qnepff/qne-node-v12/internal/gatewaytest"
+	"github.com/qnepff/qne-node-v12/internal/protoloader"
+)
+
+func TestCheckCompatibility(t *testing.T) {
+	gateway, url := gatewaytest.NewServer(t, gatewaytest.Config{})
+	loader, err := protoloader.New(url, t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	loader.SetTrustAnchors(gateway.RegistryKey())
+	ctx := context.Background()
+
+	const base = `syntax = "proto3";
+package qne.chat;
+message Message {
+  string text = 1;
+  int32 count = 2;
+  repeated int32 ids = 3;
+}
+enum Kind {
+  KIND_UNSPECIFIED = 0;
+  KIND_TEXT = 1;
+}
+service Chat {
+  rpc Send(Message) returns (Message);
+  rpc Watch(Message) returns (stream Message);
+}
+`
+	tests := []struct {
+		name    string
+		old     string
+		new     string
+		changes []string
+	}{
+		{"Unchanged", base, base, nil},
+		{"AddField", base, strings.Replace(base, "repeated int32 ids = 3;", "repeated int32 ids = 3;\n  bool edited = 4;", 1), nil},
+		{"Renumber", base, strings.Replace(base, "count = 2", "count = 5", 1),
+			[]string{"wire: Message.count: field renumbered from 2 to 5"}},
+		{"Reuse", base, strings.Replace(base, "int32 count = 2", "string author = 2", 1),
+			[]string{"wire: Message.count: field number 2 reused by author"}},
+		{"Rename", base, strings.Replace(base, "int32 count = 2", "int32 total = 2", 1),
+			[]string{"source: Message.count: field 2 renamed to total"}},
+		{"TypeChange", base, strings.Replace(base, "string text = 1", "int64 text = 1", 1),
+			[]string{"wire: Message.text: type changed from string to int64"}},
+		{"CompatibleType", base, strings.Replace(base, "int32 count = 2", "int64 count = 2", 1),
+			[]string{"source: Message.count: type changed from int32 to int64, compatible on the wire"}},
+		{"Repeated", base, strings.Replace(base, "int32 count = 2", "repeated int32 count = 2", 1),
+			[]string{"wire: Message.count: cardinality changed from optional to repeated"}},
+		{"RepeatedUnpacked", base, strings.Replace(base, "int32 count = 2", "repeated int32 count = 2 [packed = false]", 1),
+			[]string{"source: Message.count: cardinality changed from optional to repeated"}},
+		{"Singular", base, strings.Replace(base, "repeated int32 ids = 3", "int32 ids = 3", 1),
+			[]string{"wire: Message.ids: cardinality changed from repeated to optional"}},
+		{"RemoveField", base, strings.Replace(base, "repeated int32 ids = 3;", "reserved 3;", 1),
+			[]string{"source: Message.ids: field 3 removed"}},
+		{"RemoveUnreserved", base, strings.Replace(base, "repeated int32 ids = 3;", "", 1),
+			[]string{"source: Message.ids: field 3 removed without reserving its number"}},
+		{"Package", base, strings.Replace(base, "package qne.chat;", "package qne.talk;", 1),
+			[]string{"wire: qne.talk: package renamed from \"qne.chat\""}},
+		{"Enum", base, strings.Replace(base, "KIND_TEXT = 1", "KIND_PLAIN = 1", 1),
+			[]string{"source: Kind.KIND_TEXT: value 1 renamed to KIND_PLAIN"}},
+		{"Service", base, strings.Replace(base, "  rpc Watch(Message) returns (stream Message);\n", "", 1),
+			[]string{"wire: Chat.Watch: method removed"}},
+		{"Streaming", base, strings.Replace(base, "returns (stream Message)", "returns (Message)", 1),
+			[]string{"wire: Chat.Watch: streaming changed"}},
+		{"RequiredRemoved",
+			"syntax = \"proto2\";\nmessage Login {\n  required string user = 1;\n  optional string note = 2;\n}\n",
+			"syntax = \"proto2\";\nmessage Login {\n  optional string note = 2;\n}\n",
+			[]string{"wire: Login.user: required field 1 removed"}},
+		{"Ordering", base, strings.Replace(strings.Replace(base, "count = 2", "count = 5", 1), "KIND_TEXT", "KIND_PLAIN", 1),
+			[]string{
+				"wire: Message.count: field renumbered from 2 to 5",
+				"source: Kind.KIND_TEXT: value 1 renamed to KIND_PLAIN",
+			}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := int64(i + 1)
+			gateway.AddProto(protoloader.Proto{ID: id, Namespace: "chat", Name: "chat.proto", Version: "v1", Content: tt.old})
+			gateway.AddProto(protoloader.Proto{ID: id, Namespace: "chat", Name: "chat.proto", Version: "v2", Content: tt.new})
+
+			report, err := loader.CheckCompatibility(ctx, id, "v1", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.OldVersion != "v1" || report.NewVersion != "v2" {
+				t.Errorf("compared %s to %s", report.OldVersion, report.NewVersion)
+			}
+			var got []string
+			wire, source := false, false
+			for _, c := range report.Changes {
+				got = append(got, c.String())
+				wire = wire || c.Severity == protoloader.WireBreaking
+				source = source || c.Severity == protoloader.SourceBreaking
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.changes, "\n") {
+				t.Errorf("unexpected changes\n got %q\nwant %q", got, tt.changes)
+			}
+			if report.WireBreaking != wire || report.SourceBreaking != source {
+				t.Errorf("unexpected summary wire=%v source=%v", report.WireBreaking, report.SourceBreaking)
+			}
+		})
+	}
+
+	t.Run("JSON", func(t *testing.T) {
+		report, err := loader.CheckCompatibility(ctx, 1, "v1", "v2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `{"id":1,"name":"chat.proto","old_version":"v1","new_version":"v2",` +
+			`"wire_breaking":false,"source_breaking":false,"changes":[]}`
+		if string(data) != want {
+			t.Errorf("unexpected JSON\n got %s\nwant %s", data, want)
+		}
+	})
+
+	t.Run("UnknownVersion", func(t *testing.T) {
+		if _, err := loader.CheckCompatibility(ctx, 1, "v9", ""); err == nil {
+			t.Error("expected an unknown version to fail")
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package protoloader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// manifestName is the file written into a compiled output directory once
+// compilation has completed
+const manifestName = ".qne-manifest.json"
+
+// compileManifest records what a compiled output directory was generated
+// from. Its presence marks the output as complete.
+type compileManifest struct {
+	ProtoID     int64             `json:"proto_id"`
+	Version     string            `json:"version"`
+	Target      string            `json:"target"`
+	InputHash   string            `json:"input_hash"` // Over every file of the import closure
+	Options     []string          `json:"options"`
+	Generators  map[string]string `json:"generators"`
+	CompletedAt time.Time         `json:"completed_at"`
+}
+
+// matches reports whether output described by m can stand in for want
+func (m *compileManifest) matches(want *compileManifest) bool {
+	return m.ProtoID == want.ProtoID &&
+		m.Version == want.Version &&
+		m.Target == want.Target &&
+		m.InputHash == want.InputHash &&
+		reflect.DeepEqual(m.Options, want.Options) &&
+		reflect.DeepEqual(m.Generators, want.Generators)
+}
+
+// inputHash hashes the files of an import closure along with their paths
+func inputHash(files map[string]*Proto) string {
+	paths := make([]string, 0, len(files))
+	for filePath := range files {
+		paths = append(paths, filePath)
+	}
+	sort.Strings(paths)
+	h := sha256.New()
+	for _, filePath := range paths {
+		fmt.Fprintf(h, "%s\x00%s\x00", filePath, ContentHash(files[filePath].Content))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// generatorVersions returns the versions of the given code generators.
+// Each one is looked up once per loader.
+func (l *ProtoLoader) generatorVersions(ctx context.Context, names []string) map[string]string {
+	l.genMutex.Lock()
+	defer l.genMutex.Unlock()
+	versions := make(map[string]string, len(names))
+	for _, name := range names {
+		version, ok := l.genVersions[name]
+		if !ok {
+			version = "unknown"
+			if out, err := exec.CommandContext(ctx, name, "--version").Output(); err == nil {
+				version = strings.TrimSpace(string(out))
+			}
+			l.genVersions[name] = version
+		}
+		versions[name] = version
+	}
+	return versions
+}
+
+// compileTarget runs protoc for one target. The output is generated next to
+// its final location and moved into place once complete, so a failed run
+// never leaves partial output behind.
+func (l *ProtoLoader) compileTarget(ctx context.Context, want *compileManifest, args []string) error {
+	target, err := l.target(want.Target)
+	if err != nil {
+		return err
+	}
+	stagingDir, err := os.MkdirTemp(l.compiledDir, fmt.Sprintf(".proto_%d-%s-*", want.ProtoID, target.Name))
+	if err != nil {
+		return fmt.Errorf("failed to create output directory: %v", err)
+	}
+	defer os.RemoveAll(stagingDir)
+
+	limits := l.compileLimits()
+	runCtx := ctx
+	if limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, limits.Timeout)
+		defer cancel()
+	}
+	cmd := limitedCommand(runCtx, limits.MaxMemory, "protoc", append(target.Args(stagingDir), args...)...)
+	cmd.WaitDelay = time.Second
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if runCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+			return fmt.Errorf("failed to compile proto for %s: protoc ran longer than %v", target.Name, limits.Timeout)
+		}
+		return fmt.Errorf("failed to compile proto for %s: %v\nOutput: %s", target.Name, err, output)
+	}
+
+	want.CompletedAt = time.Now()
+	if err := writeManifest(stagingDir, want); err != nil {
+		return fmt.Errorf("failed to write compile manifest: %v", err)
+	}
+	protoDir := l.compiledDirFor(want.ProtoID)
+	if err := os.MkdirAll(protoDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %v", err)
+	}
+	return replaceDir(stagingDir, filepath.Join(protoDir, target.Name))
+}
+
+// compiledDirFor returns the output directory of a proto
+func (l *ProtoLoader) compiledDirFor(id int64) string {
+	return filepath.Join(l.compiledDir, fmt.Sprintf("proto_%d", id))
+}
+
+// readManifest reads the manifest of a compiled output directory
+func readManifest(dir string) (*compileManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		return nil, err
+	}
+	var m compileManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	return &m, nil
+}
+
+// writeManifest completes a compiled output directory
+func writeManifest(dir string, m *compileManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, manifestName), data, 0644)
+}
+
+// replaceDir moves a completed staging directory into place. An existing
+// directory is moved aside first, since a rename cannot replace it.
+func replaceDir(staging, target string) error {
+	old := ""
+	if _, err := os.Stat(target); err == nil {
+		old = staging + ".old"
+		if err := os.Rename(target, old); err != nil {
+			return fmt.Errorf("failed to move old output aside: %v", err)
+		}
+	}
+	if err := os.Rename(staging, target); err != nil {
+		if old != "" {
+			os.Rename(old, target)
+		}
+		return fmt.Errorf("failed to move output into place: %v", err)
+	}
+	if old != "" {
+		os.RemoveAll(old)
+	}
+	return nil
+}
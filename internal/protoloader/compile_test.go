@@ -0,0 +1,207 @@
+package protoloader
+
+import (
+	"context"
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeGenerators puts scripts standing in for protoc and its plugins first on
+// PATH. The fake protoc counts its runs in the returned file and writes one
+// file per output flag, or fails when the FAKE_PROTOC_FAIL file exists.
+func fakeGenerators(t *testing.T, goVersion string) (runs string) {
+	t.Helper()
+	dir := t.TempDir()
+	runs = filepath.Join(dir, "runs")
+	scripts := map[string]string{
+		"protoc": `#!/bin/sh
+[ "$1" = "--version" ] && { echo "libprotoc 25.1"; exit 0; }
+[ -e "` + filepath.Join(dir, "FAKE_PROTOC_FAIL") + `" ] && { echo "boom" >&2; exit 1; }
+echo run >> "` + runs + `"
+for arg in "$@"; do
+  case "$arg" in
+    --descriptor_set_out=*) echo descriptors > "${arg#*=}";;
+    --*_out=*) flag="${arg%%=*}"; echo generated > "${arg#*=}/example.${flag#--}";;
+  esac
+done
+`,
+		"protoc-gen-go":      "#!/bin/sh\necho protoc-gen-go " + goVersion + "\n",
+		"protoc-gen-go-grpc": "#!/bin/sh\necho protoc-gen-go-grpc 1.3.0\n",
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return runs
+}
+
+func countRuns(t *testing.T, runs string) int {
+	t.Helper()
+	data, err := os.ReadFile(runs)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Count(string(data), "run")
+}
+
+func TestCompileManifest(t *testing.T) {
+	v1 := Proto{ID: 1, Namespace: "test", Name: "example.proto", Version: "v1",
+		Content: "syntax = \"proto3\";\nmessage Example {}\n"}
+	v2 := v1
+	v2.Version = "v2"
+	v2.Content = "syntax = \"proto3\";\nmessage Example { string name = 1; }\n"
+	registryV1 := newTestRegistry(t, v1)
+	registryV2 := newTestRegistry(t, v2)
+	compiledDir := t.TempDir()
+	ctx := context.Background()
+
+	newLoader := func(url string) *ProtoLoader {
+		loader, err := New(url, t.TempDir(), compiledDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loader.SetTrustAnchors(testRegistryKey.Public().(ed25519.PublicKey))
+		return loader
+	}
+
+	runs := fakeGenerators(t, "v1.33.0")
+	loader := newLoader(registryV1.URL)
+
+	t.Run("Compile", func(t *testing.T) {
+		if _, err := loader.GetCompiledProtoPath(1, TargetGo); err == nil {
+			t.Error("expected no output before compiling")
+		}
+		if err := loader.CompileProto(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+		dir, err := loader.GetCompiledProtoPath(1, TargetGo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "example.go_out")); err != nil {
+			t.Error("expected generated code in the output directory")
+		}
+		manifest, err := readManifest(dir)
+		if err != nil || manifest.Version != "v1" || manifest.Generators["protoc-gen-go"] != "protoc-gen-go v1.33.0" {
+			t.Errorf("unexpected manifest %+v: %v", manifest, err)
+		}
+	})
+
+	t.Run("Current", func(t *testing.T) {
+		if err := loader.CompileProto(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+		if n := countRuns(t, runs); n != 1 {
+			t.Errorf("expected current output to be kept, protoc ran %d times", n)
+		}
+	})
+
+	t.Run("NewVersion", func(t *testing.T) {
+		if err := newLoader(registryV2.URL).CompileProto(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+		if n := countRuns(t, runs); n != 2 {
+			t.Errorf("expected a new version to be compiled, protoc ran %d times", n)
+		}
+		// The first loader still caches v1
+		if _, err := loader.GetCompiledProtoPath(1, TargetGo); err == nil || !strings.Contains(err.Error(), "stale") {
+			t.Errorf("expected stale output to be reported, got %v", err)
+		}
+	})
+
+	t.Run("NewGenerator", func(t *testing.T) {
+		runs := fakeGenerators(t, "v1.34.0")
+		if err := newLoader(registryV2.URL).CompileProto(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+		if n := countRuns(t, runs); n != 1 {
+			t.Errorf("expected a generator update to recompile, protoc ran %d times", n)
+		}
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		runs := fakeGenerators(t, "v1.35.0")
+		os.WriteFile(filepath.Join(filepath.Dir(runs), "FAKE_PROTOC_FAIL"), nil, 0644)
+		loader := newLoader(registryV2.URL)
+		if err := loader.CompileProto(ctx, 1); err == nil || !strings.Contains(err.Error(), "boom") {
+			t.Fatalf("expected protoc to fail, got %v", err)
+		}
+		// The previous output stays in place and no staging directory is left
+		dir, err := loader.GetCompiledProtoPath(1, TargetGo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if manifest, _ := readManifest(dir); manifest.Generators["protoc-gen-go"] != "protoc-gen-go v1.34.0" {
+			t.Errorf("expected the previous output, got %+v", manifest)
+		}
+		entries, _ := os.ReadDir(compiledDir)
+		if len(entries) != 1 {
+			t.Errorf("expected only the output directory, found %d entries", len(entries))
+		}
+	})
+
+	t.Run("Targets", func(t *testing.T) {
+		runs := fakeGenerators(t, "v1.34.0")
+		loader := newLoader(registryV2.URL)
+		err := loader.RegisterTarget(Target{
+			Name: "docs",
+			Args: func(dir string) []string { return []string{"--doc_out=" + dir} },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := loader.CompileProto(ctx, 1, TargetGo, TargetTypeScript, TargetDescriptorSet, "docs"); err != nil {
+			t.Fatal(err)
+		}
+		// Go output is current from the previous run
+		if n := countRuns(t, runs); n != 3 {
+			t.Errorf("expected protoc to run once per new target, ran %d times", n)
+		}
+		for target, file := range map[string]string{
+			TargetGo:            "example.go_out",
+			TargetTypeScript:    "example.ts_proto_out",
+			TargetDescriptorSet: DescriptorSetFile,
+			"docs":              "example.doc_out",
+		} {
+			dir, err := loader.GetCompiledProtoPath(1, target)
+			if err != nil {
+				t.Errorf("target %s: %v", target, err)
+				continue
+			}
+			if filepath.Base(dir) != target {
+				t.Errorf("target %s compiled into %s", target, dir)
+			}
+			if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+				t.Errorf("target %s: expected %s", target, file)
+			}
+		}
+
+		if _, err := loader.GetCompiledProtoPath(1, TargetPython); err == nil {
+			t.Error("expected a target that was not compiled to be missing")
+		}
+		if err := loader.CompileProto(ctx, 1, "cobol"); err == nil {
+			t.Error("expected an unknown target to fail")
+		}
+		if _, err := loader.GetCompiledProtoPath(1, "../proto_1"); err == nil {
+			t.Error("expected an unknown target to fail")
+		}
+		if err := loader.RegisterTarget(Target{Name: "../escape", Args: func(string) []string { return nil }}); err == nil {
+			t.Error("expected an invalid target name to fail")
+		}
+	})
+
+	t.Run("Incomplete", func(t *testing.T) {
+		os.Remove(filepath.Join(compiledDir, "proto_1", TargetGo, manifestName))
+		if _, err := loader.GetCompiledProtoPath(1, TargetGo); err == nil {
+			t.Error("expected output without a manifest to be refused")
+		}
+	})
+}
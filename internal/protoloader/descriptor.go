@@ -0,0 +1,143 @@
+package protoloader
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bufbuild/protocompile"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// FileDescriptor parses the content of a proto in-process and returns its
+// descriptor. Unlike CompileProto it needs no protoc, and the result can be
+// used by the running node right away, for example through MessageType.
+func (l *ProtoLoader) FileDescriptor(ctx context.Context, id int64) (protoreflect.FileDescriptor, error) {
+	proto, err := l.GetProto(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get proto: %w", err)
+	}
+	if proto.IsAvro() {
+		return nil, fmt.Errorf("proto %d (%s) is an Avro schema, use AvroSchema", id, proto.Name)
+	}
+
+	// Parse again when the latest version has changed
+	l.cacheMutex.RLock()
+	parsed, ok := l.descCache[id]
+	l.cacheMutex.RUnlock()
+	if ok && parsed.version == proto.Version {
+		return parsed.fd, nil
+	}
+
+	fd, err := l.parseProto(ctx, proto)
+	if err != nil {
+		return nil, err
+	}
+
+	l.cacheMutex.Lock()
+	l.descCache[id] = &parsedProto{version: proto.Version, fd: fd}
+	l.cacheMutex.Unlock()
+	return fd, nil
+}
+
+// parsedProto is a parsed descriptor along with the version it was parsed from
+type parsedProto struct {
+	version string
+	fd      protoreflect.FileDescriptor
+}
+
+// MessageType returns a dynamic type for a message defined in a proto. The
+// name may be fully qualified or relative to the proto's package, and nested
+// messages are written as Outer.Inner.
+func (l *ProtoLoader) MessageType(ctx context.Context, id int64, name string) (protoreflect.MessageType, error) {
+	fd, err := l.FileDescriptor(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	md := findMessage(fd, name)
+	if md == nil {
+		return nil, fmt.Errorf("message %s not found in proto %d (%s)", name, id, fd.Path())
+	}
+	return dynamicpb.NewMessageType(md), nil
+}
+
+// Service returns a service defined in a proto, by full name or by name
+// relative to the proto's package, to serve or call it with package rpc
+func (l *ProtoLoader) Service(ctx context.Context, id int64, name string) (protoreflect.ServiceDescriptor, error) {
+	fd, err := l.FileDescriptor(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	full := protoreflect.FullName(name)
+	if pkg := fd.Package(); pkg != "" && hasPrefix(full, pkg) {
+		full = full[len(pkg)+1:]
+	}
+	sd := fd.Services().ByName(full.Name())
+	if sd == nil || string(full) != string(full.Name()) {
+		return nil, fmt.Errorf("service %s not found in proto %d (%s)", name, id, fd.Path())
+	}
+	return sd, nil
+}
+
+// NewMessage returns an empty dynamic message of the named type, ready for
+// proto.Unmarshal or protojson.Unmarshal
+func (l *ProtoLoader) NewMessage(ctx context.Context, id int64, name string) (*dynamicpb.Message, error) {
+	mt, err := l.MessageType(ctx, id, name)
+	if err != nil {
+		return nil, err
+	}
+	return dynamicpb.NewMessage(mt.Descriptor()), nil
+}
+
+// parseProto compiles a proto and its imports with the pure-Go compiler
+func (l *ProtoLoader) parseProto(ctx context.Context, proto *Proto) (protoreflect.FileDescriptor, error) {
+	files, err := l.importClosure(ctx, proto)
+	if err != nil {
+		return nil, err
+	}
+	sources := make(map[string]string, len(files))
+	for filePath, p := range files {
+		sources[filePath] = p.Content
+	}
+
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{
+			Accessor: protocompile.SourceAccessorFromMap(sources),
+		}),
+	}
+	compiled, err := compiler.Compile(ctx, proto.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse proto %d (%s): %w", proto.ID, proto.Name, err)
+	}
+	return compiled[0], nil
+}
+
+// findMessage looks up a message by full name, or by name relative to the
+// file's package
+func findMessage(fd protoreflect.FileDescriptor, name string) protoreflect.MessageDescriptor {
+	full := protoreflect.FullName(name)
+	if pkg := fd.Package(); pkg != "" && !hasPrefix(full, pkg) {
+		full = protoreflect.FullName(string(pkg) + "." + name)
+	}
+	return findIn(fd.Messages(), full)
+}
+
+func findIn(msgs protoreflect.MessageDescriptors, full protoreflect.FullName) protoreflect.MessageDescriptor {
+	for i := 0; i < msgs.Len(); i++ {
+		md := msgs.Get(i)
+		if md.FullName() == full {
+			return md
+		}
+		if hasPrefix(full, md.FullName()) {
+			if nested := findIn(md.Messages(), full); nested != nil {
+				return nested
+			}
+		}
+	}
+	return nil
+}
+
+// hasPrefix reports whether name lies within the scope of prefix
+func hasPrefix(name, prefix protoreflect.FullName) bool {
+	return len(name) > len(prefix) && name[len(prefix)] == '.' && name[:len(prefix)] == prefix
+}
@@ -0,0 +1,204 @@
+package protoloader
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// testRegistryKey signs the protos of test registries, test loaders trust it
+var testRegistryKey = func() ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// signed returns p signed with testRegistryKey
+func signed(p Proto) Proto {
+	Sign(&p, testRegistryKey)
+	return p
+}
+
+// newTestRegistry serves the given protos, signed with testRegistryKey, under
+// /api/v1/protos/{id} and lists them under /api/v1/protos
+func newTestRegistry(t *testing.T, protos ...Proto) *httptest.Server {
+	t.Helper()
+	protos = append([]Proto(nil), protos...)
+	for i := range protos {
+		protos[i] = signed(protos[i])
+	}
+	sort.Slice(protos, func(i, j int) bool { return protos[i].ID < protos[j].ID })
+	byPath := make(map[string]Proto, len(protos))
+	for _, p := range protos {
+		byPath[fmt.Sprintf("/api/v1/protos/%d", p.ID)] = p
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/protos" {
+			query := r.URL.Query()
+			pageSize, _ := strconv.Atoi(query.Get("page_size"))
+			lastSeen, _ := strconv.ParseInt(query.Get("last_seen_id"), 10, 64)
+			result := struct {
+				Protos  []Proto `json:"protos"`
+				HasMore bool    `json:"has_more"`
+				LastID  int64   `json:"last_id"`
+			}{LastID: lastSeen}
+			for _, p := range protos {
+				if p.ID <= lastSeen || (query.Get("namespace") != "" && p.Namespace != query.Get("namespace")) {
+					continue
+				}
+				if len(result.Protos) == pageSize {
+					result.HasMore = true
+					break
+				}
+				result.Protos = append(result.Protos, p)
+				result.LastID = p.ID
+			}
+			json.NewEncoder(w).Encode(result)
+			return
+		}
+		p, ok := byPath[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(p)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTestLoader(t *testing.T, serverURL string) *ProtoLoader {
+	t.Helper()
+	loader, err := New(serverURL, t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	loader.SetTrustAnchors(testRegistryKey.Public().(ed25519.PublicKey))
+	return loader
+}
+
+func TestFileDescriptor(t *testing.T) {
+	server := newTestRegistry(t,
+		Proto{ID: 1, Namespace: "chat", Name: "chat.proto", Version: "v1", Content: `syntax = "proto3";
+package qne.chat;
+
+message Message {
+  enum Kind {
+    TEXT = 0;
+    IMAGE = 1;
+  }
+  message Author {
+    string name = 1;
+  }
+  string text = 1;
+  Kind kind = 2;
+  Author author = 3;
+  repeated string tags = 4;
+}
+
+service Chat {
+  rpc Send(Message) returns (Message);
+}`},
+		Proto{ID: 2, Namespace: "chat", Name: "broken.proto", Version: "v1", Content: `syntax = "proto3";
+message Broken {
+  string name = 1
+}`},
+	)
+	loader := newTestLoader(t, server.URL)
+	ctx := context.Background()
+
+	t.Run("Parse", func(t *testing.T) {
+		fd, err := loader.FileDescriptor(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fd.Package() != "qne.chat" || fd.Messages().Len() != 1 {
+			t.Errorf("unexpected descriptor: package %s, %d messages", fd.Package(), fd.Messages().Len())
+		}
+		again, _ := loader.FileDescriptor(ctx, 1)
+		if again != fd {
+			t.Error("expected the parsed descriptor to be cached")
+		}
+	})
+
+	t.Run("DynamicMessage", func(t *testing.T) {
+		msg, err := loader.NewMessage(ctx, 1, "Message")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := protojson.Unmarshal([]byte(`{"text": "hi", "kind": "IMAGE", "author": {"name": "quiet-fox"}, "tags": ["a", "b"]}`), msg); err != nil {
+			t.Fatal(err)
+		}
+		wire, err := proto.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := loader.NewMessage(ctx, 1, "qne.chat.Message")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := proto.Unmarshal(wire, decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(msg, decoded) {
+			t.Error("message changed in a wire round trip")
+		}
+		fields := decoded.Descriptor().Fields()
+		if got := decoded.Get(fields.ByName("text")).String(); got != "hi" {
+			t.Errorf("unexpected text %q", got)
+		}
+		if got := decoded.Get(fields.ByName("kind")).Enum(); got != protoreflect.EnumNumber(1) {
+			t.Errorf("unexpected kind %d", got)
+		}
+
+		author, err := loader.MessageType(ctx, 1, "Message.Author")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if author.Descriptor().FullName() != "qne.chat.Message.Author" {
+			t.Errorf("unexpected nested message %s", author.Descriptor().FullName())
+		}
+	})
+
+	t.Run("Service", func(t *testing.T) {
+		for _, name := range []string{"Chat", "qne.chat.Chat"} {
+			sd, err := loader.Service(ctx, 1, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sd.FullName() != "qne.chat.Chat" || sd.Methods().ByName("Send") == nil {
+				t.Errorf("unexpected service %s", sd.FullName())
+			}
+		}
+		for _, name := range []string{"Missing", "other.Chat", "Message"} {
+			if _, err := loader.Service(ctx, 1, name); err == nil {
+				t.Errorf("expected service %s not to be found", name)
+			}
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		if _, err := loader.MessageType(ctx, 1, "Missing"); err == nil {
+			t.Error("expected unknown message to fail")
+		}
+		_, err := loader.FileDescriptor(ctx, 2)
+		if err == nil || !strings.Contains(err.Error(), "broken.proto") {
+			t.Errorf("expected parse error naming the file, got %v", err)
+		}
+	})
+}
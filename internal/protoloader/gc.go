@@ -0,0 +1,290 @@
+package protoloader
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// CacheLimits bounds the memory and disk used by the loader. Zero values mean
+// no limit.
+type CacheLimits struct {
+	MaxEntries   int           // Protos kept in memory
+	MaxBytes     int64         // Proto content kept in memory
+	MaxDiskBytes int64         // Size of the cache dir and of the compiled dir, each
+	MaxDiskAge   time.Duration // Files not used for longer are removed
+}
+
+// DefaultCacheLimits are the limits of a new loader
+var DefaultCacheLimits = CacheLimits{
+	MaxEntries:   1000,
+	MaxBytes:     64 << 20,
+	MaxDiskBytes: 512 << 20,
+	MaxDiskAge:   30 * 24 * time.Hour,
+}
+
+// CacheStats counts cache activity since the loader was created
+type CacheStats struct {
+	Hits          int64 // Served from memory
+	DiskHits      int64 // Loaded from the cache dir
+	Misses        int64 // Not cached at all
+	Evictions     int64 // Dropped from memory
+	DiskEvictions int64 // Removed from disk by CollectGarbage
+	Quarantined   int64 // Corrupt cache files moved aside
+	Entries       int   // Currently in memory
+	Bytes         int64 // Currently in memory
+}
+
+// SetCacheLimits changes the limits, evicting from memory right away. Disk
+// limits are applied by the next CollectGarbage.
+func (l *ProtoLoader) SetCacheLimits(limits CacheLimits) {
+	l.cacheMutex.Lock()
+	defer l.cacheMutex.Unlock()
+	l.limits = limits
+	l.protoCache.maxEntries = limits.MaxEntries
+	l.protoCache.maxBytes = limits.MaxBytes
+	l.stats.Evictions += int64(l.protoCache.evict())
+}
+
+// Stats returns the cache counters
+func (l *ProtoLoader) Stats() CacheStats {
+	l.cacheMutex.RLock()
+	defer l.cacheMutex.RUnlock()
+	stats := l.stats
+	stats.Entries = l.protoCache.order.Len()
+	stats.Bytes = l.protoCache.bytes
+	return stats
+}
+
+// Pin keeps every cached version of the given protos, and their compiled
+// code, from being evicted or garbage collected
+func (l *ProtoLoader) Pin(ids ...int64) {
+	l.cacheMutex.Lock()
+	defer l.cacheMutex.Unlock()
+	for _, id := range ids {
+		l.pinned[id] = true
+	}
+}
+
+// Unpin makes protos subject to eviction again
+func (l *ProtoLoader) Unpin(ids ...int64) {
+	l.cacheMutex.Lock()
+	defer l.cacheMutex.Unlock()
+	for _, id := range ids {
+		delete(l.pinned, id)
+	}
+	l.stats.Evictions += int64(l.protoCache.evict())
+}
+
+func (l *ProtoLoader) isPinned(id int64) bool {
+	l.cacheMutex.RLock()
+	defer l.cacheMutex.RUnlock()
+	return l.pinned[id]
+}
+
+// diskItemPattern matches the cache files and compiled directories of a proto
+var diskItemPattern = regexp.MustCompile(`^proto_(\d+)(?:[@.]|$)`)
+
+// diskItem is a cache file or a compiled directory
+type diskItem struct {
+	id      int64
+	path    string
+	size    int64
+	modTime time.Time // Newest modification within a directory
+}
+
+// DiskUsage is what the loader keeps on disk
+type DiskUsage struct {
+	CacheFiles    int   // Cached proto versions, including quarantined files
+	CacheBytes    int64 // Size of the cache dir
+	CompiledItems int   // Protos with compiled output
+	CompiledBytes int64 // Size of the compiled dir
+}
+
+// DiskUsage measures the cache dir and the compiled dir
+func (l *ProtoLoader) DiskUsage() (DiskUsage, error) {
+	var usage DiskUsage
+	cached, err := diskItems(l.cacheDir)
+	if err != nil {
+		return usage, err
+	}
+	compiled, err := diskItems(l.compiledDir)
+	if err != nil {
+		return usage, err
+	}
+	usage.CacheFiles, usage.CompiledItems = len(cached), len(compiled)
+	for _, item := range cached {
+		usage.CacheBytes += item.size
+	}
+	for _, item := range compiled {
+		usage.CompiledBytes += item.size
+	}
+	return usage, nil
+}
+
+// ClearCache drops every cached proto and all compiled code, in memory and
+// on disk, except for pinned protos. It returns the number of files and
+// directories removed.
+func (l *ProtoLoader) ClearCache() (int, error) {
+	l.cacheMutex.Lock()
+	l.protoCache.clear()
+	l.descCache = make(map[int64]*parsedProto)
+	l.avroCache = make(map[int64]*AvroSchema)
+	l.cacheMutex.Unlock()
+
+	removed := 0
+	for _, dir := range []string{l.cacheDir, l.compiledDir} {
+		items, err := diskItems(dir)
+		if err != nil {
+			return removed, err
+		}
+		for _, item := range items {
+			if l.isPinned(item.id) {
+				continue
+			}
+			if err := os.RemoveAll(item.path); err != nil {
+				return removed, fmt.Errorf("failed to remove %s: %v", item.path, err)
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// diskItems lists the cache files or compiled directories in dir
+func diskItems(dir string) ([]diskItem, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", dir, err)
+	}
+	var items []diskItem
+	for _, entry := range entries {
+		match := diskItemPattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+		id, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		item, err := statDiskItem(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		item.id = id
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// CollectGarbage removes cache files and compiled code that have not been
+// used for longer than MaxDiskAge, then the least recently used ones until
+// each directory fits in MaxDiskBytes. Pinned protos are never removed. It
+// returns the number of files and directories removed.
+func (l *ProtoLoader) CollectGarbage() (int, error) {
+	l.cacheMutex.RLock()
+	limits := l.limits
+	l.cacheMutex.RUnlock()
+
+	removed := 0
+	for _, dir := range []string{l.cacheDir, l.compiledDir} {
+		n, err := l.collectDir(dir, limits)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+
+	l.cacheMutex.Lock()
+	l.stats.DiskEvictions += int64(removed)
+	l.cacheMutex.Unlock()
+	return removed, nil
+}
+
+func (l *ProtoLoader) collectDir(dir string, limits CacheLimits) (int, error) {
+	all, err := diskItems(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var items []diskItem
+	var total int64
+	for _, item := range all {
+		total += item.size
+		if l.isPinned(item.id) {
+			continue
+		}
+		items = append(items, item)
+	}
+
+	// Oldest first
+	sort.Slice(items, func(i, j int) bool { return items[i].modTime.Before(items[j].modTime) })
+	removed := 0
+	for _, item := range items {
+		expired := limits.MaxDiskAge > 0 && time.Since(item.modTime) > limits.MaxDiskAge
+		full := limits.MaxDiskBytes > 0 && total > limits.MaxDiskBytes
+		if !expired && !full {
+			break
+		}
+		if err := os.RemoveAll(item.path); err != nil {
+			return removed, fmt.Errorf("failed to remove %s: %v", item.path, err)
+		}
+		total -= item.size
+		removed++
+	}
+	return removed, nil
+}
+
+// statDiskItem returns the total size and newest modification of a file or
+// directory tree
+func statDiskItem(path string) (diskItem, error) {
+	item := diskItem{path: path}
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			item.size += info.Size()
+		}
+		if info.ModTime().After(item.modTime) {
+			item.modTime = info.ModTime()
+		}
+		return nil
+	})
+	return item, err
+}
+
+// touch marks a file or directory as used, for CollectGarbage
+func touch(path string) {
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+}
+
+// RunGC calls CollectGarbage every interval until ctx is done
+func (l *ProtoLoader) RunGC(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if n, err := l.CollectGarbage(); err != nil {
+				log.Printf("Failed to collect proto cache garbage: %v", err)
+			} else if n > 0 {
+				log.Printf("Removed %d unused proto cache items", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package protoloader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheLimits(t *testing.T) {
+	var protos []Proto
+	for id := int64(1); id <= 5; id++ {
+		protos = append(protos, Proto{ID: id, Namespace: "test", Name: "p.proto", Version: "v1",
+			Content: "syntax = \"proto3\";\n" + strings.Repeat("// padding\n", 10)})
+	}
+	server := newTestRegistry(t, protos...)
+	ctx := context.Background()
+
+	t.Run("LRU", func(t *testing.T) {
+		loader := newTestLoader(t, server.URL)
+		loader.SetCacheLimits(CacheLimits{MaxEntries: 4})
+		loader.Pin(1)
+
+		// Every fetch stores the latest version and a copy under its version
+		for _, id := range []int64{1, 2, 3} {
+			if _, err := loader.GetProto(ctx, id); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stats := loader.Stats()
+		if stats.Entries != 4 || stats.Evictions != 2 {
+			t.Errorf("unexpected stats %+v", stats)
+		}
+		loader.cacheMutex.RLock()
+		_, kept := loader.protoCache.items[cacheKey{id: 1}]
+		_, evicted := loader.protoCache.items[cacheKey{id: 2}]
+		loader.cacheMutex.RUnlock()
+		if !kept || evicted {
+			t.Error("expected the pinned proto to stay and the least recently used one to go")
+		}
+
+		// Evicted protos come back from disk
+		if _, err := loader.GetProto(ctx, 2); err != nil {
+			t.Fatal(err)
+		}
+		if stats := loader.Stats(); stats.DiskHits != 1 || stats.Hits != 0 {
+			t.Errorf("expected a disk hit, got %+v", stats)
+		}
+		if _, err := loader.GetProto(ctx, 2); err != nil {
+			t.Fatal(err)
+		}
+		if stats := loader.Stats(); stats.Hits != 1 {
+			t.Errorf("expected a memory hit, got %+v", stats)
+		}
+	})
+
+	t.Run("Bytes", func(t *testing.T) {
+		loader := newTestLoader(t, server.URL)
+		size := entrySize(&cacheEntry{Proto: &protos[0]})
+		loader.SetCacheLimits(CacheLimits{MaxBytes: 3 * size})
+		for _, p := range protos {
+			if _, err := loader.GetProto(ctx, p.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if stats := loader.Stats(); stats.Bytes > 3*size || stats.Entries != 3 {
+			t.Errorf("memory limit exceeded: %+v", stats)
+		}
+	})
+
+	t.Run("DescriptorEvicted", func(t *testing.T) {
+		loader := newTestLoader(t, server.URL)
+		loader.SetCacheLimits(CacheLimits{MaxEntries: 2})
+		if _, err := loader.FileDescriptor(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loader.GetProto(ctx, 2); err != nil {
+			t.Fatal(err)
+		}
+		loader.cacheMutex.RLock()
+		_, ok := loader.descCache[1]
+		loader.cacheMutex.RUnlock()
+		if ok {
+			t.Error("expected the descriptor to be dropped with its proto")
+		}
+	})
+
+	t.Run("CollectGarbage", func(t *testing.T) {
+		loader := newTestLoader(t, server.URL)
+		for _, p := range protos {
+			if _, err := loader.GetProto(ctx, p.ID); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.MkdirAll(filepath.Join(loader.compiledDir, fmt.Sprintf("proto_%d", p.ID)), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		old := time.Now().Add(-48 * time.Hour)
+		for _, name := range []string{"proto_1.json", "proto_1@v1.json", "proto_2.json", "proto_2@v1.json"} {
+			os.Chtimes(filepath.Join(loader.cacheDir, name), old, old)
+		}
+		for _, name := range []string{"proto_1", "proto_2"} {
+			os.Chtimes(filepath.Join(loader.compiledDir, name), old, old)
+		}
+		os.WriteFile(filepath.Join(loader.cacheDir, "unrelated.txt"), []byte("x"), 0644)
+		os.Chtimes(filepath.Join(loader.cacheDir, "unrelated.txt"), old, old)
+
+		loader.Pin(1)
+		loader.SetCacheLimits(CacheLimits{MaxDiskAge: 24 * time.Hour})
+		removed, err := loader.CollectGarbage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != 3 || loader.Stats().DiskEvictions != 3 {
+			t.Errorf("expected the stale files of proto 2 to be removed, removed %d", removed)
+		}
+		for _, path := range []string{
+			filepath.Join(loader.cacheDir, "proto_1.json"),
+			filepath.Join(loader.compiledDir, "proto_1"),
+			filepath.Join(loader.cacheDir, "unrelated.txt"),
+			filepath.Join(loader.cacheDir, "proto_3.json"),
+		} {
+			if _, err := os.Stat(path); err != nil {
+				t.Errorf("expected %s to be kept: %v", path, err)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(loader.cacheDir, "proto_2.json")); !os.IsNotExist(err) {
+			t.Error("expected proto_2.json to be removed")
+		}
+
+		// Size limit: the oldest unpinned files go first
+		info, _ := os.Stat(filepath.Join(loader.cacheDir, "proto_3.json"))
+		loader.SetCacheLimits(CacheLimits{MaxDiskBytes: 5 * info.Size()})
+		if _, err := loader.CollectGarbage(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(loader.cacheDir, "proto_1.json")); err != nil {
+			t.Error("pinned proto removed for size")
+		}
+		if size := dirSize(t, loader.cacheDir); size > 5*info.Size()+1 {
+			t.Errorf("cache dir still holds %d bytes", size)
+		}
+	})
+
+	t.Run("InUse", func(t *testing.T) {
+		// Protos served from memory count as used on disk too
+		loader := newTestLoader(t, server.URL)
+		if _, err := loader.GetProto(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+		old := time.Now().Add(-48 * time.Hour)
+		path := filepath.Join(loader.cacheDir, "proto_1.json")
+		os.Chtimes(path, old, old)
+		loader.cacheMutex.Lock()
+		entry, _ := loader.protoCache.get(cacheKey{id: 1})
+		entry.touched = old
+		loader.cacheMutex.Unlock()
+
+		if _, err := loader.GetProto(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+		if hits := loader.Stats().Hits; hits != 1 {
+			t.Fatalf("expected a memory hit, got %d", hits)
+		}
+		loader.SetCacheLimits(CacheLimits{MaxDiskAge: 24 * time.Hour})
+		if _, err := loader.CollectGarbage(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected the proto in use to be kept: %v", err)
+		}
+	})
+
+	t.Run("ClearCache", func(t *testing.T) {
+		loader := newTestLoader(t, server.URL)
+		for _, p := range protos[:3] {
+			if _, err := loader.GetProto(ctx, p.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		os.MkdirAll(filepath.Join(loader.compiledDir, "proto_2", TargetGo), 0755)
+		os.WriteFile(filepath.Join(loader.compiledDir, "proto_2", TargetGo, "p.pb.go"), []byte("package p\n"), 0644)
+		os.WriteFile(filepath.Join(loader.cacheDir, "unrelated.txt"), []byte("x"), 0644)
+
+		usage, err := loader.DiskUsage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usage.CacheFiles != 6 || usage.CompiledItems != 1 || usage.CompiledBytes != 10 {
+			t.Errorf("unexpected usage %+v", usage)
+		}
+		if usage.CacheBytes != dirSize(t, loader.cacheDir)-1 {
+			t.Errorf("expected %d cache bytes, got %d", dirSize(t, loader.cacheDir)-1, usage.CacheBytes)
+		}
+
+		loader.Pin(1)
+		removed, err := loader.ClearCache()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != 5 {
+			t.Errorf("expected 5 items removed, got %d", removed)
+		}
+		if usage, _ := loader.DiskUsage(); usage.CacheFiles != 2 || usage.CompiledItems != 0 {
+			t.Errorf("expected only the pinned proto to be left, got %+v", usage)
+		}
+		if stats := loader.Stats(); stats.Entries != 0 {
+			t.Errorf("expected the memory cache to be empty, got %+v", stats)
+		}
+		if _, err := os.Stat(filepath.Join(loader.cacheDir, "unrelated.txt")); err != nil {
+			t.Error("expected unrelated files to be kept")
+		}
+	})
+}
+
+func dirSize(t *testing.T, dir string) int64 {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
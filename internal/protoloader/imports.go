@@ -0,0 +1,231 @@
+package protoloader
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/bufbuild/protocompile/ast"
+	"github.com/bufbuild/protocompile/parser"
+	"github.com/bufbuild/protocompile/reporter"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	// Registers the well-known types bundled with the loader
+	_ "google.golang.org/protobuf/types/known/anypb"
+	_ "google.golang.org/protobuf/types/known/apipb"
+	_ "google.golang.org/protobuf/types/known/durationpb"
+	_ "google.golang.org/protobuf/types/known/emptypb"
+	_ "google.golang.org/protobuf/types/known/fieldmaskpb"
+	_ "google.golang.org/protobuf/types/known/sourcecontextpb"
+	_ "google.golang.org/protobuf/types/known/structpb"
+	_ "google.golang.org/protobuf/types/known/timestamppb"
+	_ "google.golang.org/protobuf/types/known/typepb"
+	_ "google.golang.org/protobuf/types/known/wrapperspb"
+	_ "google.golang.org/protobuf/types/pluginpb"
+)
+
+// wellKnownPrefix is the import path prefix of the bundled well-known types
+const wellKnownPrefix = "google/protobuf/"
+
+// ImportError reports an import that could not be resolved
+type ImportError struct {
+	Importer string // Path of the importing file
+	Import   string // Import path as written in the importer
+	Err      error
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("%s: unresolved import %q: %v", e.Importer, e.Import, e.Err)
+}
+
+func (e *ImportError) Unwrap() error { return e.Err }
+
+// ImportCycleError reports protos that import each other
+type ImportCycleError struct {
+	Cycle []string // Import paths, the first one repeated at the end
+}
+
+func (e *ImportCycleError) Error() string {
+	return "import cycle: " + strings.Join(e.Cycle, " -> ")
+}
+
+// isWellKnown reports whether an import is one of the bundled well-known types
+func isWellKnown(importPath string) bool {
+	if !strings.HasPrefix(importPath, wellKnownPrefix) {
+		return false
+	}
+	_, err := protoregistry.GlobalFiles.FindFileByPath(importPath)
+	return err == nil
+}
+
+// importClosure returns root and every registry proto it imports directly or
+// transitively, keyed by the path they are imported under. The root is keyed
+// by its name. Well-known types are left out, they are bundled.
+//
+// An import path is mapped to a registry proto by treating its directory as
+// the namespace and its base name as the proto name. Imports without a
+// directory refer to the importer's namespace. The compiler knows a file only
+// by its import path, so a path that refers to different protos from
+// different importers is an error, and so is a proto imported under two
+// paths.
+func (l *ProtoLoader) importClosure(ctx context.Context, root *Proto) (map[string]*Proto, error) {
+	limits := l.compileLimits()
+	if err := checkProto(root, limits); err != nil {
+		return nil, err
+	}
+	files := map[string]*Proto{root.Name: root}
+	// Import path of each proto in files, by namespace and name
+	paths := map[string]string{root.Namespace + "/" + root.Name: root.Name}
+	var visit func(filePath string, p *Proto, stack []string) error
+	visit = func(filePath string, p *Proto, stack []string) error {
+		imports, err := parseImports(filePath, p.Content)
+		if err != nil {
+			return err
+		}
+		stack = append(stack, filePath)
+		for _, imp := range imports {
+			if isWellKnown(imp) {
+				continue
+			}
+			namespace, name, err := importTarget(p.Namespace, imp)
+			if err != nil {
+				return &ImportError{Importer: filePath, Import: imp, Err: err}
+			}
+			if seen, ok := files[imp]; ok && (seen.Namespace != namespace || seen.Name != name) {
+				return &ImportError{Importer: filePath, Import: imp, Err: fmt.Errorf("refers to %s/%s here but to %s/%s elsewhere in the import graph", namespace, name, seen.Namespace, seen.Name)}
+			}
+			if seen, ok := paths[namespace+"/"+name]; ok && seen != imp {
+				return &ImportError{Importer: filePath, Import: imp, Err: fmt.Errorf("%s/%s is also imported as %q", namespace, name, seen)}
+			}
+			for i, onStack := range stack {
+				if onStack == imp {
+					return &ImportCycleError{Cycle: append(append([]string(nil), stack[i:]...), imp)}
+				}
+			}
+			if _, done := files[imp]; done {
+				continue
+			}
+
+			dep, err := l.FindProto(ctx, namespace, name)
+			if err != nil {
+				return &ImportError{Importer: filePath, Import: imp, Err: err}
+			}
+			if err := checkProto(dep, limits); err != nil {
+				return err
+			}
+			if limits.MaxFiles > 0 && len(files) >= limits.MaxFiles {
+				return &RejectedError{ID: root.ID, Name: root.Name, Reason: fmt.Sprintf("imports more than %d files", limits.MaxFiles)}
+			}
+			files[imp] = dep
+			paths[namespace+"/"+name] = imp
+			if err := visit(imp, dep, stack); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := visit(root.Name, root, nil); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// importTarget returns the namespace and name of the registry proto an import
+// path in a proto of the given namespace refers to
+func importTarget(namespace, importPath string) (string, string, error) {
+	if path.IsAbs(importPath) || path.Clean(importPath) != importPath || !validImportPath(importPath) {
+		return "", "", fmt.Errorf("import path must be relative and clean")
+	}
+	if strings.HasPrefix(importPath, wellKnownPrefix) {
+		return "", "", fmt.Errorf("not a bundled well-known type")
+	}
+	dir, name := path.Split(importPath)
+	if dir != "" {
+		namespace = strings.TrimSuffix(dir, "/")
+	}
+	return namespace, name, nil
+}
+
+// FindProto looks up a proto by namespace and name. When the registry holds
+// several protos with that name, the one with the highest ID wins.
+func (l *ProtoLoader) FindProto(ctx context.Context, namespace, name string) (*Proto, error) {
+	key := namespace + "/" + name
+	l.cacheMutex.RLock()
+	id, ok := l.nameIndex[key]
+	l.cacheMutex.RUnlock()
+	if ok {
+		return l.GetProto(ctx, id)
+	}
+
+	var found *Proto
+	it := l.Protos(ctx, namespace, PageOptions{Prefetch: true})
+	defer it.Close()
+	for it.Next() {
+		if p := it.Value(); p.Namespace == namespace && p.Name == name && (found == nil || p.ID > found.ID) {
+			found = p
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: %s in namespace %q", ErrNotFound, name, namespace)
+	}
+
+	l.cacheMutex.Lock()
+	l.nameIndex[key] = found.ID
+	l.cacheMutex.Unlock()
+	return l.GetProto(ctx, found.ID)
+}
+
+// parseImports returns the import paths of a proto file
+func parseImports(filePath, content string) ([]string, error) {
+	file, err := parser.Parse(filePath, strings.NewReader(content), reporter.NewHandler(nil))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filePath, err)
+	}
+	var imports []string
+	for _, decl := range file.Decls {
+		if imp, ok := decl.(*ast.ImportNode); ok {
+			imports = append(imports, imp.Name.AsString())
+		}
+	}
+	return imports, nil
+}
+
+// wellKnownDescriptorSet returns the bundled well-known types imported by
+// files, for protoc's --descriptor_set_in
+func wellKnownDescriptorSet(files map[string]*Proto) (*descriptorpb.FileDescriptorSet, error) {
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := make(map[string]bool)
+	var add func(fd protoreflect.FileDescriptor)
+	add = func(fd protoreflect.FileDescriptor) {
+		if seen[fd.Path()] {
+			return
+		}
+		seen[fd.Path()] = true
+		imports := fd.Imports()
+		for i := 0; i < imports.Len(); i++ {
+			add(imports.Get(i).FileDescriptor)
+		}
+		set.File = append(set.File, protodesc.ToFileDescriptorProto(fd))
+	}
+
+	for filePath, p := range files {
+		imports, err := parseImports(filePath, p.Content)
+		if err != nil {
+			return nil, err
+		}
+		for _, imp := range imports {
+			if fd, err := protoregistry.GlobalFiles.FindFileByPath(imp); err == nil && isWellKnown(imp) {
+				add(fd)
+			}
+		}
+	}
+	return set, nil
+}
@@ -0,0 +1,160 @@
+package protoloader
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestImports(t *testing.T) {
+	server := newTestRegistry(t,
+		Proto{ID: 1, Namespace: "chat", Name: "message.proto", Version: "v1", Content: `syntax = "proto3";
+package qne.chat;
+
+import "author.proto";
+import "common/time.proto";
+import "google/protobuf/timestamp.proto";
+
+message Message {
+  Author author = 1;
+  qne.common.Span span = 2;
+  google.protobuf.Timestamp sent = 3;
+}`},
+		Proto{ID: 2, Namespace: "chat", Name: "author.proto", Version: "v1", Content: `syntax = "proto3";
+package qne.chat;
+
+import "common/time.proto";
+
+message Author {
+  string name = 1;
+  qne.common.Span active = 2;
+}`},
+		Proto{ID: 3, Namespace: "common", Name: "time.proto", Version: "v1", Content: `syntax = "proto3";
+package qne.common;
+
+import "google/protobuf/duration.proto";
+
+message Span {
+  google.protobuf.Duration length = 1;
+}`},
+		// A newer proto with the same name replaces the older one
+		Proto{ID: 4, Namespace: "common", Name: "old.proto", Version: "v1", Content: `syntax = "proto3";
+message Old {}`},
+		Proto{ID: 5, Namespace: "common", Name: "old.proto", Version: "v2", Content: `syntax = "proto3";
+message New {}`},
+		Proto{ID: 6, Namespace: "broken", Name: "missing.proto", Version: "v1", Content: `syntax = "proto3";
+import "nowhere/gone.proto";`},
+		Proto{ID: 7, Namespace: "cycle", Name: "a.proto", Version: "v1", Content: `syntax = "proto3";
+import "b.proto";`},
+		Proto{ID: 8, Namespace: "cycle", Name: "b.proto", Version: "v1", Content: `syntax = "proto3";
+import "a.proto";`},
+		// types.proto means chat/types.proto in the root but common/types.proto
+		// in common/uses.proto
+		Proto{ID: 9, Namespace: "chat", Name: "clash.proto", Version: "v1", Content: `syntax = "proto3";
+import "types.proto";
+import "common/uses.proto";`},
+		Proto{ID: 10, Namespace: "chat", Name: "types.proto", Version: "v1", Content: `syntax = "proto3";
+message ChatType {}`},
+		Proto{ID: 11, Namespace: "common", Name: "uses.proto", Version: "v1", Content: `syntax = "proto3";
+import "types.proto";`},
+		Proto{ID: 12, Namespace: "common", Name: "types.proto", Version: "v1", Content: `syntax = "proto3";
+message CommonType {}`},
+		// dup/shared.proto is imported under two paths
+		Proto{ID: 13, Namespace: "dup", Name: "both.proto", Version: "v1", Content: `syntax = "proto3";
+import "shared.proto";
+import "dup/shared.proto";`},
+		Proto{ID: 14, Namespace: "dup", Name: "shared.proto", Version: "v1", Content: `syntax = "proto3";
+message Shared {}`},
+	)
+	loader := newTestLoader(t, server.URL)
+	ctx := context.Background()
+
+	t.Run("Closure", func(t *testing.T) {
+		proto, _ := loader.GetProto(ctx, 1)
+		files, err := loader.importClosure(ctx, proto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 3 || files["author.proto"].ID != 2 || files["common/time.proto"].ID != 3 {
+			t.Errorf("unexpected closure: %v", files)
+		}
+
+		wkt, err := wellKnownDescriptorSet(files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range wkt.File {
+			names = append(names, f.GetName())
+		}
+		if len(names) != 2 || !strings.Contains(strings.Join(names, ","), "google/protobuf/timestamp.proto") {
+			t.Errorf("unexpected well-known types %v", names)
+		}
+	})
+
+	t.Run("Resolve", func(t *testing.T) {
+		mt, err := loader.MessageType(ctx, 1, "Message")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := mt.Descriptor().Fields()
+		if got := fields.ByName("span").Message().FullName(); got != "qne.common.Span" {
+			t.Errorf("span resolved to %s", got)
+		}
+		if got := fields.ByName("sent").Message().FullName(); got != "google.protobuf.Timestamp" {
+			t.Errorf("sent resolved to %s", got)
+		}
+	})
+
+	t.Run("FindProto", func(t *testing.T) {
+		proto, err := loader.FindProto(ctx, "common", "old.proto")
+		if err != nil || proto.ID != 5 {
+			t.Errorf("expected the newest proto, got %+v: %v", proto, err)
+		}
+	})
+
+	t.Run("Unresolved", func(t *testing.T) {
+		_, err := loader.FileDescriptor(ctx, 6)
+		var importErr *ImportError
+		if !errors.As(err, &importErr) || importErr.Import != "nowhere/gone.proto" {
+			t.Fatalf("expected ImportError, got %v", err)
+		}
+		if !strings.Contains(err.Error(), `"nowhere/gone.proto"`) {
+			t.Errorf("error does not name the import: %v", err)
+		}
+	})
+
+	t.Run("Ambiguous", func(t *testing.T) {
+		_, err := loader.FileDescriptor(ctx, 9)
+		var importErr *ImportError
+		if !errors.As(err, &importErr) || importErr.Import != "types.proto" || importErr.Importer != "common/uses.proto" {
+			t.Fatalf("expected ImportError for the clashing import, got %v", err)
+		}
+		if !strings.Contains(err.Error(), "common/types.proto") || !strings.Contains(err.Error(), "chat/types.proto") {
+			t.Errorf("error does not name both protos: %v", err)
+		}
+	})
+
+	t.Run("TwoPaths", func(t *testing.T) {
+		_, err := loader.FileDescriptor(ctx, 13)
+		var importErr *ImportError
+		if !errors.As(err, &importErr) || importErr.Import != "dup/shared.proto" {
+			t.Fatalf("expected ImportError for the second path, got %v", err)
+		}
+		if !strings.Contains(err.Error(), `"shared.proto"`) {
+			t.Errorf("error does not name both paths: %v", err)
+		}
+	})
+
+	t.Run("Cycle", func(t *testing.T) {
+		_, err := loader.FileDescriptor(ctx, 7)
+		var cycleErr *ImportCycleError
+		if !errors.As(err, &cycleErr) {
+			t.Fatalf("expected ImportCycleError, got %v", err)
+		}
+		if got := strings.Join(cycleErr.Cycle, " "); got != "a.proto b.proto a.proto" {
+			t.Errorf("unexpected cycle %s", got)
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package protoloader_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/qnepff/qne-node-v12/internal/gatewaytest"
+	"github.com/qnepff/qne-node-v12/internal/protoloader"
+)
+
+func TestIntegrity(t *testing.T) {
+	gateway, url := gatewaytest.NewServer(t, gatewaytest.Config{})
+	gateway.AddProto(protoloader.Proto{ID: 1, Namespace: "chat", Name: "chat.proto", Version: "v1",
+		Content: "syntax = \"proto3\";\nmessage Chat {}\n"})
+	ctx := context.Background()
+
+	newLoader := func(t *testing.T, url, cacheDir string, anchors ...ed25519.PublicKey) *protoloader.ProtoLoader {
+		t.Helper()
+		loader, err := protoloader.New(url, cacheDir, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		loader.SetTrustAnchors(anchors...)
+		return loader
+	}
+	isIntegrityError := func(err error) bool {
+		var integrityErr *protoloader.IntegrityError
+		return errors.As(err, &integrityErr)
+	}
+
+	t.Run("Signed", func(t *testing.T) {
+		loader := newLoader(t, url, t.TempDir(), gateway.RegistryKey())
+		if _, err := loader.GetProto(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("UntrustedKey", func(t *testing.T) {
+		other, _, _ := ed25519.GenerateKey(rand.Reader)
+		loader := newLoader(t, url, t.TempDir(), other)
+		if _, err := loader.GetProto(ctx, 1); !isIntegrityError(err) {
+			t.Errorf("expected an integrity error, got %v", err)
+		}
+	})
+
+	t.Run("NoTrustAnchors", func(t *testing.T) {
+		loader := newLoader(t, url, t.TempDir())
+		if _, err := loader.GetProto(ctx, 1); !errors.Is(err, protoloader.ErrNoTrustAnchors) {
+			t.Errorf("expected ErrNoTrustAnchors, got %v", err)
+		}
+	})
+
+	t.Run("TamperedResponse", func(t *testing.T) {
+		tampered := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := httptest.NewRecorder()
+			gateway.ServeHTTP(rec, r)
+			w.Write(bytes.Replace(rec.Body.Bytes(), []byte("Chat"), []byte("Evil"), 1))
+		}))
+		defer tampered.Close()
+
+		loader := newLoader(t, tampered.URL, t.TempDir(), gateway.RegistryKey())
+		if _, err := loader.GetProto(ctx, 1); !isIntegrityError(err) {
+			t.Errorf("expected an integrity error, got %v", err)
+		}
+	})
+
+	t.Run("Unsigned", func(t *testing.T) {
+		unsigned := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(protoloader.Proto{ID: 1, Namespace: "chat", Name: "chat.proto", Version: "v1",
+				Content: "syntax = \"proto3\";\nmessage Evil {}\n"})
+		}))
+		defer unsigned.Close()
+
+		loader := newLoader(t, unsigned.URL, t.TempDir(), gateway.RegistryKey())
+		if _, err := loader.GetProto(ctx, 1); !isIntegrityError(err) {
+			t.Errorf("expected a proto without hash and signature to be refused, got %v", err)
+		}
+	})
+
+	t.Run("TamperedCache", func(t *testing.T) {
+		cacheDir := t.TempDir()
+		loader := newLoader(t, url, cacheDir, gateway.RegistryKey())
+		if _, err := loader.GetProto(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+
+		// Rehashed in the cache file, or with hash and signature removed
+		for name, strip := range map[string]bool{"proto_1.json": false, "proto_1@v1.json": true} {
+			path := filepath.Join(cacheDir, name)
+			data, _ := os.ReadFile(path)
+			var entry map[string]json.RawMessage
+			json.Unmarshal(data, &entry)
+			var p protoloader.Proto
+			json.Unmarshal(entry["proto"], &p)
+			p.Content = "syntax = \"proto3\";\nmessage Evil {}\n"
+			p.ContentHash = protoloader.ContentHash(p.Content)
+			if strip {
+				p.ContentHash, p.Signature = "", ""
+			}
+			entry["proto"], _ = json.Marshal(p)
+			data, _ = json.Marshal(entry)
+			os.WriteFile(path, data, 0644)
+		}
+
+		// Refused from disk, so the offline loader has nothing to serve
+		offline := newLoader(t, "http://127.0.0.1:0", cacheDir, gateway.RegistryKey())
+		if _, err := offline.GetProto(ctx, 1); err == nil {
+			t.Error("expected the tampered cache file to be refused")
+		}
+		if _, err := offline.GetProtoVersion(ctx, 1, "v1"); err == nil {
+			t.Error("expected the tampered version file to be refused")
+		}
+
+		// Online, the proto is fetched again
+		online := newLoader(t, url, cacheDir, gateway.RegistryKey())
+		if p, err := online.GetProto(ctx, 1); err != nil || p.Content != "syntax = \"proto3\";\nmessage Chat {}\n" {
+			t.Errorf("expected the registry's proto, got %+v: %v", p, err)
+		}
+	})
+
+	t.Run("LoadTrustAnchors", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "registry.pub")
+		os.WriteFile(path, gatewaytest.PublicKeyPEM(gateway.RegistryKey()), 0644)
+		keys, err := protoloader.LoadTrustAnchors(path)
+		if err != nil || len(keys) != 1 || !keys[0].Equal(gateway.RegistryKey()) {
+			t.Errorf("unexpected trust anchors %v: %v", keys, err)
+		}
+
+		os.WriteFile(path, []byte("not a key"), 0644)
+		if _, err := protoloader.LoadTrustAnchors(path); err == nil {
+			t.Error("expected a file without keys to fail")
+		}
+	})
+}
@@ -0,0 +1,201 @@
+package protoloader
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultPageSize is the page size used by iterators when none is given
+const DefaultPageSize = 100
+
+// PageOptions configures an iterator
+type PageOptions struct {
+	PageSize int32 // Items per request, DefaultPageSize when zero
+	Prefetch bool  // Fetch the next page while the current one is consumed
+}
+
+// pageFunc fetches the page at cursor and returns the cursor of the next one
+type pageFunc[T any] func(ctx context.Context, cursor int64) (items []T, next int64, more bool, err error)
+
+type pageResult[T any] struct {
+	items []T
+	next  int64
+	more  bool
+	err   error
+}
+
+// Iterator walks a paginated registry listing, fetching pages lazily:
+//
+//	it := loader.Protos(ctx, "chat", protoloader.PageOptions{})
+//	defer it.Close()
+//	for it.Next() {
+//		fmt.Println(it.Value().Name)
+//	}
+//	if err := it.Err(); err != nil {
+//		return err
+//	}
+//
+// An Iterator is not safe for concurrent use.
+type Iterator[T any] struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	fetch    pageFunc[T]
+	prefetch bool
+
+	page    []T
+	value   T
+	cursor  int64
+	more    bool
+	pending chan pageResult[T] // Page in flight, if any
+	err     error
+}
+
+func newIterator[T any](ctx context.Context, first int64, prefetch bool, fetch pageFunc[T]) *Iterator[T] {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Iterator[T]{ctx: ctx, cancel: cancel, fetch: fetch, prefetch: prefetch, cursor: first, more: true}
+}
+
+// Next advances to the next item and reports whether there is one. It
+// returns false at the end of the listing, on error or once ctx is done.
+func (it *Iterator[T]) Next() bool {
+	for len(it.page) == 0 {
+		if it.err != nil || !it.more {
+			return false
+		}
+		if err := it.ctx.Err(); err != nil {
+			it.err = err
+			return false
+		}
+		result := it.nextPage()
+		if result.err != nil {
+			it.err = result.err
+			return false
+		}
+		// Stop on a cursor that does not advance rather than loop forever
+		it.more = result.more && result.next != it.cursor
+		it.cursor = result.next
+		it.page = result.items
+		if it.more && it.prefetch {
+			it.startFetch()
+		}
+	}
+	it.value = it.page[0]
+	it.page = it.page[1:]
+	return true
+}
+
+// nextPage returns the prefetched page or fetches one now
+func (it *Iterator[T]) nextPage() pageResult[T] {
+	if it.pending == nil {
+		it.startFetch()
+	}
+	select {
+	case result := <-it.pending:
+		it.pending = nil
+		return result
+	case <-it.ctx.Done():
+		return pageResult[T]{err: it.ctx.Err()}
+	}
+}
+
+func (it *Iterator[T]) startFetch() {
+	pending := make(chan pageResult[T], 1)
+	it.pending = pending
+	cursor := it.cursor
+	go func() {
+		items, next, more, err := it.fetch(it.ctx, cursor)
+		pending <- pageResult[T]{items, next, more, err}
+	}()
+}
+
+// Value returns the current item
+func (it *Iterator[T]) Value() T {
+	return it.value
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *Iterator[T]) Err() error {
+	return it.err
+}
+
+// Close stops the iterator and cancels a prefetch in flight. Next returns
+// false afterwards.
+func (it *Iterator[T]) Close() {
+	it.cancel()
+	it.page = nil
+	it.more = false
+}
+
+// All collects the remaining items
+func (it *Iterator[T]) All() ([]T, error) {
+	defer it.Close()
+	var all []T
+	for it.Next() {
+		all = append(all, it.Value())
+	}
+	return all, it.Err()
+}
+
+// Protos iterates over the protos of a namespace, or of every namespace when
+// it is empty, in ID order
+func (l *ProtoLoader) Protos(ctx context.Context, namespace string, opts PageOptions) *Iterator[*Proto] {
+	pageSize := opts.pageSize()
+	return newIterator(ctx, 0, opts.Prefetch, func(ctx context.Context, lastSeen int64) ([]*Proto, int64, bool, error) {
+		protos, more, lastID, err := l.ListProtos(ctx, namespace, pageSize, lastSeen)
+		return protos, lastID, more, err
+	})
+}
+
+// Namespaces iterates over the registry's namespaces
+func (l *ProtoLoader) Namespaces(ctx context.Context, opts PageOptions) *Iterator[string] {
+	pageSize := opts.pageSize()
+	return newIterator(ctx, 1, opts.Prefetch, func(ctx context.Context, page int64) ([]string, int64, bool, error) {
+		namespaces, more, err := l.ListNamespaces(ctx, pageSize, int32(page))
+		return namespaces, page + 1, more, err
+	})
+}
+
+func (o PageOptions) pageSize() int32 {
+	if o.PageSize <= 0 {
+		return DefaultPageSize
+	}
+	return o.PageSize
+}
+
+// SyncNamespace mirrors every proto of a namespace into the local cache, so
+// they can be served while the registry is unreachable. Protos whose cached
+// version is current are kept as they are. It returns the number of protos
+// in the namespace.
+func (l *ProtoLoader) SyncNamespace(ctx context.Context, namespace string) (int, error) {
+	it := l.Protos(ctx, namespace, PageOptions{Prefetch: true})
+	defer it.Close()
+
+	count := 0
+	for it.Next() {
+		p := it.Value()
+		count++
+
+		l.cacheMutex.Lock()
+		l.nameIndex[p.Namespace+"/"+p.Name] = p.ID
+		l.cacheMutex.Unlock()
+
+		cached := l.cached(cacheKey{id: p.ID})
+		switch {
+		case cached != nil && cached.Proto.Version == p.Version:
+			refreshed := *cached
+			refreshed.FetchedAt = time.Now()
+			l.store(cacheKey{id: p.ID}, &refreshed)
+		case p.Content != "":
+			if err := l.verify(p); err != nil {
+				return count, err
+			}
+			l.storeLatest(&cacheEntry{Proto: p, FetchedAt: time.Now()})
+		default:
+			// Listings may leave out the content
+			if _, err := l.Refresh(ctx, p.ID); err != nil {
+				return count, err
+			}
+		}
+	}
+	return count, it.Err()
+}
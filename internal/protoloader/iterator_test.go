@@ -0,0 +1,155 @@
+package protoloader
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIterators(t *testing.T) {
+	var protos []Proto
+	for id := int64(1); id <= 7; id++ {
+		ns := "chat"
+		if id%2 == 0 {
+			ns = "a&b c"
+		}
+		protos = append(protos, Proto{ID: id, Namespace: ns, Name: fmt.Sprintf("p%d.proto", id), Version: "v1",
+			Content: "syntax = \"proto3\";\n"})
+	}
+	registry := newTestRegistry(t, protos...)
+	var listRequests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/protos" {
+			listRequests.Add(1)
+		}
+		if r.URL.Path == "/api/v1/namespaces" {
+			page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+			all := []string{"a&b c", "chat", "empty"}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"namespaces": all[page-1 : page],
+				"has_more":   page < len(all),
+			})
+			return
+		}
+		resp, err := http.Get(registry.URL + r.URL.String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		var body json.RawMessage
+		json.NewDecoder(resp.Body).Decode(&body)
+		w.Write(body)
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	t.Run("Protos", func(t *testing.T) {
+		for _, prefetch := range []bool{false, true} {
+			loader := newTestLoader(t, server.URL)
+			listRequests.Store(0)
+			all, err := loader.Protos(ctx, "", PageOptions{PageSize: 2, Prefetch: prefetch}).All()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(all) != 7 || all[6].ID != 7 {
+				t.Errorf("unexpected protos %v", all)
+			}
+			if listRequests.Load() != 4 {
+				t.Errorf("expected 4 pages, got %d", listRequests.Load())
+			}
+		}
+	})
+
+	t.Run("EscapedNamespace", func(t *testing.T) {
+		loader := newTestLoader(t, server.URL)
+		all, err := loader.Protos(ctx, "a&b c", PageOptions{PageSize: 2}).All()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 3 {
+			t.Fatalf("expected the 3 protos of the namespace, got %d", len(all))
+		}
+		for _, p := range all {
+			if p.Namespace != "a&b c" {
+				t.Errorf("proto %d from namespace %q", p.ID, p.Namespace)
+			}
+		}
+	})
+
+	t.Run("Namespaces", func(t *testing.T) {
+		loader := newTestLoader(t, server.URL)
+		all, err := loader.Namespaces(ctx, PageOptions{PageSize: 1, Prefetch: true}).All()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 3 || all[0] != "a&b c" || all[2] != "empty" {
+			t.Errorf("unexpected namespaces %v", all)
+		}
+	})
+
+	t.Run("Lazy", func(t *testing.T) {
+		loader := newTestLoader(t, server.URL)
+		listRequests.Store(0)
+		it := loader.Protos(ctx, "", PageOptions{PageSize: 2})
+		it.Next()
+		it.Close()
+		if listRequests.Load() != 1 {
+			t.Errorf("expected only the first page to be fetched, got %d", listRequests.Load())
+		}
+		if it.Next() || it.Err() != nil {
+			t.Errorf("expected a closed iterator to stop, got %v", it.Err())
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		loader := newTestLoader(t, server.URL)
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		it := loader.Protos(cancelled, "", PageOptions{})
+		if it.Next() || !errors.Is(it.Err(), context.Canceled) {
+			t.Errorf("expected cancellation, got %v", it.Err())
+		}
+	})
+
+	t.Run("StuckCursor", func(t *testing.T) {
+		stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"protos": []Proto{protos[0]}, "has_more": true, "last_id": 0,
+			})
+		}))
+		defer stuck.Close()
+		all, err := newTestLoader(t, stuck.URL).Protos(ctx, "", PageOptions{}).All()
+		if err != nil || len(all) != 1 {
+			t.Errorf("expected iteration to stop, got %d protos: %v", len(all), err)
+		}
+	})
+
+	t.Run("SyncNamespace", func(t *testing.T) {
+		loader := newTestLoader(t, server.URL)
+		n, err := loader.SyncNamespace(ctx, "chat")
+		if err != nil || n != 4 {
+			t.Fatalf("expected 4 protos synced, got %d: %v", n, err)
+		}
+
+		// Synced protos are served without the registry
+		offline, _ := New("http://127.0.0.1:0", loader.cacheDir, loader.compiledDir)
+		offline.SetTrustAnchors(testRegistryKey.Public().(ed25519.PublicKey))
+		for _, id := range []int64{1, 3, 5, 7} {
+			if p, err := offline.GetProto(ctx, id); err != nil || p.ID != id {
+				t.Errorf("proto %d not synced: %v", id, err)
+			}
+		}
+		if _, err := offline.GetProto(ctx, 2); err == nil {
+			t.Error("expected a proto from another namespace not to be synced")
+		}
+	})
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package protoloader
+
+import (
+	"context"
+	"os/exec"
+)
+
+// limitedCommand returns a command running name. Memory cannot be limited
+// on this platform.
+func limitedCommand(ctx context.Context, maxMemory int64, name string, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, name, args...)
+}
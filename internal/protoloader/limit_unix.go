@@ -0,0 +1,31 @@
+//go:build unix
+
+package protoloader
+
+import (
+	"context"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// limitedCommand returns a command running name in its own process group,
+// so plugins are killed along with it, and with its data segment capped at
+// maxMemory bytes through the shell's ulimit
+func limitedCommand(ctx context.Context, maxMemory int64, name string, args ...string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if path, err := exec.LookPath(name); err != nil || maxMemory <= 0 {
+		// Run as is, reporting a failed lookup when started
+		cmd = exec.CommandContext(ctx, name, args...)
+	} else {
+		// A lower hard limit already in place is kept
+		script := `ulimit -d "$1" 2>/dev/null; shift; exec "$@"`
+		shellArgs := append([]string{"-c", script, "sh", strconv.FormatInt(maxMemory>>10, 10), path}, args...)
+		cmd = exec.CommandContext(ctx, "/bin/sh", shellArgs...)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	return cmd
+}
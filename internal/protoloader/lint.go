@@ -0,0 +1,102 @@
+package protoloader
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// LintIssue is a style problem in a proto, reported before it is published
+type LintIssue struct {
+	Element string `json:"element"` // Name relative to the package, empty for the file
+	Message string `json:"message"`
+}
+
+func (i LintIssue) String() string {
+	if i.Element == "" {
+		return i.Message
+	}
+	return i.Element + ": " + i.Message
+}
+
+var (
+	upperCamel = regexp.MustCompile(`^[A-Z][A-Za-z0-9]*$`)
+	lowerSnake = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+	upperSnake = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+)
+
+// Lint checks a proto file against the registry's style rules: a package is
+// declared, messages, enums, services and methods are UpperCamelCase, fields
+// are lower_snake_case, enum values are UPPER_SNAKE_CASE and the zero value
+// of a proto3 enum ends in _UNSPECIFIED.
+func Lint(fd protoreflect.FileDescriptor) []LintIssue {
+	l := &linter{pkg: fd.Package(), issues: []LintIssue{}}
+	if fd.Package() == "" {
+		l.add(nil, "no package declared")
+	}
+	l.messages(fd.Messages(), fd.Syntax())
+	l.enums(fd.Enums(), fd.Syntax())
+	services := fd.Services()
+	for i := 0; i < services.Len(); i++ {
+		s := services.Get(i)
+		l.name(s, upperCamel, "service", "UpperCamelCase")
+		methods := s.Methods()
+		for j := 0; j < methods.Len(); j++ {
+			l.name(methods.Get(j), upperCamel, "method", "UpperCamelCase")
+		}
+	}
+	return l.issues
+}
+
+type linter struct {
+	pkg    protoreflect.FullName
+	issues []LintIssue
+}
+
+func (l *linter) add(d protoreflect.Descriptor, format string, args ...interface{}) {
+	element := ""
+	if d != nil {
+		element = strings.TrimPrefix(string(d.FullName()), string(l.pkg)+".")
+	}
+	l.issues = append(l.issues, LintIssue{Element: element, Message: fmt.Sprintf(format, args...)})
+}
+
+func (l *linter) name(d protoreflect.Descriptor, pattern *regexp.Regexp, kind, style string) {
+	if !pattern.MatchString(string(d.Name())) {
+		l.add(d, "%s name should be %s", kind, style)
+	}
+}
+
+func (l *linter) messages(messages protoreflect.MessageDescriptors, syntax protoreflect.Syntax) {
+	for i := 0; i < messages.Len(); i++ {
+		m := messages.Get(i)
+		if m.IsMapEntry() {
+			continue
+		}
+		l.name(m, upperCamel, "message", "UpperCamelCase")
+		fields := m.Fields()
+		for j := 0; j < fields.Len(); j++ {
+			l.name(fields.Get(j), lowerSnake, "field", "lower_snake_case")
+		}
+		l.messages(m.Messages(), syntax)
+		l.enums(m.Enums(), syntax)
+	}
+}
+
+func (l *linter) enums(enums protoreflect.EnumDescriptors, syntax protoreflect.Syntax) {
+	for i := 0; i < enums.Len(); i++ {
+		e := enums.Get(i)
+		l.name(e, upperCamel, "enum", "UpperCamelCase")
+		values := e.Values()
+		for j := 0; j < values.Len(); j++ {
+			l.name(values.Get(j), upperSnake, "enum value", "UPPER_SNAKE_CASE")
+		}
+		if syntax == protoreflect.Proto3 && values.Len() > 0 {
+			if zero := values.Get(0); !strings.HasSuffix(string(zero.Name()), "_UNSPECIFIED") {
+				l.add(zero, "zero value of enum %s should end in _UNSPECIFIED", e.Name())
+			}
+		}
+	}
+}
@@ -2,14 +2,22 @@ package protoloader
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	protov2 "google.golang.org/protobuf/proto"
 )
 
 type Proto struct {
@@ -18,14 +26,38 @@ type Proto struct {
 	Name      string `json:"name"`
 	Content   string `json:"content"`
 	Version   string `json:"version"`
+
+	// Why the proto should no longer be used, empty while it is current.
+	// Deprecated protos are still served.
+	Deprecated string `json:"deprecated,omitempty"`
+
+	// Set by the registry, see Sign
+	ContentHash string `json:"content_hash,omitempty"`
+	Signature   string `json:"signature,omitempty"`
 }
 
 type ProtoLoader struct {
 	serverURL    string
 	cacheDir     string
 	compiledDir  string
-	protoCache   map[int64]*Proto
+	protoCache   *lruCache
+	descCache    map[int64]*parsedProto
+	avroCache    map[int64]*AvroSchema
+	fingerprints map[uint64]*AvroSchema
+	nameIndex    map[string]int64
+	pinned       map[int64]bool
+	trustAnchors []ed25519.PublicKey
+	genVersions  map[string]string
+	targets      map[string]Target
+	genMutex     sync.Mutex
+	maxAge       time.Duration
+	limits       CacheLimits
+	stats        CacheStats
 	cacheMutex   sync.RWMutex
+	flights      singleflight.Group
+	fetchLimit   int
+	compileLimit CompileLimits
+	nodeCert     func() (*tls.Certificate, error)
 	httpClient   *http.Client
 }
 
@@ -37,78 +69,95 @@ func New(serverURL, cacheDir, compiledDir string) (*ProtoLoader, error) {
 		return nil, fmt.Errorf("failed to create compiled directory: %v", err)
 	}
 
-	return &ProtoLoader{
+	l := &ProtoLoader{
 		serverURL:    serverURL,
 		cacheDir:     cacheDir,
 		compiledDir:  compiledDir,
-		protoCache:   make(map[int64]*Proto),
+		descCache:    make(map[int64]*parsedProto),
+		avroCache:    make(map[int64]*AvroSchema),
+		fingerprints: make(map[uint64]*AvroSchema),
+		nameIndex:    make(map[string]int64),
+		pinned:       make(map[int64]bool),
+		targets:      builtinTargets(),
+		genVersions:  make(map[string]string),
+		maxAge:       DefaultMaxAge,
+		fetchLimit:   DefaultFetchConcurrency,
+		compileLimit: DefaultCompileLimits,
 		httpClient:   &http.Client{},
-	}, nil
+	}
+	// Drop parsed schemas along with the latest version they came from
+	l.protoCache = newLRUCache(l.pinned, func(key cacheKey) {
+		if key.version == "" {
+			delete(l.descCache, key.id)
+			delete(l.avroCache, key.id)
+		}
+	})
+	l.SetCacheLimits(DefaultCacheLimits)
+	return l, nil
 }
 
+// GetProto returns the latest version of a proto. Cached copies are served
+// until they are older than the max age and then revalidated with the
+// registry.
 func (l *ProtoLoader) GetProto(ctx context.Context, id int64) (*Proto, error) {
-	// Check memory cache first
-	l.cacheMutex.RLock()
-	if proto, ok := l.protoCache[id]; ok {
-		l.cacheMutex.RUnlock()
-		return proto, nil
-	}
-	l.cacheMutex.RUnlock()
-
-	// Check disk cache
-	cachePath := filepath.Join(l.cacheDir, fmt.Sprintf("proto_%d.json", id))
-	if data, err := ioutil.ReadFile(cachePath); err == nil {
-		var proto Proto
-		if err := json.Unmarshal(data, &proto); err == nil {
-			l.cacheMutex.Lock()
-			l.protoCache[id] = &proto
-			l.cacheMutex.Unlock()
-			return &proto, nil
-		}
+	key := cacheKey{id: id}
+	cached := l.cached(key)
+	if cached != nil && l.fresh(cached) {
+		return cached.Proto, nil
 	}
+	// Concurrent callers share a single request
+	return l.coalesce(ctx, key, func() (*Proto, error) {
+		return l.revalidate(ctx, id, cached)
+	})
+}
 
-	// Fetch from server
-	url := fmt.Sprintf("%s/api/v1/protos/%d", l.serverURL, id)
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
+// CompileProto generates code for a proto with protoc, for each of the
+// given targets or for TargetGo when none is given. Output that is current
+// according to its manifest is kept without running protoc again. Use
+// FileDescriptor and MessageType to work with a proto at runtime without
+// protoc.
+func (l *ProtoLoader) CompileProto(ctx context.Context, id int64, targets ...string) error {
+	if len(targets) == 0 {
+		targets = []string{TargetGo}
 	}
-
-	resp, err := l.httpClient.Do(req)
+	proto, err := l.GetProto(ctx, id)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch proto: %v", err)
+		return fmt.Errorf("failed to get proto: %v", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusNotFound {
-		return nil, fmt.Errorf("proto not found: %d", id)
-	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("server returned status %d", resp.StatusCode)
+	if proto.IsAvro() {
+		return fmt.Errorf("proto %d (%s) is an Avro schema, use AvroSchema", id, proto.Name)
 	}
 
-	var proto Proto
-	if err := json.NewDecoder(resp.Body).Decode(&proto); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %v", err)
+	files, err := l.importClosure(ctx, proto)
+	if err != nil {
+		return err
 	}
+	protoDir := l.compiledDirFor(id)
 
-	// Cache the proto
-	data, err := json.Marshal(proto)
-	if err == nil {
-		_ = ioutil.WriteFile(cachePath, data, 0644)
+	var pending []*compileManifest
+	for _, name := range targets {
+		target, err := l.target(name)
+		if err != nil {
+			return err
+		}
+		want := &compileManifest{
+			ProtoID:    id,
+			Version:    proto.Version,
+			Target:     target.Name,
+			InputHash:  inputHash(files),
+			Options:    target.Args("$OUT"),
+			Generators: l.generatorVersions(ctx, append([]string{"protoc"}, target.Plugins...)),
+		}
+		outputDir := filepath.Join(protoDir, target.Name)
+		if current, err := readManifest(outputDir); err == nil && current.matches(want) {
+			touch(outputDir)
+			continue
+		}
+		pending = append(pending, want)
 	}
-
-	l.cacheMutex.Lock()
-	l.protoCache[id] = &proto
-	l.cacheMutex.Unlock()
-
-	return &proto, nil
-}
-
-func (l *ProtoLoader) CompileProto(ctx context.Context, id int64) error {
-	proto, err := l.GetProto(ctx, id)
-	if err != nil {
-		return fmt.Errorf("failed to get proto: %v", err)
+	if len(pending) == 0 {
+		return nil
 	}
 
 	// Create a temporary directory for proto files
@@ -118,51 +167,89 @@ func (l *ProtoLoader) CompileProto(ctx context.Context, id int64) error {
 	}
 	defer os.RemoveAll(tmpDir)
 
-	// Write the proto file
-	protoPath := filepath.Join(tmpDir, proto.Name)
-	if err := ioutil.WriteFile(protoPath, []byte(proto.Content), 0644); err != nil {
-		return fmt.Errorf("failed to write proto file: %v", err)
-	}
-
-	// Create output directory
-	outputDir := filepath.Join(l.compiledDir, fmt.Sprintf("proto_%d", id))
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		return fmt.Errorf("failed to create output directory: %v", err)
+	// Write the proto and everything it imports, each under its import path.
+	// protoc has no "--" to end its flags, so files are passed by absolute
+	// path, which never reads as a flag.
+	paths := make([]string, 0, len(files))
+	for filePath, p := range files {
+		fullPath, err := sandboxPath(tmpDir, filePath)
+		if err != nil {
+			return &RejectedError{ID: p.ID, Name: p.Name, Reason: err.Error()}
+		}
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			return fmt.Errorf("failed to create proto directory: %v", err)
+		}
+		if err := ioutil.WriteFile(fullPath, []byte(p.Content), 0644); err != nil {
+			return fmt.Errorf("failed to write proto file: %v", err)
+		}
+		paths = append(paths, fullPath)
 	}
+	sort.Strings(paths)
 
-	// Compile the proto file
-	cmd := exec.CommandContext(ctx, "protoc",
-		"--go_out="+outputDir,
-		"--go_opt=paths=source_relative",
-		"--go-grpc_out="+outputDir,
-		"--go-grpc_opt=paths=source_relative",
-		"--proto_path="+tmpDir,
-		proto.Name,
-	)
+	args := []string{"--proto_path=" + tmpDir}
 
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to compile proto: %v\nOutput: %s", err, output)
+	// Provide the well-known types from the bundled descriptors, so they do
+	// not have to be installed alongside protoc
+	wkt, err := wellKnownDescriptorSet(files)
+	if err != nil {
+		return err
+	}
+	if len(wkt.File) > 0 {
+		data, err := protov2.Marshal(wkt)
+		if err != nil {
+			return fmt.Errorf("failed to encode well-known types: %v", err)
+		}
+		wktPath := filepath.Join(tmpDir, "well-known-types.pb")
+		if err := ioutil.WriteFile(wktPath, data, 0644); err != nil {
+			return fmt.Errorf("failed to write well-known types: %v", err)
+		}
+		args = append(args, "--descriptor_set_in="+wktPath)
 	}
 
+	// Compile the whole import closure in one run per target
+	for _, want := range pending {
+		if err := l.compileTarget(ctx, want, append(args, paths...)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (l *ProtoLoader) GetCompiledProtoPath(id int64) (string, error) {
-	outputDir := filepath.Join(l.compiledDir, fmt.Sprintf("proto_%d", id))
-	if _, err := os.Stat(outputDir); err != nil {
+// GetCompiledProtoPath returns the directory holding the code generated for
+// a target. Output without a manifest, or compiled from a version other than
+// the cached one, is reported as not found.
+func (l *ProtoLoader) GetCompiledProtoPath(id int64, target string) (string, error) {
+	if _, err := l.target(target); err != nil {
+		return "", err
+	}
+	outputDir := filepath.Join(l.compiledDirFor(id), target)
+	manifest, err := readManifest(outputDir)
+	if err != nil {
 		return "", fmt.Errorf("compiled proto not found: %v", err)
 	}
+	if manifest.ProtoID != id || manifest.Target != target {
+		return "", fmt.Errorf("compiled proto not found: manifest is for proto %d target %s", manifest.ProtoID, manifest.Target)
+	}
+	if cached := l.cached(cacheKey{id: id}); cached != nil && cached.Proto.Version != manifest.Version {
+		return "", fmt.Errorf("compiled proto is stale: compiled version %s, latest %s", manifest.Version, cached.Proto.Version)
+	}
+	touch(outputDir)
 	return outputDir, nil
 }
 
-// ListProtos returns a list of available proto definitions
+// ListProtos returns a page of available proto definitions. Use Protos to
+// iterate over all of them.
 func (l *ProtoLoader) ListProtos(ctx context.Context, namespace string, pageSize int32, lastSeenID int64) ([]*Proto, bool, int64, error) {
-	url := fmt.Sprintf("%s/api/v1/protos?page_size=%d&last_seen_id=%d", l.serverURL, pageSize, lastSeenID)
+	query := url.Values{
+		"page_size":    {strconv.Itoa(int(pageSize))},
+		"last_seen_id": {strconv.FormatInt(lastSeenID, 10)},
+	}
 	if namespace != "" {
-		url += "&namespace=" + namespace
+		query.Set("namespace", namespace)
 	}
+	reqURL := l.serverURL + "/api/v1/protos?" + query.Encode()
 
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
 	if err != nil {
 		return nil, false, 0, fmt.Errorf("failed to create request: %v", err)
 	}
@@ -189,11 +276,16 @@ func (l *ProtoLoader) ListProtos(ctx context.Context, namespace string, pageSize
 	return result.Protos, result.HasMore, result.LastID, nil
 }
 
-// ListNamespaces returns all available namespaces
+// ListNamespaces returns a page of available namespaces. Pages are numbered
+// from 1. Use Namespaces to iterate over all of them.
 func (l *ProtoLoader) ListNamespaces(ctx context.Context, pageSize int32, page int32) ([]string, bool, error) {
-	url := fmt.Sprintf("%s/api/v1/namespaces?page_size=%d&page=%d", l.serverURL, pageSize, page)
+	query := url.Values{
+		"page_size": {strconv.Itoa(int(pageSize))},
+		"page":      {strconv.Itoa(int(page))},
+	}
+	reqURL := l.serverURL + "/api/v1/namespaces?" + query.Encode()
 
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
 	if err != nil {
 		return nil, false, fmt.Errorf("failed to create request: %v", err)
 	}
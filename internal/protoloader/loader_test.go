@@ -2,6 +2,7 @@ package protoloader
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -15,7 +16,7 @@ func TestProtoLoader(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.URL.Path {
 		case "/api/v1/protos/1":
-			json.NewEncoder(w).Encode(Proto{
+			json.NewEncoder(w).Encode(signed(Proto{
 				ID:        1,
 				Namespace: "test",
 				Name:      "example.proto",
@@ -25,11 +26,11 @@ message Example {
   string name = 1;
 }`,
 				Version:   "v1",
-			})
+			}))
 		case "/api/v1/protos":
 			json.NewEncoder(w).Encode(map[string]interface{}{
 				"protos": []Proto{
-					{
+					signed(Proto{
 						ID:        1,
 						Namespace: "test",
 						Name:      "example.proto",
@@ -39,8 +40,8 @@ message Example {
   string name = 1;
 }`,
 						Version:   "v1",
-					},
-					{
+					}),
+					signed(Proto{
 						ID:        2,
 						Namespace: "test",
 						Name:      "example2.proto",
@@ -50,7 +51,7 @@ message Example2 {
   string name = 1;
 }`,
 						Version:   "v1",
-					},
+					}),
 				},
 				"has_more": false,
 				"last_id":  2,
@@ -81,6 +82,7 @@ message Example2 {
 	if err != nil {
 		t.Fatal(err)
 	}
+	loader.SetTrustAnchors(testRegistryKey.Public().(ed25519.PublicKey))
 
 	// Test GetProto
 	t.Run("GetProto", func(t *testing.T) {
@@ -155,7 +157,7 @@ message Example2 {
 			t.Fatal(err)
 		}
 
-		outputDir, err := loader.GetCompiledProtoPath(1)
+		outputDir, err := loader.GetCompiledProtoPath(1, TargetGo)
 		if err != nil {
 			t.Fatal(err)
 		}
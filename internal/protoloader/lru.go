@@ -0,0 +1,106 @@
+package protoloader
+
+import "container/list"
+
+// lruCache holds cache entries in memory and evicts the least recently used
+// ones beyond its limits. Entries of pinned protos are never evicted. It is
+// guarded by ProtoLoader.cacheMutex.
+type lruCache struct {
+	maxEntries int   // Zero means no limit
+	maxBytes   int64 // Zero means no limit
+	bytes      int64
+	items      map[cacheKey]*list.Element
+	order      *list.List // Most recently used at the front
+	pinned     map[int64]bool
+	onEvict    func(key cacheKey)
+}
+
+type lruItem struct {
+	key   cacheKey
+	entry *cacheEntry
+	size  int64
+}
+
+func newLRUCache(pinned map[int64]bool, onEvict func(key cacheKey)) *lruCache {
+	return &lruCache{
+		items:   make(map[cacheKey]*list.Element),
+		order:   list.New(),
+		pinned:  pinned,
+		onEvict: onEvict,
+	}
+}
+
+// get returns an entry and marks it as recently used
+func (c *lruCache) get(key cacheKey) (*cacheEntry, bool) {
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruItem).entry, true
+}
+
+// add inserts or replaces an entry and returns the number of entries evicted
+// to make room for it
+func (c *lruCache) add(key cacheKey, entry *cacheEntry) int {
+	item := &lruItem{key: key, entry: entry, size: entrySize(entry)}
+	if elem, ok := c.items[key]; ok {
+		c.bytes -= elem.Value.(*lruItem).size
+		elem.Value = item
+		c.order.MoveToFront(elem)
+	} else {
+		c.items[key] = c.order.PushFront(item)
+	}
+	c.bytes += item.size
+	return c.evict()
+}
+
+func (c *lruCache) remove(key cacheKey) {
+	if elem, ok := c.items[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+// clear drops every entry
+func (c *lruCache) clear() {
+	c.items = make(map[cacheKey]*list.Element)
+	c.order.Init()
+	c.bytes = 0
+}
+
+// evict drops least recently used entries until the cache is within its
+// limits, or only pinned entries are left
+func (c *lruCache) evict() int {
+	evicted := 0
+	elem := c.order.Back()
+	for elem != nil && c.over() {
+		prev := elem.Prev()
+		item := elem.Value.(*lruItem)
+		if !c.pinned[item.key.id] {
+			c.removeElement(elem)
+			if c.onEvict != nil {
+				c.onEvict(item.key)
+			}
+			evicted++
+		}
+		elem = prev
+	}
+	return evicted
+}
+
+func (c *lruCache) over() bool {
+	return (c.maxEntries > 0 && c.order.Len() > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes)
+}
+
+func (c *lruCache) removeElement(elem *list.Element) {
+	item := elem.Value.(*lruItem)
+	c.order.Remove(elem)
+	delete(c.items, item.key)
+	c.bytes -= item.size
+}
+
+// entrySize approximates the memory held by an entry
+func entrySize(entry *cacheEntry) int64 {
+	p := entry.Proto
+	return int64(len(p.Content) + len(p.Name) + len(p.Namespace) + len(p.Version) + len(entry.ETag))
+}
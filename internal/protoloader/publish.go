@@ -0,0 +1,278 @@
+package protoloader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hamba/avro/v2"
+)
+
+// ErrNoCertificate is returned by registry writes on a loader without a node
+// certificate, see SetCertificate
+var ErrNoCertificate = errors.New("no node certificate to sign registry writes with")
+
+// PublishOptions relax the checks PublishProto runs before uploading
+type PublishOptions struct {
+	// AllowBreaking publishes a version that breaks the wire format of the
+	// latest one
+	AllowBreaking bool
+
+	// SkipLint publishes a proto that does not follow the style rules
+	SkipLint bool
+}
+
+// PublishCheck is the outcome of the checks run on a proto before it is
+// published
+type PublishCheck struct {
+	Lint   []LintIssue   `json:"lint"`
+	Compat *CompatReport `json:"compat,omitempty"` // Nil for the first version
+}
+
+// failure returns why a check keeps a proto from being published, or an
+// empty string when it passes
+func (c *PublishCheck) failure(opts PublishOptions) string {
+	switch {
+	case !opts.SkipLint && len(c.Lint) > 0:
+		return fmt.Sprintf("%d lint issues", len(c.Lint))
+	case !opts.AllowBreaking && c.Compat != nil && c.Compat.WireBreaking:
+		return fmt.Sprintf("wire-breaking changes from version %s", c.Compat.OldVersion)
+	}
+	return ""
+}
+
+// CheckFailedError reports a proto PublishProto refused to upload. Check
+// holds the lint issues and compatibility report.
+type CheckFailedError struct {
+	Namespace string
+	Name      string
+	Version   string
+	Reason    string
+	Check     *PublishCheck
+}
+
+func (e *CheckFailedError) Error() string {
+	return fmt.Sprintf("check of %s/%s %s failed: %s", e.Namespace, e.Name, e.Version, e.Reason)
+}
+
+// RegistryError is a registry write refused by the registry, such as a
+// version that already exists or a namespace owned by another node
+type RegistryError struct {
+	Status  int
+	Message string
+}
+
+func (e *RegistryError) Error() string {
+	return fmt.Sprintf("registry returned status %d: %s", e.Status, e.Message)
+}
+
+// CheckProto runs the checks PublishProto runs before uploading a proto: it
+// has to parse, and its lint issues and the changes from the latest version
+// of the same namespace and name are reported. Avro schemas are not linted,
+// and are compatible when the new schema can read data written with the
+// latest one.
+func (l *ProtoLoader) CheckProto(ctx context.Context, p *Proto) (*PublishCheck, error) {
+	if p.Namespace == "" || p.Version == "" {
+		return nil, errors.New("namespace and version are required")
+	}
+	candidate := Proto{Namespace: p.Namespace, Name: p.Name, Version: p.Version, Content: p.Content}
+	if err := checkProto(&candidate, l.compileLimits()); err != nil {
+		return nil, err
+	}
+
+	latest, err := l.FindProto(ctx, p.Namespace, p.Name)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		latest = nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to get latest version: %w", err)
+	default:
+		// Compare against what the registry holds now, not a cached copy
+		if latest, err = l.Refresh(ctx, latest.ID); err != nil {
+			return nil, fmt.Errorf("failed to get latest version: %w", err)
+		}
+		if latest.Version == p.Version {
+			return nil, fmt.Errorf("version %s of %s/%s already exists", p.Version, p.Namespace, p.Name)
+		}
+		candidate.ID = latest.ID
+	}
+
+	check := &PublishCheck{Lint: []LintIssue{}}
+	var report *CompatReport
+	if latest != nil {
+		report = &CompatReport{
+			ID:         latest.ID,
+			Name:       p.Name,
+			OldVersion: latest.Version,
+			NewVersion: p.Version,
+			Changes:    []Change{},
+		}
+	}
+
+	if candidate.IsAvro() {
+		schema, err := ParseAvroSchema(&candidate)
+		if err != nil {
+			return nil, err
+		}
+		if report != nil {
+			old, err := ParseAvroSchema(latest)
+			if err != nil {
+				return nil, err
+			}
+			if err := avro.NewSchemaCompatibility().Compatible(schema.Schema, old.Schema); err != nil {
+				report.Changes = append(report.Changes, Change{
+					Severity: WireBreaking,
+					Element:  p.Name,
+					Message:  fmt.Sprintf("cannot read data written with version %s: %v", latest.Version, err),
+				})
+			}
+		}
+	} else {
+		fd, err := l.parseProto(ctx, &candidate)
+		if err != nil {
+			return nil, err
+		}
+		check.Lint = Lint(fd)
+		if report != nil {
+			old, err := l.parseProto(ctx, latest)
+			if err != nil {
+				return nil, err
+			}
+			report.Changes = CompareDescriptors(old, fd)
+		}
+	}
+	if report != nil {
+		report.classify()
+		check.Compat = report
+	}
+	return check, nil
+}
+
+// PublishProto uploads a new proto, or a new version of the proto with the
+// same namespace and name, and returns it as stored by the registry with its
+// ID and signature. The namespace has to exist, see CreateNamespace.
+//
+// The proto is checked with CheckProto first. Lint issues and changes that
+// break the wire format of the latest version are refused with a
+// CheckFailedError unless opts allow them. The request is signed with the
+// node certificate, see SetCertificate.
+func (l *ProtoLoader) PublishProto(ctx context.Context, p *Proto, opts PublishOptions) (*Proto, error) {
+	check, err := l.CheckProto(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if reason := check.failure(opts); reason != "" {
+		return nil, &CheckFailedError{Namespace: p.Namespace, Name: p.Name, Version: p.Version, Reason: reason, Check: check}
+	}
+
+	request := struct {
+		Namespace string `json:"namespace"`
+		Name      string `json:"name"`
+		Version   string `json:"version"`
+		Content   string `json:"content"`
+	}{p.Namespace, p.Name, p.Version, p.Content}
+	var published Proto
+	if err := l.signedPost(ctx, "/api/v1/protos", request, &published); err != nil {
+		return nil, fmt.Errorf("failed to publish %s/%s: %w", p.Namespace, p.Name, err)
+	}
+	if published.Namespace != p.Namespace || published.Name != p.Name ||
+		published.Version != p.Version || published.Content != p.Content {
+		return nil, &IntegrityError{ID: published.ID, Version: published.Version, Reason: "registry stored a different proto than was published"}
+	}
+	if err := l.verify(&published); err != nil {
+		return nil, err
+	}
+
+	l.storeLatest(&cacheEntry{Proto: &published, FetchedAt: time.Now()})
+	l.cacheMutex.Lock()
+	l.nameIndex[p.Namespace+"/"+p.Name] = published.ID
+	l.cacheMutex.Unlock()
+	return &published, nil
+}
+
+// DeprecateProto marks a proto as deprecated for reason. It stays available,
+// with the reason in its Deprecated field.
+func (l *ProtoLoader) DeprecateProto(ctx context.Context, id int64, reason string) error {
+	if reason == "" {
+		return errors.New("a reason is required to deprecate a proto")
+	}
+	request := struct {
+		Reason string `json:"reason"`
+	}{reason}
+	if err := l.signedPost(ctx, fmt.Sprintf("/api/v1/protos/%d/deprecate", id), request, nil); err != nil {
+		return fmt.Errorf("failed to deprecate proto %d: %w", id, err)
+	}
+	l.Invalidate(id)
+	return nil
+}
+
+// CreateNamespace creates a namespace owned by this node. Only its owner
+// can publish to it and deprecate its protos.
+func (l *ProtoLoader) CreateNamespace(ctx context.Context, name string) error {
+	if !validImportPath(name) {
+		return fmt.Errorf("invalid namespace %q", name)
+	}
+	request := struct {
+		Name string `json:"name"`
+	}{name}
+	if err := l.signedPost(ctx, "/api/v1/namespaces", request, nil); err != nil {
+		return fmt.Errorf("failed to create namespace %s: %w", name, err)
+	}
+	return nil
+}
+
+// signedPost sends a registry write signed with the node certificate and
+// decodes the response into out, unless it is nil
+func (l *ProtoLoader) signedPost(ctx context.Context, path string, body, out interface{}) error {
+	l.cacheMutex.RLock()
+	source := l.nodeCert
+	l.cacheMutex.RUnlock()
+	if source == nil {
+		return ErrNoCertificate
+	}
+	cert, err := source()
+	if err != nil {
+		return fmt.Errorf("failed to get node certificate: %v", err)
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to encode request: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", l.serverURL+path, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := SignRequest(req, data, cert); err != nil {
+		return err
+	}
+
+	resp, err := l.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach registry: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var result struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		if result.Error == "" {
+			result.Error = http.StatusText(resp.StatusCode)
+		}
+		return &RegistryError{Status: resp.StatusCode, Message: result.Error}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
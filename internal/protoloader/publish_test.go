@@ -0,0 +1,269 @@
+package protoloader_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qnepff/qne-node-v12/internal/certmanager"
+	"github.com/qnepff/qne-node-v12/internal/gatewaytest"
+	"github.com/qnepff/qne-node-v12/internal/protoloader"
+)
+
+// nodeCertificate issues a certificate for a node from a CA
+func nodeCertificate(t *testing.T, ca *gatewaytest.CA, name string) *tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: name}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := ca.Issue(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := certmanager.ParseCertificate(chain, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestPublish(t *testing.T) {
+	gateway, url := gatewaytest.NewServer(t, gatewaytest.Config{})
+	ctx := context.Background()
+	newLoader := func(t *testing.T, cert *tls.Certificate) *protoloader.ProtoLoader {
+		t.Helper()
+		loader, err := protoloader.New(url, t.TempDir(), t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		loader.SetTrustAnchors(gateway.RegistryKey())
+		if cert != nil {
+			loader.SetCertificate(func() (*tls.Certificate, error) { return cert, nil })
+		}
+		return loader
+	}
+	owner := newLoader(t, nodeCertificate(t, gateway.CA(), "quiet-fox"))
+
+	const v1 = `syntax = "proto3";
+package qne.teams;
+message Member {
+  string name = 1;
+  int32 role = 2;
+}
+`
+	proto := func(version, content string) *protoloader.Proto {
+		return &protoloader.Proto{Namespace: "teams", Name: "member.proto", Version: version, Content: content}
+	}
+	var registryErr *protoloader.RegistryError
+
+	t.Run("CreateNamespace", func(t *testing.T) {
+		if err := owner.CreateNamespace(ctx, "teams"); err != nil {
+			t.Fatal(err)
+		}
+		if err := owner.CreateNamespace(ctx, "teams"); !errors.As(err, &registryErr) || registryErr.Status != http.StatusConflict {
+			t.Errorf("expected an existing namespace to conflict, got %v", err)
+		}
+		if err := owner.CreateNamespace(ctx, "../teams"); err == nil {
+			t.Error("expected an invalid namespace to be refused")
+		}
+	})
+
+	var published *protoloader.Proto
+	t.Run("First", func(t *testing.T) {
+		check, err := owner.CheckProto(ctx, proto("v1", v1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(check.Lint) != 0 || check.Compat != nil {
+			t.Errorf("expected a clean first version, got %+v", check)
+		}
+		published, err = owner.PublishProto(ctx, proto("v1", v1), protoloader.PublishOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if published.ID == 0 || published.Signature == "" {
+			t.Errorf("expected the registry to assign an ID and sign, got %+v", published)
+		}
+		found, err := owner.FindProto(ctx, "teams", "member.proto")
+		if err != nil || found.ID != published.ID || found.Version != "v1" {
+			t.Errorf("expected to find the published proto, got %+v, %v", found, err)
+		}
+		if _, err := owner.PublishProto(ctx, proto("v1", v1), protoloader.PublishOptions{}); err == nil {
+			t.Error("expected publishing an existing version to fail")
+		}
+	})
+
+	t.Run("Lint", func(t *testing.T) {
+		content := strings.Replace(v1, "string name = 1;", "string displayName = 1;", 1)
+		_, err := owner.PublishProto(ctx, proto("v2", content), protoloader.PublishOptions{})
+		var checkErr *protoloader.CheckFailedError
+		if !errors.As(err, &checkErr) || len(checkErr.Check.Lint) != 1 ||
+			checkErr.Check.Lint[0].String() != "Member.displayName: field name should be lower_snake_case" {
+			t.Fatalf("expected a lint failure, got %v", err)
+		}
+	})
+
+	t.Run("Breaking", func(t *testing.T) {
+		content := strings.Replace(v1, "int32 role = 2;", "string role = 2;", 1)
+		_, err := owner.PublishProto(ctx, proto("v2", content), protoloader.PublishOptions{})
+		var checkErr *protoloader.CheckFailedError
+		if !errors.As(err, &checkErr) || checkErr.Check.Compat == nil || !checkErr.Check.Compat.WireBreaking {
+			t.Fatalf("expected a wire-breaking change to be refused, got %v", err)
+		}
+		p, err := owner.PublishProto(ctx, proto("v2", content), protoloader.PublishOptions{AllowBreaking: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.ID != published.ID || p.Version != "v2" {
+			t.Errorf("expected version v2 of proto %d, got %+v", published.ID, p)
+		}
+		latest, err := owner.GetProto(ctx, published.ID)
+		if err != nil || latest.Version != "v2" {
+			t.Errorf("expected v2 to be the latest version, got %+v, %v", latest, err)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		if _, err := owner.PublishProto(ctx, proto("v3", "syntax = \"proto3\";\nmessage {"), protoloader.PublishOptions{}); err == nil {
+			t.Error("expected a proto that does not parse to be refused")
+		}
+		bad := proto("v1", v1)
+		bad.Name = "../member.proto"
+		var rejected *protoloader.RejectedError
+		if _, err := owner.PublishProto(ctx, bad, protoloader.PublishOptions{}); !errors.As(err, &rejected) {
+			t.Errorf("expected an invalid name to be rejected, got %v", err)
+		}
+		missing := proto("v1", v1)
+		missing.Namespace = "missing"
+		if _, err := owner.PublishProto(ctx, missing, protoloader.PublishOptions{}); !errors.As(err, &registryErr) || registryErr.Status != http.StatusNotFound {
+			t.Errorf("expected an unknown namespace to be refused, got %v", err)
+		}
+	})
+
+	t.Run("Deprecate", func(t *testing.T) {
+		if err := owner.DeprecateProto(ctx, published.ID, "use teams/person.proto"); err != nil {
+			t.Fatal(err)
+		}
+		p, err := owner.GetProto(ctx, published.ID)
+		if err != nil || p.Deprecated != "use teams/person.proto" {
+			t.Errorf("expected the proto to be deprecated, got %+v, %v", p, err)
+		}
+		if err := owner.DeprecateProto(ctx, 999, "gone"); !errors.As(err, &registryErr) || registryErr.Status != http.StatusNotFound {
+			t.Errorf("expected an unknown proto to be refused, got %v", err)
+		}
+	})
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		anonymous := newLoader(t, nil)
+		if err := anonymous.CreateNamespace(ctx, "anonymous"); !errors.Is(err, protoloader.ErrNoCertificate) {
+			t.Errorf("expected writes without a certificate to fail, got %v", err)
+		}
+
+		other := newLoader(t, nodeCertificate(t, gateway.CA(), "brave-owl"))
+		if err := other.DeprecateProto(ctx, published.ID, "mine now"); !errors.As(err, &registryErr) || registryErr.Status != http.StatusForbidden {
+			t.Errorf("expected another node to be refused, got %v", err)
+		}
+
+		foreignCA, err := gatewaytest.NewCA()
+		if err != nil {
+			t.Fatal(err)
+		}
+		untrusted := newLoader(t, nodeCertificate(t, foreignCA, "quiet-fox"))
+		if err := untrusted.CreateNamespace(ctx, "untrusted"); !errors.As(err, &registryErr) || registryErr.Status != http.StatusUnauthorized {
+			t.Errorf("expected a certificate from another CA to be refused, got %v", err)
+		}
+
+		// A signature does not carry over to another body
+		body := []byte(`{"name":"signed"}`)
+		req, _ := http.NewRequest("POST", url+"/api/v1/namespaces", bytes.NewReader([]byte(`{"name":"tampered"}`)))
+		if err := protoloader.SignRequest(req, body, nodeCertificate(t, gateway.CA(), "quiet-fox")); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected a tampered request to be refused, got status %d", resp.StatusCode)
+		}
+
+		// A signed request is accepted once
+		body = []byte(`{"name":"replayed"}`)
+		req, _ = http.NewRequest("POST", url+"/api/v1/namespaces", bytes.NewReader(body))
+		if err := protoloader.SignRequest(req, body, nodeCertificate(t, gateway.CA(), "quiet-fox")); err != nil {
+			t.Fatal(err)
+		}
+		for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+			replay := req.Clone(ctx)
+			replay.Body = io.NopCloser(bytes.NewReader(body))
+			resp, err := http.DefaultClient.Do(replay)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != want {
+				t.Errorf("request %d: expected status %d, got %d", i+1, want, resp.StatusCode)
+			}
+		}
+	})
+}
+
+func TestLint(t *testing.T) {
+	gateway, url := gatewaytest.NewServer(t, gatewaytest.Config{})
+	loader, err := protoloader.New(url, t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	loader.SetTrustAnchors(gateway.RegistryKey())
+	gateway.AddProto(protoloader.Proto{ID: 1, Namespace: "lint", Name: "lint.proto", Version: "v1", Content: `syntax = "proto3";
+message chat_message {
+  string Text = 1;
+  map<string, int32> counts = 2;
+  enum state {
+    Open = 0;
+  }
+}
+service chat {
+  rpc send(chat_message) returns (chat_message);
+}
+`})
+	fd, err := loader.FileDescriptor(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var issues []string
+	for _, issue := range protoloader.Lint(fd) {
+		issues = append(issues, issue.String())
+	}
+	expected := []string{
+		"no package declared",
+		"chat_message: message name should be UpperCamelCase",
+		"chat_message.Text: field name should be lower_snake_case",
+		"chat_message.state: enum name should be UpperCamelCase",
+		"chat_message.Open: enum value name should be UPPER_SNAKE_CASE",
+		"chat_message.Open: zero value of enum state should end in _UNSPECIFIED",
+		"chat: service name should be UpperCamelCase",
+		"chat.send: method name should be UpperCamelCase",
+	}
+	if strings.Join(issues, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected lint issues:\n%s", strings.Join(issues, "\n"))
+	}
+}
@@ -0,0 +1,105 @@
+package protoloader
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// CompileLimits bounds what CompileProto and the pure-Go parser accept from
+// the registry, and the resources protoc may use. Zero values mean no limit.
+type CompileLimits struct {
+	MaxContentSize int           // Bytes of a single proto file
+	MaxFiles       int           // Files in an import closure
+	Timeout        time.Duration // Run time of one protoc invocation
+	MaxMemory      int64         // Data segment of protoc and its plugins, where supported
+}
+
+// DefaultCompileLimits are the limits of a new loader
+var DefaultCompileLimits = CompileLimits{
+	MaxContentSize: 1 << 20,
+	MaxFiles:       256,
+	Timeout:        2 * time.Minute,
+	MaxMemory:      1 << 30,
+}
+
+// maxNameLen bounds proto names and each segment of a namespace
+const maxNameLen = 128
+
+// namePattern matches proto names and namespace segments. Names cannot
+// start with a dot or a dash, so they never climb out of a directory or
+// read as a flag.
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// RejectedError reports a registry proto refused before it reaches the file
+// system or protoc, because of its name, namespace or size
+type RejectedError struct {
+	ID     int64
+	Name   string
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("proto %d (%q) rejected: %s", e.ID, e.Name, e.Reason)
+}
+
+// SetCompileLimits changes the limits applied by later compilations
+func (l *ProtoLoader) SetCompileLimits(limits CompileLimits) {
+	l.cacheMutex.Lock()
+	defer l.cacheMutex.Unlock()
+	l.compileLimit = limits
+}
+
+func (l *ProtoLoader) compileLimits() CompileLimits {
+	l.cacheMutex.RLock()
+	defer l.cacheMutex.RUnlock()
+	return l.compileLimit
+}
+
+// checkProto validates what the registry sent for a proto before its name is
+// used as a path or its content is parsed
+func checkProto(p *Proto, limits CompileLimits) error {
+	reject := func(format string, args ...interface{}) error {
+		return &RejectedError{ID: p.ID, Name: p.Name, Reason: fmt.Sprintf(format, args...)}
+	}
+	if !validName(p.Name) {
+		return reject("invalid name")
+	}
+	if p.Namespace != "" && !validImportPath(p.Namespace) {
+		return reject("invalid namespace %q", p.Namespace)
+	}
+	if limits.MaxContentSize > 0 && len(p.Content) > limits.MaxContentSize {
+		return reject("content of %d bytes exceeds the limit of %d", len(p.Content), limits.MaxContentSize)
+	}
+	return nil
+}
+
+func validName(name string) bool {
+	return len(name) <= maxNameLen && namePattern.MatchString(name) && !strings.Contains(name, "..")
+}
+
+// validImportPath reports whether every slash separated segment of a path is
+// a valid name
+func validImportPath(p string) bool {
+	for _, segment := range strings.Split(p, "/") {
+		if !validName(segment) {
+			return false
+		}
+	}
+	return true
+}
+
+// sandboxPath returns where a file of an import closure is written below
+// root, or an error if its import path would land outside of root
+func sandboxPath(root, importPath string) (string, error) {
+	if !validImportPath(importPath) {
+		return "", fmt.Errorf("invalid import path %q", importPath)
+	}
+	full := filepath.Join(root, filepath.FromSlash(importPath))
+	if rel, err := filepath.Rel(root, full); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("import path %q escapes the sandbox", importPath)
+	}
+	return full, nil
+}
@@ -0,0 +1,148 @@
+package protoloader
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHostileProtos(t *testing.T) {
+	const content = "syntax = \"proto3\";\nmessage Example {}\n"
+	server := newTestRegistry(t,
+		Proto{ID: 1, Namespace: "test", Name: "../../escaped.proto", Version: "v1", Content: content},
+		Proto{ID: 2, Namespace: "test", Name: "--plugin=protoc-gen-evil", Version: "v1", Content: content},
+		Proto{ID: 3, Namespace: "../etc", Name: "example.proto", Version: "v1", Content: content},
+		Proto{ID: 4, Namespace: "test", Name: "big.proto", Version: "v1", Content: content + strings.Repeat("//", 1<<20)},
+		Proto{ID: 5, Namespace: "test", Name: "climb.proto", Version: "v1",
+			Content: "syntax = \"proto3\";\nimport \"../../../tmp/x.proto\";\n"},
+		Proto{ID: 6, Namespace: "test", Name: "flag.proto", Version: "v1",
+			Content: "syntax = \"proto3\";\nimport \"-I/etc/x.proto\";\n"},
+		Proto{ID: 7, Namespace: "test", Name: ".hidden.proto", Version: "v1", Content: content},
+		Proto{ID: 8, Namespace: "test", Name: "a.proto", Version: "v1",
+			Content: "syntax = \"proto3\";\nimport \"b.proto\";\n"},
+		Proto{ID: 9, Namespace: "test", Name: "b.proto", Version: "v1", Content: content},
+	)
+	ctx := context.Background()
+
+	t.Run("Rejected", func(t *testing.T) {
+		loader := newTestLoader(t, server.URL)
+		for _, id := range []int64{1, 2, 3, 4, 7} {
+			var rejected *RejectedError
+			if err := loader.CompileProto(ctx, id); !errors.As(err, &rejected) || rejected.ID != id {
+				t.Errorf("proto %d: expected a rejection from CompileProto, got %v", id, err)
+			}
+			if _, err := loader.FileDescriptor(ctx, id); !errors.As(err, &rejected) {
+				t.Errorf("proto %d: expected a rejection from FileDescriptor, got %v", id, err)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(os.TempDir(), "escaped.proto")); err == nil {
+			t.Error("proto written outside of the sandbox")
+		}
+	})
+
+	t.Run("HostileImports", func(t *testing.T) {
+		loader := newTestLoader(t, server.URL)
+		for _, id := range []int64{5, 6} {
+			var importErr *ImportError
+			if err := loader.CompileProto(ctx, id); !errors.As(err, &importErr) {
+				t.Errorf("proto %d: expected an import error, got %v", id, err)
+			}
+		}
+	})
+
+	t.Run("MaxFiles", func(t *testing.T) {
+		loader := newTestLoader(t, server.URL)
+		limits := DefaultCompileLimits
+		limits.MaxFiles = 1
+		loader.SetCompileLimits(limits)
+		var rejected *RejectedError
+		if _, err := loader.FileDescriptor(ctx, 8); !errors.As(err, &rejected) || rejected.ID != 8 {
+			t.Errorf("expected an import closure over the limit to be rejected, got %v", err)
+		}
+		limits.MaxFiles = 2
+		loader.SetCompileLimits(limits)
+		if _, err := loader.FileDescriptor(ctx, 8); err != nil {
+			t.Errorf("expected a closure within the limit to parse: %v", err)
+		}
+	})
+
+	t.Run("SandboxPath", func(t *testing.T) {
+		root := t.TempDir()
+		for _, p := range []string{"../x.proto", "a/../../x.proto", "/etc/x.proto", "-x.proto", "a/.b/x.proto", ""} {
+			if _, err := sandboxPath(root, p); err == nil {
+				t.Errorf("expected %q to be refused", p)
+			}
+		}
+		if full, err := sandboxPath(root, "chat/v1/message.proto"); err != nil || full != filepath.Join(root, "chat", "v1", "message.proto") {
+			t.Errorf("unexpected path %s: %v", full, err)
+		}
+	})
+}
+
+// fakeProtoc puts a protoc on PATH recording its arguments and data segment
+// limit in the returned file, sleeping for sleep first
+func fakeProtoc(t *testing.T, sleep string) (record string) {
+	t.Helper()
+	dir := t.TempDir()
+	record = filepath.Join(dir, "record")
+	script := `#!/bin/sh
+[ "$1" = "--version" ] && { echo "libprotoc 25.1"; exit 0; }
+sleep ` + sleep + `
+{ ulimit -d; printf '%s\n' "$@"; } > "` + record + `"
+`
+	if err := os.WriteFile(filepath.Join(dir, "protoc"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return record
+}
+
+func TestProtocLimits(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake protoc is a shell script")
+	}
+	server := newTestRegistry(t, Proto{ID: 1, Namespace: "test", Name: "example.proto", Version: "v1",
+		Content: "syntax = \"proto3\";\nmessage Example {}\n"})
+	ctx := context.Background()
+
+	t.Run("Arguments", func(t *testing.T) {
+		record := fakeProtoc(t, "0")
+		loader := newTestLoader(t, server.URL)
+		if err := loader.CompileProto(ctx, 1, TargetPython); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if lines[0] != "1048576" {
+			t.Errorf("expected a 1 GiB data segment limit, got %s KiB", lines[0])
+		}
+		file := lines[len(lines)-1]
+		if !filepath.IsAbs(file) || filepath.Base(file) != "example.proto" {
+			t.Errorf("expected the proto as an absolute path, got %s", file)
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		fakeProtoc(t, "10")
+		loader := newTestLoader(t, server.URL)
+		limits := DefaultCompileLimits
+		limits.Timeout = 200 * time.Millisecond
+		loader.SetCompileLimits(limits)
+		start := time.Now()
+		err := loader.CompileProto(ctx, 1, TargetPython)
+		if err == nil || !strings.Contains(err.Error(), "ran longer than") {
+			t.Errorf("expected a timeout, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("protoc was not stopped, took %v", elapsed)
+		}
+	})
+}
@@ -0,0 +1,130 @@
+package protoloader
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Names of the built-in code generation targets
+const (
+	TargetGo            = "go"
+	TargetTypeScript    = "ts"
+	TargetProtobufES    = "es"
+	TargetPython        = "python"
+	TargetDescriptorSet = "descriptor-set"
+)
+
+// DescriptorSetFile is the file written by the descriptor set target
+const DescriptorSetFile = "descriptor_set.pb"
+
+// Target is a kind of output CompileProto can generate. Each target is
+// compiled into its own subdirectory of a proto's compiled directory.
+type Target struct {
+	// Name identifies the target and names its output subdirectory
+	Name string
+
+	// Args returns the protoc flags writing the target's output into dir
+	Args func(dir string) []string
+
+	// Plugins are the protoc plugins the target runs. Their versions are
+	// recorded so output is regenerated when they change.
+	Plugins []string
+}
+
+// builtinTargets returns the targets every loader knows
+func builtinTargets() map[string]Target {
+	targets := []Target{
+		{
+			Name: TargetGo,
+			Args: func(dir string) []string {
+				return []string{
+					"--go_out=" + dir,
+					"--go_opt=paths=source_relative",
+					"--go-grpc_out=" + dir,
+					"--go-grpc_opt=paths=source_relative",
+				}
+			},
+			Plugins: []string{"protoc-gen-go", "protoc-gen-go-grpc"},
+		},
+		{
+			// Types and codecs in the style of ts-proto
+			Name: TargetTypeScript,
+			Args: func(dir string) []string {
+				return []string{
+					"--ts_proto_out=" + dir,
+					"--ts_proto_opt=esModuleInterop=true,outputJsonMethods=true,useOptionals=messages",
+				}
+			},
+			Plugins: []string{"protoc-gen-ts_proto"},
+		},
+		{
+			// TypeScript in the style of protobuf-es
+			Name: TargetProtobufES,
+			Args: func(dir string) []string {
+				return []string{"--es_out=" + dir, "--es_opt=target=ts"}
+			},
+			Plugins: []string{"protoc-gen-es"},
+		},
+		{
+			// Generated by protoc itself, with type stubs
+			Name: TargetPython,
+			Args: func(dir string) []string {
+				return []string{"--python_out=" + dir, "--pyi_out=" + dir}
+			},
+		},
+		{
+			Name: TargetDescriptorSet,
+			Args: func(dir string) []string {
+				return []string{
+					"--descriptor_set_out=" + filepath.Join(dir, DescriptorSetFile),
+					"--include_imports",
+					"--include_source_info",
+				}
+			},
+		},
+	}
+	byName := make(map[string]Target, len(targets))
+	for _, t := range targets {
+		byName[t.Name] = t
+	}
+	return byName
+}
+
+// RegisterTarget adds a target to the loader, or replaces the one with the
+// same name
+func (l *ProtoLoader) RegisterTarget(t Target) error {
+	if t.Name == "" || strings.ContainsAny(t.Name, `/\`) || strings.HasPrefix(t.Name, ".") {
+		return fmt.Errorf("invalid target name %q", t.Name)
+	}
+	if t.Args == nil {
+		return fmt.Errorf("target %s has no protoc arguments", t.Name)
+	}
+	l.cacheMutex.Lock()
+	defer l.cacheMutex.Unlock()
+	l.targets[t.Name] = t
+	return nil
+}
+
+// Targets returns the names of the loader's targets
+func (l *ProtoLoader) Targets() []string {
+	l.cacheMutex.RLock()
+	defer l.cacheMutex.RUnlock()
+	names := make([]string, 0, len(l.targets))
+	for name := range l.targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (l *ProtoLoader) target(name string) (Target, error) {
+	l.cacheMutex.RLock()
+	defer l.cacheMutex.RUnlock()
+	t, ok := l.targets[name]
+	if !ok {
+		return Target{}, fmt.Errorf("unknown target %q", name)
+	}
+	return t, nil
+}
@@ -2,15 +2,44 @@ package rest
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
 	"net/http"
+	"strconv"
 	"time"
 )
 
+const requestIDHeader = "X-Request-ID"
+
 type Client struct {
 	baseURL    string
 	httpClient *http.Client
+	retry      RetryPolicy
+}
+
+// RetryPolicy controls how failed requests are retried. Network errors, 5xx
+// and 429 responses are retried with exponential backoff and full jitter.
+// Registration is not idempotent, so it is only sent again after a network
+// error when the connection to the gateway was never made.
+type RetryPolicy struct {
+	MaxAttempts   int           // Total attempts including the first one
+	BaseDelay     time.Duration // Backoff before the second attempt
+	MaxDelay      time.Duration // Upper bound for a single backoff
+	MaxRetryAfter time.Duration // Upper bound for a server-requested Retry-After
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:   5,
+	BaseDelay:     500 * time.Millisecond,
+	MaxDelay:      30 * time.Second,
+	MaxRetryAfter: 2 * time.Minute,
 }
 
 type SegmentRegistrationRequest struct {
@@ -28,87 +57,268 @@ type CertificateRequest struct {
 	NodeID    int64  `json:"node_id"`
 	NodeName  string `json:"node_name"`
 	SegmentID string `json:"segment_id"`
+	CSR       string `json:"csr,omitempty"` // PEM encoded certificate signing request for the node key
 }
 
 type CertificateResponse struct {
-	Certificate string `json:"certificate"`
+	Certificate string `json:"certificate"` // PEM encoded certificate, followed by any intermediates
 	Success     bool   `json:"success"`
 }
 
+type HeartbeatRequest struct {
+	NodeID     int64      `json:"node_id"`
+	NodeName   string     `json:"node_name"`
+	SegmentID  string     `json:"segment_id"`
+	PublicAddr string     `json:"public_addr"` // HTTPS address, host may be empty to use the observed address
+	NoiseAddr  string     `json:"noise_addr"`  // Noise UDP address, host may be empty as above
+	Protocols  []string   `json:"protocols"`   // Supported protocol versions, e.g. h3 or the Noise protocol name
+	Load       LoadReport `json:"load"`
+}
+
+// LoadReport describes how busy the node currently is
+type LoadReport struct {
+	Connections  int `json:"connections"`   // Open WebSocket signaling connections
+	PeerSessions int `json:"peer_sessions"` // Established Noise sessions
+	Requests     int `json:"requests"`      // HTTP requests in flight
+	Goroutines   int `json:"goroutines"`
+}
+
+type HeartbeatResponse struct {
+	Interval int  `json:"interval,omitempty"` // Seconds until the next heartbeat is expected, 0 keeps the current interval
+	Success  bool `json:"success"`
+}
+
+type DeregisterRequest struct {
+	NodeID    int64  `json:"node_id"`
+	NodeName  string `json:"node_name"`
+	SegmentID string `json:"segment_id"`
+}
+
+type DeregisterResponse struct {
+	Success bool `json:"success"`
+}
+
+// successResponse is implemented by responses carrying a Success flag
+type successResponse interface {
+	succeeded() bool
+}
+
+func (r *SegmentRegistrationResponse) succeeded() bool { return r.Success }
+func (r *CertificateResponse) succeeded() bool         { return r.Success }
+func (r *HeartbeatResponse) succeeded() bool           { return r.Success }
+func (r *DeregisterResponse) succeeded() bool          { return r.Success }
+
 func NewClient(baseURL string) *Client {
 	return &Client{
 		baseURL: baseURL,
 		httpClient: &http.Client{
 			Timeout: 30 * time.Second,
 		},
+		retry: DefaultRetryPolicy,
 	}
 }
 
-// RegisterInSegment registers with the gateway to get assigned to a segment and receive a node ID and temporary name
-func (c *Client) RegisterInSegment() (*SegmentRegistrationResponse, error) {
-	reqBody := SegmentRegistrationRequest{}
-	
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %v", err)
-	}
-
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/v1/segment/register", c.baseURL), bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %v", err)
+// SetRetryPolicy replaces the retry policy used for all requests
+func (c *Client) SetRetryPolicy(p RetryPolicy) {
+	if p.MaxAttempts < 1 {
+		p.MaxAttempts = 1
 	}
-	defer resp.Body.Close()
+	c.retry = p
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
-	}
+// RegisterInSegment registers with the gateway to get assigned to a segment and receive a node ID and temporary name
+func (c *Client) RegisterInSegment() (*SegmentRegistrationResponse, error) {
+	return c.RegisterInSegmentContext(context.Background())
+}
 
+// RegisterInSegmentContext is like RegisterInSegment but honours ctx for
+// cancellation, including while waiting between retries
+func (c *Client) RegisterInSegmentContext(ctx context.Context) (*SegmentRegistrationResponse, error) {
 	var response SegmentRegistrationResponse
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %v", err)
+	if err := c.post(ctx, "/api/v1/segment/register", false, SegmentRegistrationRequest{}, &response); err != nil {
+		return nil, err
 	}
-
 	return &response, nil
 }
 
 func (c *Client) GetQNECertificate(nodeID int64, nodeName, segmentID string) (*CertificateResponse, error) {
-	reqBody := CertificateRequest{
+	return c.GetQNECertificateContext(context.Background(), nodeID, nodeName, segmentID)
+}
+
+// GetQNECertificateContext is like GetQNECertificate but honours ctx
+func (c *Client) GetQNECertificateContext(ctx context.Context, nodeID int64, nodeName, segmentID string) (*CertificateResponse, error) {
+	return c.RequestQNECertificateContext(ctx, CertificateRequest{
 		NodeID:    nodeID,
 		NodeName:  nodeName,
 		SegmentID: segmentID,
+	})
+}
+
+// RequestQNECertificateContext asks the gateway to issue a certificate. When
+// req carries a CSR the certificate is issued for the key in the CSR, which is
+// also how an expiring certificate is renewed.
+func (c *Client) RequestQNECertificateContext(ctx context.Context, req CertificateRequest) (*CertificateResponse, error) {
+	var response CertificateResponse
+	if err := c.post(ctx, "/api/v1/certificate", true, req, &response); err != nil {
+		return nil, err
 	}
-	
+	return &response, nil
+}
+
+// HeartbeatContext reports that the node is alive along with its addresses,
+// protocols and load. A node the gateway no longer knows gets an error for
+// which IsUnknownNode is true.
+func (c *Client) HeartbeatContext(ctx context.Context, req HeartbeatRequest) (*HeartbeatResponse, error) {
+	var response HeartbeatResponse
+	if err := c.post(ctx, "/api/v1/node/heartbeat", true, req, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// DeregisterContext tells the gateway the node is going offline
+func (c *Client) DeregisterContext(ctx context.Context, req DeregisterRequest) error {
+	var response DeregisterResponse
+	return c.post(ctx, "/api/v1/node/deregister", true, req, &response)
+}
+
+// post sends a JSON request and decodes the JSON response, retrying according
+// to the client's retry policy. Failures reported by the gateway are returned
+// as *APIError. A request that is not idempotent is not sent again when the
+// gateway may already have processed it.
+func (c *Client) post(ctx context.Context, path string, idempotent bool, reqBody interface{}, respBody successResponse) error {
 	jsonData, err := json.Marshal(reqBody)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %v", err)
+		return fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	requestID := newRequestID()
+
+	var (
+		lastErr error
+		after   time.Duration
+	)
+	for attempt := 0; attempt < c.retry.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, c.backoff(attempt, after)); err != nil {
+				return fmt.Errorf("%w (last error: %v)", err, lastErr)
+			}
+		}
+
+		var retryable bool
+		retryable, after, lastErr = c.attempt(ctx, path, idempotent, jsonData, requestID, respBody)
+		if lastErr == nil || !retryable {
+			return lastErr
+		}
+		if ctx.Err() != nil {
+			return lastErr
+		}
 	}
+	return lastErr
+}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/v1/certificate", c.baseURL), bytes.NewBuffer(jsonData))
+// attempt performs a single request and reports whether a failure is worth
+// retrying, along with any delay requested through Retry-After
+func (c *Client) attempt(ctx context.Context, path string, idempotent bool, body []byte, requestID string, respBody successResponse) (bool, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+path, bytes.NewReader(body))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
+		return false, 0, fmt.Errorf("failed to create request: %v", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(requestIDHeader, requestID)
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %v", err)
+		return idempotent || notSent(err), 0, fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		apiErr := newAPIError(path, resp, data, requestID)
+		return apiErr.Temporary(), retryAfter(resp), apiErr
 	}
 
-	var response CertificateResponse
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %v", err)
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return idempotent, 0, fmt.Errorf("failed to read response: %w", err)
+	}
+	if err := json.Unmarshal(data, respBody); err != nil {
+		return false, 0, fmt.Errorf("failed to decode response: %v", err)
 	}
+	if !respBody.succeeded() {
+		if len(data) > maxErrorBody {
+			data = data[:maxErrorBody]
+		}
+		apiErr := newAPIError(path, resp, data, requestID)
+		if apiErr.Message == string(bytes.TrimSpace(data)) {
+			// No error field, the body itself is not a useful message
+			apiErr.Message = "gateway reported failure"
+		}
+		return false, 0, apiErr
+	}
+	return false, 0, nil
+}
 
-	return &response, nil
+// notSent reports whether a request failed before the connection to the
+// gateway was made, so the gateway cannot have seen it
+func notSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// backoff returns the delay before the given attempt, preferring the server's
+// Retry-After when present
+func (c *Client) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		if retryAfter > c.retry.MaxRetryAfter {
+			return c.retry.MaxRetryAfter
+		}
+		return retryAfter
+	}
+
+	ceiling := c.retry.BaseDelay << (attempt - 1)
+	if ceiling <= 0 || ceiling > c.retry.MaxDelay {
+		ceiling = c.retry.MaxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(mrand.Int63n(int64(ceiling) + 1))
+}
+
+// retryAfter parses the Retry-After header in either of its forms
+func retryAfter(resp *http.Response) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
 }
@@ -0,0 +1,252 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var fastRetry = RetryPolicy{
+	MaxAttempts:   3,
+	BaseDelay:     time.Millisecond,
+	MaxDelay:      5 * time.Millisecond,
+	MaxRetryAfter: 50 * time.Millisecond,
+}
+
+func TestClient(t *testing.T) {
+	t.Run("RetryOn5xx", func(t *testing.T) {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) < 3 {
+				w.Header().Set("Retry-After", "0")
+				http.Error(w, "try later", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`{"node_id": 7, "node_name": "quiet-fox", "segment_id": "s1", "success": true}`))
+		}))
+		defer server.Close()
+
+		client := NewClient(server.URL)
+		client.SetRetryPolicy(fastRetry)
+
+		resp, err := client.RegisterInSegmentContext(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.NodeID != 7 || calls.Load() != 3 {
+			t.Errorf("unexpected result %+v after %d calls", resp, calls.Load())
+		}
+	})
+
+	t.Run("Unavailable", func(t *testing.T) {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.Header().Set("X-Request-ID", "req-1")
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(`{"error": "upstream down"}`))
+		}))
+		defer server.Close()
+
+		client := NewClient(server.URL)
+		client.SetRetryPolicy(fastRetry)
+
+		_, err := client.RegisterInSegment()
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) {
+			t.Fatalf("expected *APIError, got %v", err)
+		}
+		if apiErr.StatusCode != http.StatusBadGateway || apiErr.Message != "upstream down" || apiErr.RequestID != "req-1" {
+			t.Errorf("unexpected error fields: %+v", apiErr)
+		}
+		if !IsUnavailable(err) || IsRejected(err) {
+			t.Error("expected a 502 to count as unavailable")
+		}
+		if calls.Load() != int32(fastRetry.MaxAttempts) {
+			t.Errorf("expected %d attempts, got %d", fastRetry.MaxAttempts, calls.Load())
+		}
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		var calls atomic.Int32
+		var requestID string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			requestID = r.Header.Get("X-Request-ID")
+			http.Error(w, "unknown node", http.StatusForbidden)
+		}))
+		defer server.Close()
+
+		client := NewClient(server.URL)
+		client.SetRetryPolicy(fastRetry)
+
+		_, err := client.GetQNECertificate(1, "n", "s")
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) {
+			t.Fatalf("expected *APIError, got %v", err)
+		}
+		if apiErr.Message != "unknown node" || apiErr.RequestID == "" || apiErr.RequestID != requestID {
+			t.Errorf("unexpected error fields: %+v", apiErr)
+		}
+		if !IsRejected(err) || IsUnavailable(err) {
+			t.Error("expected a 403 to count as rejected")
+		}
+		if calls.Load() != 1 {
+			t.Errorf("4xx must not be retried, got %d attempts", calls.Load())
+		}
+	})
+
+	t.Run("SuccessFalse", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"certificate": "", "success": false}`))
+		}))
+		defer server.Close()
+
+		_, err := NewClient(server.URL).GetQNECertificate(1, "n", "s")
+		if !IsRejected(err) {
+			t.Errorf("expected success=false to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("Heartbeat", func(t *testing.T) {
+		var got HeartbeatRequest
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/api/v1/node/heartbeat":
+				json.NewDecoder(r.Body).Decode(&got)
+				w.Write([]byte(`{"interval": 45, "success": true}`))
+			case "/api/v1/node/deregister":
+				w.Write([]byte(`{"success": true}`))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		defer server.Close()
+
+		client := NewClient(server.URL)
+		resp, err := client.HeartbeatContext(context.Background(), HeartbeatRequest{
+			NodeID:     7,
+			PublicAddr: ":4445",
+			Protocols:  []string{"h3"},
+			Load:       LoadReport{Connections: 2},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Interval != 45 {
+			t.Errorf("expected interval from gateway, got %d", resp.Interval)
+		}
+		if got.NodeID != 7 || got.PublicAddr != ":4445" || got.Load.Connections != 2 || len(got.Protocols) != 1 {
+			t.Errorf("unexpected heartbeat sent: %+v", got)
+		}
+
+		if err := client.DeregisterContext(context.Background(), DeregisterRequest{NodeID: 7}); err != nil {
+			t.Errorf("deregister failed: %v", err)
+		}
+	})
+
+	t.Run("UnknownNode", func(t *testing.T) {
+		for _, tc := range []struct {
+			status  int
+			body    string
+			unknown bool
+		}{
+			{http.StatusOK, `{"success": false, "code": "unknown_node", "error": "node 7 is gone"}`, true},
+			{http.StatusNotFound, `{"success": false, "code": "unknown_node"}`, true},
+			{http.StatusNotFound, `{"error": "Unknown node 7"}`, true},
+			{http.StatusNotFound, `not found`, true},
+			// The wording alone means nothing
+			{http.StatusOK, `{"success": false, "error": "unknown node"}`, false},
+			{http.StatusForbidden, `{"error": "unknown node"}`, false},
+			{http.StatusNotFound, `{"error": "no such segment", "code": "unknown_segment"}`, false},
+			{http.StatusOK, `{"success": false}`, false},
+		} {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+
+			_, err := NewClient(server.URL).HeartbeatContext(context.Background(), HeartbeatRequest{NodeID: 7})
+			server.Close()
+
+			if IsUnknownNode(err) != tc.unknown {
+				t.Errorf("status %d, body %s: IsUnknownNode = %v for %v", tc.status, tc.body, !tc.unknown, err)
+			}
+			if tc.body == `{"success": false}` && !strings.Contains(err.Error(), "gateway reported failure") {
+				t.Errorf("expected generic failure message, got %v", err)
+			}
+		}
+	})
+
+	t.Run("RegisterNotRepeated", func(t *testing.T) {
+		// The gateway may have registered the node before the connection broke
+		var calls atomic.Int32
+		client := NewClient("http://gateway.invalid")
+		client.SetRetryPolicy(fastRetry)
+		client.httpClient.Transport = roundTripFunc(func(*http.Request) (*http.Response, error) {
+			calls.Add(1)
+			return nil, io.ErrUnexpectedEOF
+		})
+		if _, err := client.RegisterInSegmentContext(context.Background()); err == nil {
+			t.Fatal("expected the broken connection to fail")
+		}
+		if calls.Load() != 1 {
+			t.Errorf("expected registration to be sent once, got %d attempts", calls.Load())
+		}
+
+		calls.Store(0)
+		if _, err := client.HeartbeatContext(context.Background(), HeartbeatRequest{NodeID: 7}); err == nil {
+			t.Fatal("expected the broken connection to fail")
+		}
+		if calls.Load() != int32(fastRetry.MaxAttempts) {
+			t.Errorf("expected heartbeats to be retried, got %d attempts", calls.Load())
+		}
+
+		// Never connected, nothing can have been registered
+		calls.Store(0)
+		client.httpClient.Transport = roundTripFunc(func(*http.Request) (*http.Response, error) {
+			calls.Add(1)
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+		})
+		if _, err := client.RegisterInSegmentContext(context.Background()); err == nil {
+			t.Fatal("expected the refused connection to fail")
+		}
+		if calls.Load() != int32(fastRetry.MaxAttempts) {
+			t.Errorf("expected registration to be retried when never sent, got %d attempts", calls.Load())
+		}
+	})
+
+	t.Run("ContextCanceled", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		client := NewClient(server.URL)
+		client.SetRetryPolicy(RetryPolicy{MaxAttempts: 5, MaxRetryAfter: time.Minute})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err := client.RegisterInSegmentContext(ctx)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected deadline exceeded, got %v", err)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Error("Retry-After wait ignored the context")
+		}
+	})
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
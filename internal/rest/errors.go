@@ -0,0 +1,119 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// maxErrorBody limits how much of an error response is kept
+const maxErrorBody = 4 << 10
+
+// CodeUnknownNode is the error code the gateway answers requests for a node
+// it does not know with
+const CodeUnknownNode = "unknown_node"
+
+// APIError is returned when the gateway answers with a non-2xx status or a
+// response whose Success flag is false
+type APIError struct {
+	Op         string // Endpoint path, e.g. /api/v1/segment/register
+	StatusCode int
+	Message    string // Error message reported by the gateway
+	Code       string // Machine-readable error code reported by the gateway, if any
+	Body       []byte // Raw response body, truncated
+	RequestID  string
+}
+
+func (e *APIError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "gateway %s: status %d", e.Op, e.StatusCode)
+	if e.Message != "" {
+		fmt.Fprintf(&b, ": %s", e.Message)
+	}
+	if e.RequestID != "" {
+		fmt.Fprintf(&b, " (request %s)", e.RequestID)
+	}
+	return b.String()
+}
+
+// Temporary reports whether the request may succeed when retried
+func (e *APIError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// Rejected reports whether the gateway refused the request itself, as
+// opposed to being unable to process it
+func (e *APIError) Rejected() bool {
+	return !e.Temporary()
+}
+
+// IsRejected reports whether err means the gateway refused the request, for
+// example an unknown node or a revoked registration
+func IsRejected(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Rejected()
+}
+
+// IsUnknownNode reports whether the gateway does not know the node, which
+// means its registration is gone and the node has to register again. The
+// gateway says so with CodeUnknownNode, or with a 404 from a node endpoint
+// when the response has no code.
+func IsUnknownNode(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.Code != "" {
+		return apiErr.Code == CodeUnknownNode
+	}
+	return apiErr.StatusCode == http.StatusNotFound
+}
+
+// IsUnavailable reports whether err means the gateway could not be reached or
+// kept failing after all retries
+func IsUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+	return true
+}
+
+func newAPIError(op string, resp *http.Response, body []byte, requestID string) *APIError {
+	if id := resp.Header.Get(requestIDHeader); id != "" {
+		requestID = id
+	}
+	message, code := errorMessage(body)
+	return &APIError{
+		Op:         op,
+		StatusCode: resp.StatusCode,
+		Message:    message,
+		Code:       code,
+		Body:       body,
+		RequestID:  requestID,
+	}
+}
+
+// errorMessage extracts the message and error code from a JSON error body,
+// falling back to the body text
+func errorMessage(body []byte) (string, string) {
+	var payload struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+		Code    string `json:"code"`
+	}
+	if err := json.Unmarshal(body, &payload); err == nil {
+		if payload.Error != "" {
+			return payload.Error, payload.Code
+		}
+		if payload.Message != "" {
+			return payload.Message, payload.Code
+		}
+	}
+	return strings.TrimSpace(string(body)), payload.Code
+}
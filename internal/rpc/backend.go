@@ -0,0 +1,105 @@
+package rpc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// maxBackendResponse bounds the body read from an HTTP backend
+const maxBackendResponse = 4 << 20
+
+// httpCodes maps backend response statuses to gRPC codes. Other 4xx
+// statuses fail with FailedPrecondition, other 5xx ones with Internal.
+var httpCodes = map[int]codes.Code{
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusUnauthorized:        codes.Unauthenticated,
+	http.StatusForbidden:           codes.PermissionDenied,
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusConflict:            codes.AlreadyExists,
+	http.StatusTooManyRequests:     codes.ResourceExhausted,
+	http.StatusNotImplemented:      codes.Unimplemented,
+	http.StatusServiceUnavailable:  codes.Unavailable,
+	http.StatusGatewayTimeout:      codes.DeadlineExceeded,
+	http.StatusRequestTimeout:      codes.DeadlineExceeded,
+	http.StatusPreconditionFailed:  codes.FailedPrecondition,
+	http.StatusInternalServerError: codes.Internal,
+}
+
+// HTTPBackend returns a handler forwarding unary calls to an HTTP backend.
+// Each request is POSTed as JSON to baseURL followed by the method's path,
+// /package.Service/Method, and a 2xx response body is read as the JSON
+// response. Other statuses fail the call with the matching gRPC code and
+// the body as its message. Streaming methods answer Unimplemented.
+func HTTPBackend(baseURL string, client *http.Client) Handler {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	return func(call *Call) error {
+		if call.Method.IsStreamingClient() || call.Method.IsStreamingServer() {
+			return status.Errorf(codes.Unimplemented, "streaming method %s cannot be forwarded over HTTP", call.Method.Name())
+		}
+		req, err := call.Recv()
+		if err != nil {
+			return err
+		}
+		body, err := protojson.Marshal(req)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to encode request: %v", err)
+		}
+
+		ctx := call.Context()
+		httpReq, err := http.NewRequestWithContext(ctx, "POST", baseURL+fullMethod(call.Method), bytes.NewReader(body))
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to create request: %v", err)
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(httpReq)
+		if err != nil {
+			if ctx.Err() != nil {
+				return status.FromContextError(ctx.Err()).Err()
+			}
+			return status.Errorf(codes.Unavailable, "backend unavailable: %v", err)
+		}
+		defer resp.Body.Close()
+
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxBackendResponse+1))
+		if err != nil {
+			return status.Errorf(codes.Unavailable, "failed to read backend response: %v", err)
+		}
+		if len(data) > maxBackendResponse {
+			return status.Errorf(codes.ResourceExhausted, "backend response larger than %d bytes", maxBackendResponse)
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return status.Error(backendCode(resp.StatusCode), backendMessage(resp.StatusCode, data))
+		}
+
+		out := dynamicpb.NewMessage(call.Method.Output())
+		if err := protojson.Unmarshal(data, out); err != nil {
+			return status.Errorf(codes.Internal, "invalid backend response: %v", err)
+		}
+		return call.Send(out)
+	}
+}
+
+func backendCode(httpStatus int) codes.Code {
+	if code, ok := httpCodes[httpStatus]; ok {
+		return code
+	}
+	if httpStatus >= 400 && httpStatus < 500 {
+		return codes.FailedPrecondition
+	}
+	return codes.Internal
+}
+
+func backendMessage(httpStatus int, body []byte) string {
+	if msg := strings.TrimSpace(string(body)); msg != "" {
+		return msg
+	}
+	return fmt.Sprintf("backend returned status %d", httpStatus)
+}
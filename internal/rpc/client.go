@@ -0,0 +1,106 @@
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Dial returns a connection to the gRPC server of another node. With a nil
+// tlsConfig the connection is not encrypted, for local development only.
+func Dial(target string, tlsConfig *tls.Config, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	conn, err := grpc.NewClient(target, append(opts, grpc.WithTransportCredentials(creds))...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %v", target, err)
+	}
+	return conn, nil
+}
+
+// Client calls the methods of a service with dynamic messages
+type Client struct {
+	conn grpc.ClientConnInterface
+	desc protoreflect.ServiceDescriptor
+}
+
+func NewClient(conn grpc.ClientConnInterface, sd protoreflect.ServiceDescriptor) *Client {
+	return &Client{conn: conn, desc: sd}
+}
+
+func (c *Client) method(name string) (protoreflect.MethodDescriptor, error) {
+	md := c.desc.Methods().ByName(protoreflect.Name(name))
+	if md == nil {
+		return nil, fmt.Errorf("service %s has no method %s", c.desc.FullName(), name)
+	}
+	return md, nil
+}
+
+func fullMethod(md protoreflect.MethodDescriptor) string {
+	return "/" + string(md.Parent().FullName()) + "/" + string(md.Name())
+}
+
+// Call calls a unary method
+func (c *Client) Call(ctx context.Context, method string, req proto.Message, opts ...grpc.CallOption) (*dynamicpb.Message, error) {
+	md, err := c.method(method)
+	if err != nil {
+		return nil, err
+	}
+	if md.IsStreamingClient() || md.IsStreamingServer() {
+		return nil, fmt.Errorf("method %s is streaming, use Stream", method)
+	}
+	resp := dynamicpb.NewMessage(md.Output())
+	if err := c.conn.Invoke(ctx, fullMethod(md), req, resp, opts...); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Stream starts a call of a streaming method
+func (c *Client) Stream(ctx context.Context, method string, opts ...grpc.CallOption) (*ClientStream, error) {
+	md, err := c.method(method)
+	if err != nil {
+		return nil, err
+	}
+	desc := &grpc.StreamDesc{
+		StreamName:    string(md.Name()),
+		ClientStreams: md.IsStreamingClient(),
+		ServerStreams: md.IsStreamingServer(),
+	}
+	stream, err := c.conn.NewStream(ctx, desc, fullMethod(md), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientStream{ClientStream: stream, method: md}, nil
+}
+
+// ClientStream is a streaming call in progress. Call CloseSend once all
+// requests are sent.
+type ClientStream struct {
+	grpc.ClientStream
+	method protoreflect.MethodDescriptor
+}
+
+// Send sends a request
+func (s *ClientStream) Send(msg proto.Message) error {
+	return s.SendMsg(msg)
+}
+
+// Recv returns the next response, or io.EOF once the server has sent all
+// of them
+func (s *ClientStream) Recv() (*dynamicpb.Message, error) {
+	msg := dynamicpb.NewMessage(s.method.Output())
+	if err := s.RecvMsg(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,310 @@
+// Package rpc hosts and calls gRPC services defined by registry protos at
+// runtime. Messages are dynamic, so a service can be served or called from
+// its descriptor alone, without generated code.
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/reflection"
+	reflectionv1 "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	reflectionv1alpha "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Protocol is reported to the gateway by nodes serving gRPC
+const Protocol = "grpc"
+
+// Handler serves the calls of one method. It reads requests with Recv and
+// answers with Send, once each for unary methods and as often as declared
+// for streaming ones. Errors made with status.Error reach the caller with
+// their code.
+type Handler func(call *Call) error
+
+// Unary returns a handler answering each request with one response
+func Unary(fn func(ctx context.Context, req *dynamicpb.Message) (proto.Message, error)) Handler {
+	return func(call *Call) error {
+		req, err := call.Recv()
+		if err != nil {
+			return err
+		}
+		resp, err := fn(call.Context(), req)
+		if err != nil {
+			return err
+		}
+		return call.Send(resp)
+	}
+}
+
+// Call is a call being served
+type Call struct {
+	Method protoreflect.MethodDescriptor
+	stream grpc.ServerStream
+	sent   int
+}
+
+func (c *Call) Context() context.Context {
+	return c.stream.Context()
+}
+
+// Recv returns the next request, or io.EOF once the caller has sent all of
+// them
+func (c *Call) Recv() (*dynamicpb.Message, error) {
+	msg := dynamicpb.NewMessage(c.Method.Input())
+	if err := c.stream.RecvMsg(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Send sends a response, which has to be of the method's output type
+func (c *Call) Send(msg proto.Message) error {
+	if got, want := msg.ProtoReflect().Descriptor().FullName(), c.Method.Output().FullName(); got != want {
+		return status.Errorf(codes.Internal, "handler answered with %s instead of %s", got, want)
+	}
+	if c.sent > 0 && !c.Method.IsStreamingServer() {
+		return status.Error(codes.Internal, "handler answered more than once")
+	}
+	if err := c.stream.SendMsg(msg); err != nil {
+		return err
+	}
+	c.sent++
+	return nil
+}
+
+// service is a registered service with the handlers of its methods
+type service struct {
+	desc     protoreflect.ServiceDescriptor
+	handlers map[protoreflect.Name]Handler
+}
+
+// Server serves registered services and the server reflection API, so tools
+// like grpcurl can discover them. Services can be registered and removed
+// while the server is running.
+type Server struct {
+	grpc *grpc.Server
+
+	mu       sync.RWMutex
+	services map[protoreflect.FullName]*service
+	files    *protoregistry.Files // Files defining the services, for reflection
+}
+
+func NewServer(opts ...grpc.ServerOption) *Server {
+	s := &Server{
+		services: make(map[protoreflect.FullName]*service),
+		files:    &protoregistry.Files{},
+	}
+	// Calls are dispatched here rather than through grpc.RegisterService,
+	// which cannot add services once the server is running
+	s.grpc = grpc.NewServer(append(opts, grpc.UnknownServiceHandler(s.dispatch))...)
+
+	reflectionOpts := reflection.ServerOptions{Services: s, DescriptorResolver: resolver{s}}
+	reflectionv1.RegisterServerReflectionServer(s.grpc, reflection.NewServerV1(reflectionOpts))
+	reflectionv1alpha.RegisterServerReflectionServer(s.grpc, reflection.NewServer(reflectionOpts))
+	return s
+}
+
+// RegisterService serves a service, calling the handler named after each of
+// its methods. Methods without a handler answer Unimplemented. Registering
+// a service again replaces it, so a new version takes over for later calls.
+func (s *Server) RegisterService(sd protoreflect.ServiceDescriptor, handlers map[string]Handler) error {
+	svc := &service{desc: sd, handlers: make(map[protoreflect.Name]Handler, len(handlers))}
+	for name, h := range handlers {
+		if sd.Methods().ByName(protoreflect.Name(name)) == nil {
+			return fmt.Errorf("service %s has no method %s", sd.FullName(), name)
+		}
+		svc.handlers[protoreflect.Name(name)] = h
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	services := make(map[protoreflect.FullName]*service, len(s.services)+1)
+	for name, existing := range s.services {
+		services[name] = existing
+	}
+	services[sd.FullName()] = svc
+	files, err := serviceFiles(services)
+	if err != nil {
+		return fmt.Errorf("failed to register service %s: %v", sd.FullName(), err)
+	}
+	s.services, s.files = services, files
+	return nil
+}
+
+// RemoveService stops serving a service. Calls in progress are not
+// interrupted.
+func (s *Server) RemoveService(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.services[protoreflect.FullName(name)]; !ok {
+		return
+	}
+	services := make(map[protoreflect.FullName]*service, len(s.services))
+	for n, existing := range s.services {
+		if n != protoreflect.FullName(name) {
+			services[n] = existing
+		}
+	}
+	// Files that registered together before still do
+	files, _ := serviceFiles(services)
+	s.services, s.files = services, files
+}
+
+// serviceFiles collects the files defining services and everything they
+// import
+func serviceFiles(services map[protoreflect.FullName]*service) (*protoregistry.Files, error) {
+	files := &protoregistry.Files{}
+	seen := make(map[protoreflect.FileDescriptor]bool)
+	var add func(fd protoreflect.FileDescriptor) error
+	add = func(fd protoreflect.FileDescriptor) error {
+		if seen[fd] {
+			return nil
+		}
+		seen[fd] = true
+		imports := fd.Imports()
+		for i := 0; i < imports.Len(); i++ {
+			if err := add(imports.Get(i).FileDescriptor); err != nil {
+				return err
+			}
+		}
+		// Well-known types are served from the global registry
+		if _, err := protoregistry.GlobalFiles.FindFileByPath(fd.Path()); err == nil {
+			return nil
+		}
+		return files.RegisterFile(fd)
+	}
+
+	// Sorted, so which of two conflicting services fails does not vary
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := add(services[protoreflect.FullName(name)].desc.ParentFile()); err != nil {
+			return files, err
+		}
+	}
+	return files, nil
+}
+
+// GetServiceInfo lists the registered services and the reflection service,
+// for server reflection
+func (s *Server) GetServiceInfo() map[string]grpc.ServiceInfo {
+	info := s.grpc.GetServiceInfo()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for name, svc := range s.services {
+		methods := svc.desc.Methods()
+		si := grpc.ServiceInfo{Metadata: svc.desc.ParentFile().Path()}
+		for i := 0; i < methods.Len(); i++ {
+			md := methods.Get(i)
+			si.Methods = append(si.Methods, grpc.MethodInfo{
+				Name:           string(md.Name()),
+				IsClientStream: md.IsStreamingClient(),
+				IsServerStream: md.IsStreamingServer(),
+			})
+		}
+		info[string(name)] = si
+	}
+	return info
+}
+
+// dispatch serves every call to a registered service
+func (s *Server) dispatch(_ interface{}, stream grpc.ServerStream) error {
+	fullMethod, _ := grpc.MethodFromServerStream(stream)
+	serviceName, methodName, ok := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	if !ok {
+		return status.Errorf(codes.Unimplemented, "malformed method %q", fullMethod)
+	}
+
+	s.mu.RLock()
+	svc := s.services[protoreflect.FullName(serviceName)]
+	s.mu.RUnlock()
+	if svc == nil {
+		return status.Errorf(codes.Unimplemented, "unknown service %s", serviceName)
+	}
+	md := svc.desc.Methods().ByName(protoreflect.Name(methodName))
+	handler := svc.handlers[protoreflect.Name(methodName)]
+	if md == nil || handler == nil {
+		return status.Errorf(codes.Unimplemented, "unknown method %s for service %s", methodName, serviceName)
+	}
+
+	call := &Call{Method: md, stream: stream}
+	err := handler(call)
+	if errors.Is(err, io.EOF) && call.sent == 0 {
+		return status.Error(codes.InvalidArgument, "no request sent")
+	}
+	if err == nil && call.sent == 0 && !md.IsStreamingServer() {
+		return status.Errorf(codes.Internal, "handler for %s sent no response", fullMethod)
+	}
+	return err
+}
+
+// ServeHTTP serves a gRPC request received by an HTTP/2 server, see Route
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.grpc.ServeHTTP(w, r)
+}
+
+// Serve accepts gRPC connections on lis until Stop is called
+func (s *Server) Serve(lis net.Listener) error {
+	return s.grpc.Serve(lis)
+}
+
+// Stop closes every connection, canceling calls in progress
+func (s *Server) Stop() {
+	s.grpc.Stop()
+}
+
+// Route returns a handler passing gRPC requests to grpcHandler and the rest
+// to next, so gRPC can share an HTTP/2 server with other handlers. gRPC
+// needs HTTP/2, HTTP/3 requests always go to next.
+func Route(grpcHandler, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			grpcHandler.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// resolver finds descriptors for server reflection among the registered
+// services first, then the files linked into the binary
+type resolver struct {
+	s *Server
+}
+
+func (r resolver) current() *protoregistry.Files {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+	return r.s.files
+}
+
+func (r resolver) FindFileByPath(path string) (protoreflect.FileDescriptor, error) {
+	if fd, err := r.current().FindFileByPath(path); err == nil {
+		return fd, nil
+	}
+	return protoregistry.GlobalFiles.FindFileByPath(path)
+}
+
+func (r resolver) FindDescriptorByName(name protoreflect.FullName) (protoreflect.Descriptor, error) {
+	if d, err := r.current().FindDescriptorByName(name); err == nil {
+		return d, nil
+	}
+	return protoregistry.GlobalFiles.FindDescriptorByName(name)
+}
@@ -0,0 +1,352 @@
+package rpc_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	reflectionv1 "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/qnepff/qne-node-v12/internal/gatewaytest"
+	"github.com/qnepff/qne-node-v12/internal/protoloader"
+	"github.com/qnepff/qne-node-v12/internal/rpc"
+)
+
+const echoProto = `syntax = "proto3";
+package qne.echo;
+
+message EchoRequest {
+  string text = 1;
+  int32 repeat = 2;
+}
+
+message EchoResponse {
+  string text = 1;
+}
+
+service Echo {
+  rpc Say(EchoRequest) returns (EchoResponse);
+  rpc Repeat(EchoRequest) returns (stream EchoResponse);
+  rpc Collect(stream EchoRequest) returns (EchoResponse);
+  rpc Chat(stream EchoRequest) returns (stream EchoResponse);
+  rpc Forward(EchoRequest) returns (EchoResponse);
+  rpc Silent(EchoRequest) returns (EchoResponse);
+}
+`
+
+// echo builds a message of the echo service with its text field set
+func echo(md protoreflect.MessageDescriptor, text string) *dynamicpb.Message {
+	msg := dynamicpb.NewMessage(md)
+	msg.Set(md.Fields().ByName("text"), protoreflect.ValueOfString(text))
+	return msg
+}
+
+func text(msg proto.Message) string {
+	m := msg.ProtoReflect()
+	return m.Get(m.Descriptor().Fields().ByName("text")).String()
+}
+
+func TestServer(t *testing.T) {
+	gateway, gatewayURL := gatewaytest.NewServer(t, gatewaytest.Config{})
+	gateway.AddProto(protoloader.Proto{ID: 1, Namespace: "echo", Name: "echo.proto", Version: "v1", Content: echoProto})
+	loader, err := protoloader.New(gatewayURL, t.TempDir(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	loader.SetTrustAnchors(gateway.RegistryKey())
+	ctx := context.Background()
+	sd, err := loader.Service(ctx, 1, "Echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := sd.Methods().ByName("Say").Input()
+	output := sd.Methods().ByName("Say").Output()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Text string }
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.URL.Path != "/qne.echo.Echo/Forward" || req.Text == "missing" {
+			http.Error(w, "no such text", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"text": strings.ToUpper(req.Text)})
+	}))
+	t.Cleanup(backend.Close)
+
+	handlers := map[string]rpc.Handler{
+		"Say": rpc.Unary(func(ctx context.Context, req *dynamicpb.Message) (proto.Message, error) {
+			return echo(output, "you said "+text(req)), nil
+		}),
+		"Repeat": func(call *rpc.Call) error {
+			req, err := call.Recv()
+			if err != nil {
+				return err
+			}
+			n := req.Get(input.Fields().ByName("repeat")).Int()
+			for i := int64(0); i < n; i++ {
+				if err := call.Send(echo(output, text(req))); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		"Collect": func(call *rpc.Call) error {
+			var texts []string
+			for {
+				req, err := call.Recv()
+				if err == io.EOF {
+					return call.Send(echo(output, strings.Join(texts, " ")))
+				}
+				if err != nil {
+					return err
+				}
+				texts = append(texts, text(req))
+			}
+		},
+		"Chat": func(call *rpc.Call) error {
+			for {
+				req, err := call.Recv()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if err := call.Send(echo(output, text(req)+"!")); err != nil {
+					return err
+				}
+			}
+		},
+		"Forward": rpc.HTTPBackend(backend.URL+"/", http.DefaultClient),
+	}
+	server := rpc.NewServer()
+	if err := server.RegisterService(sd, handlers); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.RegisterService(sd, map[string]rpc.Handler{"Missing": handlers["Say"]}); err == nil {
+		t.Error("expected a handler for a method the service lacks to be refused")
+	}
+
+	// Served the way the node serves it, next to other handlers on HTTP/2
+	ts := httptest.NewUnstartedServer(rpc.Route(server, http.NotFoundHandler()))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	t.Cleanup(server.Stop)
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	conn, err := rpc.Dial(ts.Listener.Addr().String(), &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	client := rpc.NewClient(conn, sd)
+
+	t.Run("Unary", func(t *testing.T) {
+		resp, err := client.Call(ctx, "Say", echo(input, "hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if text(resp) != "you said hello" {
+			t.Errorf("unexpected response %q", text(resp))
+		}
+		if _, err := client.Call(ctx, "Repeat", echo(input, "hello")); err == nil {
+			t.Error("expected Call of a streaming method to fail")
+		}
+	})
+
+	t.Run("ServerStream", func(t *testing.T) {
+		req := echo(input, "again")
+		req.Set(input.Fields().ByName("repeat"), protoreflect.ValueOfInt32(3))
+		stream, err := client.Stream(ctx, "Repeat")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.Send(req); err != nil {
+			t.Fatal(err)
+		}
+		stream.CloseSend()
+		count := 0
+		for {
+			resp, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text(resp) != "again" {
+				t.Errorf("unexpected response %q", text(resp))
+			}
+			count++
+		}
+		if count != 3 {
+			t.Errorf("expected 3 responses, got %d", count)
+		}
+	})
+
+	t.Run("ClientStream", func(t *testing.T) {
+		stream, err := client.Stream(ctx, "Collect")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, word := range []string{"a", "b", "c"} {
+			if err := stream.Send(echo(input, word)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stream.CloseSend()
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if text(resp) != "a b c" {
+			t.Errorf("unexpected response %q", text(resp))
+		}
+	})
+
+	t.Run("Bidi", func(t *testing.T) {
+		stream, err := client.Stream(ctx, "Chat")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, word := range []string{"hi", "bye"} {
+			if err := stream.Send(echo(input, word)); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := stream.Recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text(resp) != word+"!" {
+				t.Errorf("unexpected response %q", text(resp))
+			}
+		}
+		stream.CloseSend()
+		if _, err := stream.Recv(); err != io.EOF {
+			t.Errorf("expected the stream to end, got %v", err)
+		}
+	})
+
+	t.Run("HTTPBackend", func(t *testing.T) {
+		resp, err := client.Call(ctx, "Forward", echo(input, "loud"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if text(resp) != "LOUD" {
+			t.Errorf("unexpected response %q", text(resp))
+		}
+		_, err = client.Call(ctx, "Forward", echo(input, "missing"))
+		if s, _ := status.FromError(err); s.Code() != codes.NotFound || s.Message() != "no such text" {
+			t.Errorf("expected the backend's 404 as NotFound, got %v", err)
+		}
+	})
+
+	t.Run("Unimplemented", func(t *testing.T) {
+		_, err := client.Call(ctx, "Silent", echo(input, "hello"))
+		if status.Code(err) != codes.Unimplemented {
+			t.Errorf("expected a method without handler to be unimplemented, got %v", err)
+		}
+		if _, err := client.Call(ctx, "Nothing", echo(input, "hello")); err == nil {
+			t.Error("expected an unknown method to fail on the client")
+		}
+	})
+
+	t.Run("Reflection", func(t *testing.T) {
+		stream, err := reflectionv1.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stream.CloseSend()
+
+		stream.Send(&reflectionv1.ServerReflectionRequest{
+			MessageRequest: &reflectionv1.ServerReflectionRequest_ListServices{},
+		})
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var services []string
+		for _, s := range resp.GetListServicesResponse().GetService() {
+			services = append(services, s.Name)
+		}
+		sort.Strings(services)
+		expected := "grpc.reflection.v1.ServerReflection grpc.reflection.v1alpha.ServerReflection qne.echo.Echo"
+		if strings.Join(services, " ") != expected {
+			t.Errorf("unexpected services %v", services)
+		}
+
+		stream.Send(&reflectionv1.ServerReflectionRequest{
+			MessageRequest: &reflectionv1.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: "qne.echo.Echo"},
+		})
+		resp, err = stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := resp.GetFileDescriptorResponse().GetFileDescriptorProto()
+		if len(files) == 0 {
+			t.Fatalf("expected the file defining the service, got %v", resp)
+		}
+		var file descriptorpb.FileDescriptorProto
+		if err := proto.Unmarshal(files[0], &file); err != nil {
+			t.Fatal(err)
+		}
+		if file.GetName() != "echo.proto" || len(file.GetService()) != 1 {
+			t.Errorf("unexpected file %s with %d services", file.GetName(), len(file.GetService()))
+		}
+	})
+
+	t.Run("Route", func(t *testing.T) {
+		resp, err := ts.Client().Get(ts.URL + "/qne.echo.Echo/Say")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected other requests to reach the next handler, got status %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		server.RemoveService("qne.echo.Echo")
+		_, err := client.Call(ctx, "Say", echo(input, "hello"))
+		if status.Code(err) != codes.Unimplemented {
+			t.Errorf("expected a removed service to be unimplemented, got %v", err)
+		}
+		if _, ok := server.GetServiceInfo()["qne.echo.Echo"]; ok {
+			t.Error("expected a removed service to be unlisted")
+		}
+		if err := server.RegisterService(sd, handlers); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Call(ctx, "Say", echo(input, "hello")); err != nil {
+			t.Errorf("expected the service to be back: %v", err)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		var wrongType rpc.Handler = rpc.Unary(func(ctx context.Context, req *dynamicpb.Message) (proto.Message, error) {
+			return req, nil
+		})
+		if err := server.RegisterService(sd, map[string]rpc.Handler{"Say": wrongType}); err != nil {
+			t.Fatal(err)
+		}
+		_, err := client.Call(ctx, "Say", echo(input, "hello"))
+		if s, _ := status.FromError(err); s.Code() != codes.Internal || !strings.Contains(s.Message(), "instead of qne.echo.EchoResponse") {
+			t.Errorf("expected a response of the wrong type to fail, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,376 @@
+package signaling
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Protocol identifies the signaling message format, reported to the gateway
+const Protocol = "qne-signaling/1"
+
+// Message types understood by the hub
+const (
+	TypeJoin         = "join"
+	TypeLeave        = "leave"
+	TypeOffer        = "offer"
+	TypeAnswer       = "answer"
+	TypeICECandidate = "ice-candidate"
+
+	// Sent by the hub
+	TypeWelcome    = "welcome"
+	TypeJoined     = "joined"
+	TypePeerJoined = "peer-joined"
+	TypePeerLeft   = "peer-left"
+	TypeError      = "error"
+)
+
+// sendBufferSize is the number of outgoing messages queued per client before
+// the client is considered too slow and disconnected
+const sendBufferSize = 64
+
+// closeWait bounds how long Close waits to deliver a close frame
+const closeWait = time.Second
+
+var (
+	ErrNameTaken   = errors.New("name already in use")
+	ErrHubClosed   = errors.New("hub closed")
+	ErrUnknownPeer = errors.New("unknown peer")
+)
+
+type WebRTCMessage struct {
+	Type      string      `json:"type"`
+	From      string      `json:"from,omitempty"`
+	To        string      `json:"to,omitempty"`
+	Room      string      `json:"room,omitempty"`
+	Offer     interface{} `json:"offer,omitempty"`
+	Answer    interface{} `json:"answer,omitempty"`
+	Candidate interface{} `json:"candidate,omitempty"`
+	Peers     []string    `json:"peers,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type client struct {
+	name  string
+	conn  *websocket.Conn
+	send  chan WebRTCMessage
+	rooms map[string]struct{}
+	once  sync.Once
+}
+
+func (c *client) close() {
+	c.once.Do(func() {
+		close(c.send)
+	})
+}
+
+// Hub relays WebRTC signaling messages between connected clients. Clients are
+// tracked by node name and can join any number of named rooms.
+type Hub struct {
+	upgrader websocket.Upgrader
+	clients  map[string]*client
+	rooms    map[string]map[string]*client
+	mu       sync.Mutex
+	closed   bool
+	anonSeq  atomic.Int64
+	wg       sync.WaitGroup
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		},
+		clients: make(map[string]*client),
+		rooms:   make(map[string]map[string]*client),
+	}
+}
+
+// ServeHTTP upgrades the request to a WebSocket and relays messages for the
+// client until it disconnects. The client name is taken from the "name" query
+// parameter, an anonymous name is assigned when it is missing.
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = fmt.Sprintf("anon-%d", h.anonSeq.Add(1))
+	}
+
+	h.mu.Lock()
+	closed := h.closed
+	_, taken := h.clients[name]
+	h.mu.Unlock()
+	if closed {
+		http.Error(w, ErrHubClosed.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if taken {
+		http.Error(w, ErrNameTaken.Error(), http.StatusConflict)
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade WebSocket connection: %v", err)
+		return
+	}
+
+	c := &client{
+		name:  name,
+		conn:  conn,
+		send:  make(chan WebRTCMessage, sendBufferSize),
+		rooms: make(map[string]struct{}),
+	}
+	if err := h.register(c); err != nil {
+		conn.WriteJSON(WebRTCMessage{Type: TypeError, Error: err.Error()})
+		conn.Close()
+		return
+	}
+
+	go func() {
+		defer h.wg.Done()
+		h.writePump(c)
+	}()
+
+	c.send <- WebRTCMessage{Type: TypeWelcome, To: name}
+	h.readPump(c)
+}
+
+// Peers returns the sorted names of all clients in the given room
+func (h *Hub) Peers(room string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.roomPeersLocked(room, "")
+}
+
+// Clients returns the number of connected clients
+func (h *Hub) Clients() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+// Close disconnects all clients and rejects new connections
+func (h *Hub) Close() error {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil
+	}
+	h.closed = true
+	clients := make([]*client, 0, len(h.clients))
+	for _, c := range h.clients {
+		clients = append(clients, c)
+	}
+	h.mu.Unlock()
+
+	for _, c := range clients {
+		c.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(closeWait))
+		c.conn.Close()
+	}
+	h.wg.Wait()
+	return nil
+}
+
+func (h *Hub) register(c *client) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return ErrHubClosed
+	}
+	if _, ok := h.clients[c.name]; ok {
+		return ErrNameTaken
+	}
+	h.clients[c.name] = c
+	h.wg.Add(1)
+	return nil
+}
+
+func (h *Hub) unregister(c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients[c.name] != c {
+		return
+	}
+	for room := range c.rooms {
+		h.leaveLocked(c, room)
+	}
+	delete(h.clients, c.name)
+	c.close()
+}
+
+func (h *Hub) readPump(c *client) {
+	defer func() {
+		h.unregister(c)
+		c.conn.Close()
+	}()
+
+	for {
+		var msg WebRTCMessage
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("Failed to read WebSocket message from %s: %v", c.name, err)
+			}
+			return
+		}
+		h.handle(c, msg)
+	}
+}
+
+func (h *Hub) writePump(c *client) {
+	for msg := range c.send {
+		if err := c.conn.WriteJSON(msg); err != nil {
+			log.Printf("Failed to write WebSocket message to %s: %v", c.name, err)
+			c.conn.Close()
+			// Drain so senders never block on a dead client
+			for range c.send {
+			}
+			return
+		}
+	}
+}
+
+func (h *Hub) handle(c *client, msg WebRTCMessage) {
+	// The sender can never be spoofed
+	msg.From = c.name
+
+	switch msg.Type {
+	case TypeJoin:
+		if msg.Room == "" {
+			h.reply(c, "join requires a room")
+			return
+		}
+		h.join(c, msg.Room)
+	case TypeLeave:
+		if msg.Room == "" {
+			h.reply(c, "leave requires a room")
+			return
+		}
+		h.mu.Lock()
+		h.leaveLocked(c, msg.Room)
+		h.mu.Unlock()
+	case TypeOffer, TypeAnswer, TypeICECandidate:
+		if err := h.route(c, msg); err != nil {
+			h.reply(c, err.Error())
+		}
+	default:
+		h.reply(c, fmt.Sprintf("unknown message type %q", msg.Type))
+	}
+}
+
+func (h *Hub) join(c *client, room string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := c.rooms[room]; ok {
+		return
+	}
+	members, ok := h.rooms[room]
+	if !ok {
+		members = make(map[string]*client)
+		h.rooms[room] = members
+	}
+	for _, peer := range members {
+		h.deliverLocked(peer, WebRTCMessage{Type: TypePeerJoined, From: c.name, Room: room})
+	}
+	members[c.name] = c
+	c.rooms[room] = struct{}{}
+
+	h.deliverLocked(c, WebRTCMessage{Type: TypeJoined, Room: room, Peers: h.roomPeersLocked(room, c.name)})
+}
+
+func (h *Hub) leaveLocked(c *client, room string) {
+	members, ok := h.rooms[room]
+	if !ok {
+		return
+	}
+	if _, ok := members[c.name]; !ok {
+		return
+	}
+	delete(members, c.name)
+	delete(c.rooms, room)
+	if len(members) == 0 {
+		delete(h.rooms, room)
+		return
+	}
+	for _, peer := range members {
+		h.deliverLocked(peer, WebRTCMessage{Type: TypePeerLeft, From: c.name, Room: room})
+	}
+}
+
+// route forwards a signaling message to its target peer. Messages without a
+// target are relayed to every other member of the room.
+func (h *Hub) route(c *client, msg WebRTCMessage) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if msg.Room != "" {
+		if _, ok := c.rooms[msg.Room]; !ok {
+			return fmt.Errorf("not a member of room %q", msg.Room)
+		}
+	}
+
+	if msg.To != "" {
+		target, ok := h.clients[msg.To]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownPeer, msg.To)
+		}
+		if msg.Room != "" {
+			if _, ok := target.rooms[msg.Room]; !ok {
+				return fmt.Errorf("%w: %s is not in room %q", ErrUnknownPeer, msg.To, msg.Room)
+			}
+		}
+		h.deliverLocked(target, msg)
+		return nil
+	}
+
+	if msg.Room == "" {
+		return errors.New("message needs a target peer or a room")
+	}
+	for name, peer := range h.rooms[msg.Room] {
+		if name != c.name {
+			h.deliverLocked(peer, msg)
+		}
+	}
+	return nil
+}
+
+func (h *Hub) reply(c *client, errMsg string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.deliverLocked(c, WebRTCMessage{Type: TypeError, Error: errMsg})
+}
+
+// deliverLocked queues a message for a client without blocking. A client whose
+// buffer is full is disconnected.
+func (h *Hub) deliverLocked(c *client, msg WebRTCMessage) {
+	if h.clients[c.name] != c {
+		return
+	}
+	select {
+	case c.send <- msg:
+	default:
+		log.Printf("Dropping slow WebSocket client %s", c.name)
+		c.conn.Close()
+	}
+}
+
+func (h *Hub) roomPeersLocked(room, exclude string) []string {
+	peers := make([]string, 0, len(h.rooms[room]))
+	for name := range h.rooms[room] {
+		if name != exclude {
+			peers = append(peers, name)
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
@@ -0,0 +1,145 @@
+package signaling
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func dial(t *testing.T, server *httptest.Server, name string) *websocket.Conn {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?name=" + name
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("failed to dial as %s: %v", name, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	msg := read(t, conn)
+	if msg.Type != TypeWelcome || msg.To != name {
+		t.Fatalf("expected welcome for %s, got %+v", name, msg)
+	}
+	return conn
+}
+
+func read(t *testing.T, conn *websocket.Conn) WebRTCMessage {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg WebRTCMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	return msg
+}
+
+func send(t *testing.T, conn *websocket.Conn, msg WebRTCMessage) {
+	t.Helper()
+
+	if err := conn.WriteJSON(msg); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+}
+
+func TestHub(t *testing.T) {
+	hub := NewHub()
+	mux := http.NewServeMux()
+	mux.Handle("/ws", hub)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	defer hub.Close()
+
+	alice := dial(t, server, "alice")
+	bob := dial(t, server, "bob")
+
+	t.Run("Join", func(t *testing.T) {
+		send(t, alice, WebRTCMessage{Type: TypeJoin, Room: "call"})
+		msg := read(t, alice)
+		if msg.Type != TypeJoined || msg.Room != "call" || len(msg.Peers) != 0 {
+			t.Fatalf("unexpected join reply: %+v", msg)
+		}
+
+		send(t, bob, WebRTCMessage{Type: TypeJoin, Room: "call"})
+		msg = read(t, bob)
+		if msg.Type != TypeJoined || len(msg.Peers) != 1 || msg.Peers[0] != "alice" {
+			t.Fatalf("unexpected join reply: %+v", msg)
+		}
+
+		msg = read(t, alice)
+		if msg.Type != TypePeerJoined || msg.From != "bob" || msg.Room != "call" {
+			t.Fatalf("expected peer-joined for bob, got %+v", msg)
+		}
+
+		if peers := hub.Peers("call"); len(peers) != 2 {
+			t.Errorf("expected 2 peers in room, got %v", peers)
+		}
+		if hub.Clients() != 2 {
+			t.Errorf("expected 2 clients, got %d", hub.Clients())
+		}
+	})
+
+	t.Run("Route", func(t *testing.T) {
+		send(t, alice, WebRTCMessage{Type: TypeOffer, To: "bob", Room: "call", Offer: map[string]string{"sdp": "o"}})
+		msg := read(t, bob)
+		if msg.Type != TypeOffer || msg.From != "alice" || msg.To != "bob" || msg.Offer == nil {
+			t.Fatalf("unexpected offer: %+v", msg)
+		}
+
+		// The hub overrides a spoofed sender
+		send(t, bob, WebRTCMessage{Type: TypeAnswer, From: "mallory", To: "alice", Answer: map[string]string{"sdp": "a"}})
+		msg = read(t, alice)
+		if msg.Type != TypeAnswer || msg.From != "bob" {
+			t.Fatalf("unexpected answer: %+v", msg)
+		}
+
+		// Without a target the message goes to the rest of the room
+		send(t, alice, WebRTCMessage{Type: TypeICECandidate, Room: "call", Candidate: "c"})
+		msg = read(t, bob)
+		if msg.Type != TypeICECandidate || msg.From != "alice" || msg.Candidate != "c" {
+			t.Fatalf("unexpected candidate: %+v", msg)
+		}
+	})
+
+	t.Run("UnknownPeer", func(t *testing.T) {
+		send(t, alice, WebRTCMessage{Type: TypeOffer, To: "carol"})
+		msg := read(t, alice)
+		if msg.Type != TypeError || !strings.Contains(msg.Error, "carol") {
+			t.Fatalf("expected error for unknown peer, got %+v", msg)
+		}
+	})
+
+	t.Run("NameTaken", func(t *testing.T) {
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?name=alice"
+		_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+		if err == nil {
+			t.Fatal("expected duplicate name to be rejected")
+		}
+		if resp == nil || resp.StatusCode != http.StatusConflict {
+			t.Errorf("expected status 409, got %v", resp)
+		}
+	})
+
+	t.Run("Leave", func(t *testing.T) {
+		send(t, bob, WebRTCMessage{Type: TypeLeave, Room: "call"})
+		msg := read(t, alice)
+		if msg.Type != TypePeerLeft || msg.From != "bob" {
+			t.Fatalf("expected peer-left for bob, got %+v", msg)
+		}
+
+		send(t, bob, WebRTCMessage{Type: TypeJoin, Room: "call"})
+		read(t, bob)
+		read(t, alice)
+
+		// Disconnecting also leaves every room
+		bob.Close()
+		msg = read(t, alice)
+		if msg.Type != TypePeerLeft || msg.From != "bob" {
+			t.Fatalf("expected peer-left after disconnect, got %+v", msg)
+		}
+	})
+}
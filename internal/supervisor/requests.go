@@ -0,0 +1,64 @@
+package supervisor
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// Requests counts in-flight HTTP requests so that servers without a graceful
+// shutdown of their own, like quic-go's HTTP/3 server, can still be drained
+// before they are closed
+type Requests struct {
+	mu     sync.Mutex
+	active int
+	idle   chan struct{} // closed when active drops back to zero
+}
+
+// Wrap returns a handler that tracks requests served by h
+func (r *Requests) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		if r.active == 0 {
+			r.idle = make(chan struct{})
+		}
+		r.active++
+		r.mu.Unlock()
+
+		defer func() {
+			r.mu.Lock()
+			r.active--
+			if r.active == 0 {
+				close(r.idle)
+			}
+			r.mu.Unlock()
+		}()
+
+		h.ServeHTTP(w, req)
+	})
+}
+
+// Active returns the number of requests currently being served
+func (r *Requests) Active() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.active
+}
+
+// Wait blocks until no requests are in flight or ctx is done
+func (r *Requests) Wait(ctx context.Context) error {
+	r.mu.Lock()
+	if r.active == 0 {
+		r.mu.Unlock()
+		return nil
+	}
+	idle := r.idle
+	r.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,155 @@
+// Package supervisor runs the long-lived components of the node and shuts
+// them down together.
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// RunFunc runs a component until it fails or ctx is canceled. ctx is canceled
+// as soon as shutdown begins.
+type RunFunc func(ctx context.Context) error
+
+// StopFunc stops a component, draining work until ctx expires
+type StopFunc func(ctx context.Context) error
+
+type component struct {
+	name string
+	run  RunFunc
+	stop StopFunc
+}
+
+type hook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// Supervisor starts components, waits for a shutdown request or the first
+// component failure, and then stops everything within a deadline
+type Supervisor struct {
+	shutdownTimeout time.Duration
+	components      []component
+	hooks           []hook
+}
+
+func New(shutdownTimeout time.Duration) *Supervisor {
+	return &Supervisor{shutdownTimeout: shutdownTimeout}
+}
+
+// Add registers a component. Either function may be nil: a component without
+// run only needs stopping, one without stop exits when its ctx is canceled.
+func (s *Supervisor) Add(name string, run RunFunc, stop StopFunc) {
+	s.components = append(s.components, component{name: name, run: run, stop: stop})
+}
+
+// OnShutdown registers a hook that runs, in registration order, before the
+// components are stopped. Their run contexts are already canceled, so
+// background work such as heartbeats does not overlap the hooks.
+func (s *Supervisor) OnShutdown(name string, fn func(ctx context.Context) error) {
+	s.hooks = append(s.hooks, hook{name: name, fn: fn})
+}
+
+type exit struct {
+	name string
+	err  error
+}
+
+// Run starts all components and blocks until ctx is canceled or a component
+// exits. It returns nil only when every component shut down cleanly.
+func (s *Supervisor) Run(ctx context.Context) error {
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+
+	exits := make(chan exit, len(s.components))
+	running := 0
+	for _, c := range s.components {
+		if c.run == nil {
+			continue
+		}
+		running++
+		go func(c component) {
+			exits <- exit{name: c.name, err: c.run(runCtx)}
+		}(c)
+	}
+
+	var errs []error
+	select {
+	case <-ctx.Done():
+		log.Printf("Shutting down gracefully...")
+	case e := <-exits:
+		running--
+		if e.err == nil {
+			e.err = errors.New("exited unexpectedly")
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", e.name, e.err))
+		log.Printf("Component %s failed, shutting down: %v", e.name, e.err)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+
+	cancelRun()
+	for _, h := range s.hooks {
+		if err := h.fn(shutdownCtx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", h.name, err))
+		}
+	}
+
+	errs = append(errs, s.stopAll(shutdownCtx)...)
+
+	// Errors returned while stopping are expected, only a missed deadline is not
+	for running > 0 {
+		select {
+		case <-exits:
+			running--
+		case <-shutdownCtx.Done():
+			errs = append(errs, fmt.Errorf("%d components did not stop within %v", running, s.shutdownTimeout))
+			return errors.Join(errs...)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Supervisor) stopAll(ctx context.Context) []error {
+	var (
+		mu   sync.Mutex
+		errs []error
+		wg   sync.WaitGroup
+	)
+	for _, c := range s.components {
+		if c.stop == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(c component) {
+			defer wg.Done()
+			if err := c.stop(ctx); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("stopping %s: %w", c.name, err))
+				mu.Unlock()
+			}
+		}(c)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		mu.Lock()
+		errs = append(errs, fmt.Errorf("stopping components: %w", ctx.Err()))
+		mu.Unlock()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]error(nil), errs...)
+}
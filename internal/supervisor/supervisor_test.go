@@ -0,0 +1,172 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSupervisor(t *testing.T) {
+	t.Run("Shutdown", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A request in flight when shutdown starts must be drained
+		release := make(chan struct{})
+		started := make(chan struct{})
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			w.Write([]byte("done"))
+		})}
+
+		var order []string
+		s := New(5 * time.Second)
+		s.Add("http", func(ctx context.Context) error {
+			return server.Serve(ln)
+		}, func(ctx context.Context) error {
+			order = append(order, "http")
+			return server.Shutdown(ctx)
+		})
+		s.Add("worker", func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}, nil)
+		s.OnShutdown("deregister", func(ctx context.Context) error {
+			order = append(order, "deregister")
+			return nil
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		result := make(chan error, 1)
+		go func() { result <- s.Run(ctx) }()
+
+		response := make(chan string, 1)
+		go func() {
+			resp, err := http.Get("http://" + ln.Addr().String())
+			if err != nil {
+				response <- err.Error()
+				return
+			}
+			defer resp.Body.Close()
+			var buf [4]byte
+			n, _ := resp.Body.Read(buf[:])
+			response <- string(buf[:n])
+		}()
+		<-started
+
+		cancel()
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+
+		if got := <-response; got != "done" {
+			t.Errorf("in-flight request was not drained: %s", got)
+		}
+		if err := <-result; err != nil {
+			t.Errorf("expected clean shutdown, got %v", err)
+		}
+		if strings.Join(order, ",") != "deregister,http" {
+			t.Errorf("expected hooks before stopping components, got %v", order)
+		}
+	})
+
+	t.Run("HooksAfterCancel", func(t *testing.T) {
+		// A heartbeat must not re-register the node while it deregisters
+		runCtx := make(chan context.Context, 1)
+		s := New(time.Second)
+		s.Add("heartbeat", func(ctx context.Context) error {
+			runCtx <- ctx
+			<-ctx.Done()
+			return ctx.Err()
+		}, nil)
+		var canceled bool
+		s.OnShutdown("deregister", func(ctx context.Context) error {
+			canceled = (<-runCtx).Err() != nil
+			return nil
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := s.Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if !canceled {
+			t.Error("expected components to be canceled before the shutdown hooks")
+		}
+	})
+
+	t.Run("ComponentFailure", func(t *testing.T) {
+		var stopped atomic.Bool
+		s := New(time.Second)
+		s.Add("broken", func(ctx context.Context) error {
+			return errors.New("address in use")
+		}, nil)
+		s.Add("healthy", func(ctx context.Context) error {
+			<-ctx.Done()
+			return nil
+		}, func(ctx context.Context) error {
+			stopped.Store(true)
+			return nil
+		})
+
+		err := s.Run(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "broken: address in use") {
+			t.Errorf("expected failure of broken component, got %v", err)
+		}
+		if !stopped.Load() {
+			t.Error("healthy component was not stopped")
+		}
+	})
+
+	t.Run("DrainRequests", func(t *testing.T) {
+		var requests Requests
+		release := make(chan struct{})
+		started := make(chan struct{})
+		handler := requests.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		}))
+		go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		<-started
+
+		if requests.Active() != 1 {
+			t.Errorf("expected one active request, got %d", requests.Active())
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if err := requests.Wait(ctx); err != context.DeadlineExceeded {
+			t.Errorf("expected wait to time out, got %v", err)
+		}
+
+		close(release)
+		if err := requests.Wait(context.Background()); err != nil {
+			t.Errorf("expected drained requests, got %v", err)
+		}
+	})
+
+	t.Run("Deadline", func(t *testing.T) {
+		s := New(50 * time.Millisecond)
+		s.Add("stuck", func(ctx context.Context) error {
+			select {}
+		}, nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		start := time.Now()
+		err := s.Run(ctx)
+		if err == nil || !strings.Contains(err.Error(), "did not stop") {
+			t.Errorf("expected deadline error, got %v", err)
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Error("shutdown did not respect the deadline")
+		}
+	})
+}
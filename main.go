@@ -1,128 +1,232 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"math/big"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 
+	"github.com/qnepff/qne-node-v12/internal/certmanager"
+	"github.com/qnepff/qne-node-v12/internal/certsource"
+	"github.com/qnepff/qne-node-v12/internal/config"
+	"github.com/qnepff/qne-node-v12/internal/heartbeat"
+	"github.com/qnepff/qne-node-v12/internal/identity"
+	"github.com/qnepff/qne-node-v12/internal/noise"
+	"github.com/qnepff/qne-node-v12/internal/protoloader"
 	"github.com/qnepff/qne-node-v12/internal/rest"
-)
-
-const (
-	addr = ":4445"
-	gatewayURL = "https://qne.name" // QNE gateway server URL
+	"github.com/qnepff/qne-node-v12/internal/rpc"
+	"github.com/qnepff/qne-node-v12/internal/signaling"
+	"github.com/qnepff/qne-node-v12/internal/supervisor"
 )
 
 var (
-	upgrader = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-	}
-
-	nodeID int64
-	nodeName string
-	segmentID string
-	certificate string
+	cfg *config.Config
+	identityStore *identity.Store
 	restClient *rest.Client
-	mu sync.RWMutex
+	certManager *certmanager.Manager
+
+	// registrationMu serializes registration, which the heartbeat and the
+	// certificate manager may both restart
+	registrationMu sync.Mutex
 )
 
-type WebRTCMessage struct {
-	Type      string      `json:"type"`
-	Offer     interface{} `json:"offer,omitempty"`
-	Answer    interface{} `json:"answer,omitempty"`
-	Candidate interface{} `json:"candidate,omitempty"`
+// serviceRetryInterval is the wait before loading configured gRPC services
+// the registry could not provide again
+const serviceRetryInterval = 30 * time.Second
+
+// protoGCInterval is how often unused protos are removed from the disk cache
+const protoGCInterval = time.Hour
+
+func start(ctx context.Context) error {
+	registrationMu.Lock()
+	defer registrationMu.Unlock()
+	return register(ctx)
 }
 
-func start() error {
+// register reuses the saved identity or registers a new one, and fetches the
+// QNE certificate for it
+func register(ctx context.Context) error {
 	// Initialize REST client if not already done
 	if restClient == nil {
-		restClient = rest.NewClient(gatewayURL)
+		restClient = rest.NewClient(cfg.GatewayURL)
+	}
+
+	// Reuse the saved identity as long as the gateway still accepts it
+	if id := identityStore.Get(); id.Registered() {
+		err := certManager.Renew(ctx)
+		switch {
+		case err == nil:
+			log.Printf("Reusing node ID %d and name '%s' in segment: %s", id.NodeID, id.NodeName, id.SegmentID)
+			return nil
+		case rest.IsRejected(err):
+			log.Printf("Saved identity for node ID %d was revoked, registering again: %v", id.NodeID, err)
+			if err := identityStore.ClearRegistration(); err != nil {
+				return fmt.Errorf("failed to clear revoked identity: %v", err)
+			}
+		default:
+			return fmt.Errorf("failed to verify saved identity: %w", err)
+		}
 	}
 
 	// Register in a segment and get assigned a node ID and temporary name
-	resp, err := restClient.RegisterInSegment()
+	resp, err := restClient.RegisterInSegmentContext(ctx)
+	if rest.IsRejected(err) {
+		return fmt.Errorf("registration rejected by gateway: %w", err)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to register in segment: %v", err)
+		return fmt.Errorf("gateway unavailable, failed to register in segment: %w", err)
 	}
 
-	mu.Lock()
-	nodeID = resp.NodeID
-	nodeName = resp.NodeName
-	segmentID = resp.SegmentID
-	mu.Unlock()
+	if err := identityStore.SetRegistration(resp.NodeID, resp.NodeName, resp.SegmentID); err != nil {
+		return fmt.Errorf("failed to save identity: %v", err)
+	}
 
-	log.Printf("Registered with node ID %d and name '%s' in segment: %s", nodeID, nodeName, segmentID)
+	log.Printf("Registered with node ID %d and name '%s' in segment: %s", resp.NodeID, resp.NodeName, resp.SegmentID)
 
 	// Get QNE certificate
-	certResp, err := restClient.GetQNECertificate(nodeID, nodeName, segmentID)
-	if err != nil {
-		return fmt.Errorf("failed to get QNE certificate: %v", err)
+	if err := certManager.Renew(ctx); err != nil {
+		return fmt.Errorf("failed to get QNE certificate: %w", err)
 	}
 
-	mu.Lock()
-	certificate = certResp.Certificate
-	mu.Unlock()
-
-	log.Printf("Retrieved QNE certificate")
+	log.Printf("Retrieved QNE certificate, valid until %s", certManager.NotAfter().Format(time.RFC3339))
 	return nil
 }
 
-func restart() error {
-	mu.Lock()
-	// Clear existing state
-	nodeID = 0
-	nodeName = ""
-	segmentID = ""
-	certificate = ""
-	mu.Unlock()
+// issueCertificate requests a QNE certificate for the current identity
+func issueCertificate(ctx context.Context, csr []byte) (string, error) {
+	id := identityStore.Get()
+	resp, err := restClient.RequestQNECertificateContext(ctx, rest.CertificateRequest{
+		NodeID:    id.NodeID,
+		NodeName:  id.NodeName,
+		SegmentID: id.SegmentID,
+		CSR:       string(csr),
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.Certificate, nil
+}
+
+func restart(ctx context.Context) error {
+	registrationMu.Lock()
+	defer registrationMu.Unlock()
+
+	// The node is shutting down and about to deregister
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Drop the saved identity so register() registers again
+	if err := identityStore.ClearRegistration(); err != nil {
+		return fmt.Errorf("failed to clear identity: %v", err)
+	}
 
 	// Start fresh
-	return start()
+	return register(ctx)
+}
+
+// deregister tells the gateway the node is going offline. The saved identity
+// is kept so the node comes back under the same ID. A registration still in
+// progress finishes first, so its node is the one deregistered.
+func deregister(ctx context.Context) error {
+	registrationMu.Lock()
+	defer registrationMu.Unlock()
+
+	id := identityStore.Get()
+	if !id.Registered() {
+		return nil
+	}
+	err := restClient.DeregisterContext(ctx, rest.DeregisterRequest{
+		NodeID:    id.NodeID,
+		NodeName:  id.NodeName,
+		SegmentID: id.SegmentID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to deregister node ID %d: %w", id.NodeID, err)
+	}
+	log.Printf("Deregistered node ID %d from the gateway", id.NodeID)
+	return nil
 }
 
 func main() {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	loaded, err := config.Load(os.Args[0], os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	cfg = loaded
+	restClient = rest.NewClient(cfg.GatewayURL)
+
+	store, err := identity.Open(cfg.DataDir)
+	if err != nil {
+		log.Fatalf("Failed to open identity store: %v", err)
+	}
+	identityStore = store
+
+	tlsKey, err := identityStore.TLSKey()
+	if err != nil {
+		log.Fatalf("Failed to load TLS key: %v", err)
+	}
+	certManager, err = certmanager.New(certmanager.Config{
+		Key:        tlsKey,
+		CommonName: func() string { return identityStore.Get().NodeName },
+		Issue:      issueCertificate,
+		OnRenewed: func(certPEM string) {
+			if err := identityStore.SetCertificate(certPEM); err != nil {
+				log.Printf("Failed to save QNE certificate: %v", err)
+			}
+		},
+		OnRefused: restart,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create certificate manager: %v", err)
+	}
+	// Serve the saved certificate until the first renewal
+	if saved := identityStore.Get().Certificate; saved != "" {
+		if err := certManager.Load(saved); err != nil {
+			log.Printf("Ignoring saved QNE certificate: %v", err)
+		}
+	}
 
-	tlsConfig, err := generateTLSConfig()
+	certSource, err := newCertSource()
 	if err != nil {
-		log.Fatalf("Failed to generate TLS config: %v", err)
+		log.Fatalf("Failed to set up TLS certificates: %v", err)
 	}
+	// Both servers share one config so certificate changes reach them alike
+	tlsConfig := certsource.TLSConfig(certSource)
 
 	quicConfig := &quic.Config{
-		EnableDatagrams:       true,
-		MaxIdleTimeout:        30 * time.Second,
-		KeepAlivePeriod:      10 * time.Second,
-		HandshakeIdleTimeout:  5 * time.Second,
-		MaxIncomingStreams:   1000,
-		MaxIncomingUniStreams: 1000,
-		Allow0RTT:            true,
+		EnableDatagrams:       cfg.QUIC.EnableDatagrams,
+		MaxIdleTimeout:        cfg.QUIC.MaxIdleTimeout,
+		KeepAlivePeriod:       cfg.QUIC.KeepAlivePeriod,
+		HandshakeIdleTimeout:  cfg.QUIC.HandshakeIdleTimeout,
+		MaxIncomingStreams:    cfg.QUIC.MaxIncomingStreams,
+		MaxIncomingUniStreams: cfg.QUIC.MaxIncomingUniStreams,
+		Allow0RTT:             cfg.QUIC.Allow0RTT,
 		Versions:             []quic.VersionNumber{quic.Version1},
 	}
 
 	mux := http.NewServeMux()
 
 	// Handle WebSocket endpoint
-	mux.HandleFunc("/ws", handleWebSocket)
+	hub := signaling.NewHub()
+	mux.Handle("/ws", hub)
 
 	// Handle static files
 	fileHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -132,7 +236,7 @@ func main() {
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 
 		// Add Alt-Svc header for HTTP/3
-		w.Header().Set("Alt-Svc", fmt.Sprintf(`h3=":%s"`, addr))
+		w.Header().Set("Alt-Svc", fmt.Sprintf(`h3=":%s"`, cfg.Port()))
 
 		// Set content type based on file extension
 		if strings.HasSuffix(r.URL.Path, ".css") {
@@ -144,113 +248,260 @@ func main() {
 		}
 
 		// Serve static files from the generated output directory
-		fs := http.FileServer(http.Dir("frontend/.output/public"))
+		fs := http.FileServer(http.Dir(cfg.StaticRoot))
 		fs.ServeHTTP(w, r)
 	})
 
 	mux.Handle("/", fileHandler)
 
+	// Registry services are served over gRPC next to the other handlers.
+	// gRPC needs HTTP/2, so only the HTTP/2 server routes to it.
+	rpcServer := rpc.NewServer()
+	var rpcRequests supervisor.Requests
+
+	// quic-go cannot close HTTP/3 gracefully, so count its requests to drain
+	// them. HTTP/2 requests are only counted for the reported load.
+	var http3Requests, http2Requests supervisor.Requests
+
 	// Create HTTP/3 server
 	http3Server := &http3.Server{
-		Handler:         mux,
-		Addr:           addr,
+		Handler:         http3Requests.Wrap(mux),
+		Addr:           cfg.Addr,
 		QuicConfig:     quicConfig,
 		TLSConfig:      tlsConfig,
-		EnableDatagrams: true,
+		EnableDatagrams: cfg.QUIC.EnableDatagrams,
 	}
 
 	// Create HTTP/2 server
 	http2Server := &http.Server{
-		Addr:      addr,
-		Handler:   mux,
+		Addr:      cfg.Addr,
+		Handler:   http2Requests.Wrap(rpc.Route(rpcRequests.Wrap(rpcServer), mux)),
 		TLSConfig: tlsConfig,
 	}
 
-	// Start HTTP/3 server
-	go func() {
-		fmt.Printf("Starting HTTP/3 server on %s\n", addr)
-		if err := http3Server.ListenAndServeTLS("localhost.crt", "localhost.key"); err != nil {
-			log.Printf("HTTP/3 server error: %v", err)
-		}
-	}()
+	// Start Noise peer transport
+	staticKey, err := identityStore.StaticKey()
+	if err != nil {
+		log.Fatalf("Failed to load Noise static key: %v", err)
+	}
+	noiseNode, err := noise.Listen(cfg.NoiseAddr, noise.Config{StaticKey: staticKey})
+	if err != nil {
+		log.Fatalf("Failed to start Noise transport: %v", err)
+	}
+	fmt.Printf("Starting Noise transport on %s\n", cfg.NoiseAddr)
 
-	// Start HTTP/2 server
-	go func() {
-		fmt.Printf("Starting HTTP/2 server on %s\n", addr)
-		if err := http2Server.ListenAndServeTLS("localhost.crt", "localhost.key"); err != nil {
-			log.Printf("HTTP/2 server error: %v", err)
+	// Registry protos of the node, kept in the data directory
+	protoLoader, err := protoloader.New(cfg.GatewayURL, filepath.Join(cfg.DataDir, "proto-cache"), filepath.Join(cfg.DataDir, "proto-compiled"))
+	if err != nil {
+		log.Fatalf("Failed to create proto loader: %v", err)
+	}
+	if cfg.TrustAnchors != "" {
+		anchors, err := protoloader.LoadTrustAnchors(cfg.TrustAnchors)
+		if err != nil {
+			log.Fatalf("Failed to load registry trust anchors: %v", err)
 		}
-	}()
-
-	if err := start(); err != nil {
-		log.Fatalf("Failed to start: %v", err)
+		protoLoader.SetTrustAnchors(anchors...)
+	} else {
+		log.Printf("No registry trust anchors set, protos will not be loaded")
 	}
+	// Registry writes are signed with the node's QNE certificate
+	protoLoader.SetCertificate(certManager.Certificate)
+
+	sup := supervisor.New(cfg.ShutdownTimeout)
+
+	sup.Add("HTTP/3 server", func(ctx context.Context) error {
+		fmt.Printf("Starting HTTP/3 server on %s\n", cfg.Addr)
+		return http3Server.ListenAndServe()
+	}, func(ctx context.Context) error {
+		drainErr := http3Requests.Wait(ctx)
+		if err := http3Server.Close(); err != nil {
+			return err
+		}
+		return drainErr
+	})
 
-	<-sigChan
-	fmt.Println("\nShutting down gracefully...")
-}
+	sup.Add("HTTP/2 server", func(ctx context.Context) error {
+		fmt.Printf("Starting HTTP/2 server on %s\n", cfg.Addr)
+		return http2Server.ListenAndServeTLS("", "")
+	}, http2Server.Shutdown)
+
+	// Streaming calls would hold up the HTTP/2 server's Shutdown until they
+	// end, so they are drained here and then canceled
+	sup.Add("gRPC services", hostServices(protoLoader, rpcServer), func(ctx context.Context) error {
+		drainErr := rpcRequests.Wait(ctx)
+		rpcServer.Stop()
+		return drainErr
+	})
+
+	sup.Add("proto cache GC", func(ctx context.Context) error {
+		protoLoader.RunGC(ctx, protoGCInterval)
+		return nil
+	}, nil)
+
+	// Hijacked WebSocket connections are not drained by Shutdown
+	sup.Add("WebSocket hub", nil, func(ctx context.Context) error {
+		return hub.Close()
+	})
+
+	sup.Add("Noise transport", func(ctx context.Context) error {
+		handlePeerMessages(noiseNode)
+		return nil
+	}, func(ctx context.Context) error {
+		return noiseNode.Close()
+	})
 
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	sup.Add("gateway registration", func(ctx context.Context) error {
+		if err := start(ctx); err != nil {
+			return err
+		}
+		return certManager.Run(ctx)
+	}, nil)
+
+	reporter, err := heartbeat.New(heartbeat.Config{
+		Client:   restClient,
+		Interval: cfg.HeartbeatInterval,
+		Report: func() (rest.HeartbeatRequest, bool) {
+			id := identityStore.Get()
+			return rest.HeartbeatRequest{
+				NodeID:     id.NodeID,
+				NodeName:   id.NodeName,
+				SegmentID:  id.SegmentID,
+				PublicAddr: publicAddr(),
+				NoiseAddr:  noiseAddr(),
+				Protocols:  []string{"h3", "h2", noise.Protocol, signaling.Protocol, rpc.Protocol},
+				Load: rest.LoadReport{
+					Connections:  hub.Clients(),
+					PeerSessions: noiseNode.Sessions(),
+					Requests:     http3Requests.Active() + http2Requests.Active(),
+					Goroutines:   runtime.NumGoroutine(),
+				},
+			}, id.Registered()
+		},
+		OnUnknownNode: restart,
+	})
 	if err != nil {
-		log.Printf("Failed to upgrade WebSocket connection: %v", err)
-		return
+		log.Fatalf("Failed to create heartbeat: %v", err)
 	}
-	defer conn.Close()
+	sup.Add("gateway heartbeat", reporter.Run, nil)
+	sup.OnShutdown("gateway deregistration", deregister)
 
-	for {
-		var msg WebRTCMessage
-		err := conn.ReadJSON(&msg)
-		if err != nil {
-			log.Printf("Failed to read WebSocket message: %v", err)
-			break
-		}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-		// Echo the message back
-		if err := conn.WriteJSON(msg); err != nil {
-			log.Printf("Failed to write WebSocket message: %v", err)
-			break
-		}
+	if err := sup.Run(ctx); err != nil {
+		log.Printf("Shutdown with errors: %v", err)
+		stop()
+		os.Exit(1)
 	}
 }
 
-func generateTLSConfig() (*tls.Config, error) {
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return nil, err
+// publicAddr returns the HTTPS address reported to the gateway
+func publicAddr() string {
+	if cfg.PublicAddr != "" {
+		return cfg.PublicAddr
 	}
+	return ":" + cfg.Port()
+}
 
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().Add(24 * time.Hour),
-		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
-		DNSNames:     []string{"localhost"},
-	}
+// noiseAddr returns the Noise address reported to the gateway, on the public
+// host when one is configured
+func noiseAddr() string {
+	_, port, _ := net.SplitHostPort(cfg.NoiseAddr)
+	host, _, _ := net.SplitHostPort(cfg.PublicAddr)
+	return net.JoinHostPort(host, port)
+}
 
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
-	if err != nil {
-		return nil, err
+// newCertSource builds the certificate source selected in the configuration
+func newCertSource() (certsource.Source, error) {
+	var chain certsource.Chain
+
+	switch cfg.TLS.Source {
+	case config.TLSSourceQNE:
+		chain = append(chain, certManager)
+		if cfg.TLS.CertFile != "" {
+			files, err := certsource.NewFiles(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, files)
+		}
+	case config.TLSSourceFiles:
+		files, err := certsource.NewFiles(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, files)
 	}
 
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
-
-	// Write the certificate and key to files
-	if err := os.WriteFile("localhost.crt", certPEM, 0644); err != nil {
-		return nil, fmt.Errorf("failed to write certificate file: %v", err)
+	if cfg.TLS.Source == config.TLSSourceSelfSigned || cfg.TLS.SelfSignedFallback {
+		log.Printf("TLS falls back to a self-signed development certificate, clients will not trust it")
+		chain = append(chain, certsource.NewSelfSigned())
 	}
-	if err := os.WriteFile("localhost.key", keyPEM, 0600); err != nil {
-		return nil, fmt.Errorf("failed to write key file: %v", err)
+	return chain, nil
+}
+
+// hostServices returns the component loading the gRPC services in the
+// configuration from the registry and forwarding their calls to HTTP
+// backends. Services that cannot be loaded or registered are retried, as the
+// gateway may not be reachable yet. Protos are verified against the loader's
+// trust anchors.
+func hostServices(loader *protoloader.ProtoLoader, server *rpc.Server) supervisor.RunFunc {
+	return func(ctx context.Context) error {
+		pending := cfg.RPC.Services
+		if len(pending) > 0 {
+			for {
+				pending = hostPending(ctx, loader, server, pending)
+				if len(pending) == 0 {
+					break
+				}
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(serviceRetryInterval):
+				}
+			}
+		}
+		<-ctx.Done()
+		return nil
 	}
+}
 
-	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
-	if err != nil {
-		return nil, err
+// hostPending registers services with the server and returns the ones to
+// retry
+func hostPending(ctx context.Context, loader *protoloader.ProtoLoader, server *rpc.Server, services []config.RPCService) []config.RPCService {
+	var retry []config.RPCService
+	for _, svc := range services {
+		sd, err := loader.Service(ctx, svc.Proto, svc.Service)
+		if err != nil {
+			log.Printf("Failed to load gRPC service %s of proto %d: %v", svc.Service, svc.Proto, err)
+			retry = append(retry, svc)
+			continue
+		}
+		backend := rpc.HTTPBackend(svc.Backend, http.DefaultClient)
+		handlers := make(map[string]rpc.Handler)
+		methods := sd.Methods()
+		for i := 0; i < methods.Len(); i++ {
+			handlers[string(methods.Get(i).Name())] = backend
+		}
+		if err := server.RegisterService(sd, handlers); err != nil {
+			// A newer version of the proto may no longer conflict
+			log.Printf("Failed to serve gRPC service %s: %v", sd.FullName(), err)
+			retry = append(retry, svc)
+			continue
+		}
+		// Keep serving it from the disk cache when the gateway is unreachable
+		loader.Pin(svc.Proto)
+		log.Printf("Serving gRPC service %s, forwarded to %s", sd.FullName(), svc.Backend)
 	}
+	return retry
+}
 
-	return &tls.Config{
-		Certificates: []tls.Certificate{tlsCert},
-		NextProtos:  []string{"h3", "h2"},
-	}, nil
+func handlePeerMessages(node *noise.Node) {
+	for {
+		msg, err := node.Receive()
+		if err != nil {
+			return
+		}
+		log.Printf("Received %d bytes from peer %s", len(msg.Data), msg.Peer)
+	}
 }